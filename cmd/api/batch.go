@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"net/http"
+)
+
+// batchResult is the outcome of a single operation of a batch
+type batchResult struct {
+	Op    string      `json:"op"`
+	ID    int64       `json:"id"`
+	Movie *data.Movie `json:"movie,omitempty"`
+}
+
+// batchMoviesHandler applies a list of creates, patches and deletes atomically. Patches carry
+// the version the client expects, as the If-Match header does for a single update. When any
+// operation fails the whole batch is rolled back and the error names the operation at fault
+// curl -X POST -d '{"operations": [{"op": "patch", "id": 1, "version": 2, "movie": {"year": 2017}}, {"op": "delete", "id": 4}]}' localhost:4000/v1/movies/batch
+func (app *application) batchMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Operations []struct {
+			Op      string     `json:"op"`
+			ID      int64      `json:"id"`
+			Version int32      `json:"version"`
+			Movie   moviePatch `json:"movie"`
+		} `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Operations) > 0, "operations", "must be provided")
+	v.Check(len(input.Operations) <= data.MaxMovieOperations, "operations", fmt.Sprintf("must not contain more than %d operations", data.MaxMovieOperations))
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// movies as earlier operations of the batch leave them, so that a movie can be changed
+	// more than once in the same batch
+	pending := make(map[int64]*data.Movie)
+
+	ops := make([]*data.MovieOperation, len(input.Operations))
+
+	for i, in := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+		op := &data.MovieOperation{Op: in.Op}
+
+		switch in.Op {
+		case data.MovieOpCreate:
+			op.Movie = &data.Movie{}
+			in.Movie.apply(op.Movie)
+
+		case data.MovieOpPatch, data.MovieOpDelete:
+			if in.ID < 1 {
+				v.AddError(key+".id", "must be provided")
+				continue
+			}
+
+			current, ok := pending[in.ID]
+			if !ok {
+				current, err = app.models.Movies.Get(r.Context(), in.ID)
+				if err != nil {
+					switch {
+					case errors.Is(err, data.ErrNoRecordFound):
+						app.errorResponse(w, r, http.StatusNotFound, fmt.Sprintf("%s: movie %d could not be found", key, in.ID))
+					default:
+						app.serverErrorResponse(w, r, err)
+					}
+					return
+				}
+			}
+
+			if current == nil {
+				app.errorResponse(w, r, http.StatusNotFound, fmt.Sprintf("%s: movie %d is deleted by an earlier operation", key, in.ID))
+				return
+			}
+
+			cp := *current
+			op.Movie = &cp
+
+			if in.Op == data.MovieOpDelete {
+				pending[in.ID] = nil
+				break
+			}
+
+			v.Check(in.Version > 0, key+".version", "must be provided")
+			if in.Version > 0 && in.Version != current.Version {
+				app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("%s: movie %d is at version %d", key, in.ID, current.Version))
+				return
+			}
+
+			in.Movie.apply(op.Movie)
+
+			next := *op.Movie
+			next.Version++
+			pending[in.ID] = &next
+
+		default:
+			v.AddError(key+".op", fmt.Sprintf("must be one of %s, %s or %s", data.MovieOpCreate, data.MovieOpPatch, data.MovieOpDelete))
+			continue
+		}
+
+		if op.Op != data.MovieOpDelete {
+			mv := validator.New()
+			data.ValidateMovie(mv, op.Movie)
+
+			for field, message := range mv.Errors {
+				v.AddError(key+".movie."+field, message)
+			}
+		}
+
+		ops[i] = op
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Movies.Batch(r.Context(), ops, app.contextGetUser(r).ID)
+	if err != nil {
+		var batchErr *data.BatchError
+
+		switch {
+		case errors.As(err, &batchErr) && errors.Is(err, data.ErrEditConflict):
+			app.errorResponse(w, r, http.StatusConflict, fmt.Sprintf("operations[%d]: unable to update the record due to an edit conflict, please try again", batchErr.Index))
+		case errors.As(err, &batchErr) && errors.Is(err, data.ErrNoRecordFound):
+			app.errorResponse(w, r, http.StatusNotFound, fmt.Sprintf("operations[%d]: the movie could not be found", batchErr.Index))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		results[i] = batchResult{Op: op.Op, ID: op.Movie.ID}
+
+		if op.Op != data.MovieOpDelete {
+			results[i].Movie = op.Movie
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
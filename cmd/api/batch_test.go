@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"testing"
+)
+
+func TestBatchMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	editor := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+
+	op := func(fields ...interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			m[fields[i].(string)] = fields[i+1]
+		}
+		return m
+	}
+
+	batch := func(ops ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"operations": ops}
+	}
+
+	rejected := []struct {
+		name       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"missing permission", reader, batch(op("op", "delete", "id", 1)), http.StatusForbidden},
+		{"no operations", editor, batch(), http.StatusUnprocessableEntity},
+		{"unknown op", editor, batch(op("op", "upsert", "id", 1)), http.StatusUnprocessableEntity},
+		{"missing id", editor, batch(op("op", "delete")), http.StatusUnprocessableEntity},
+		{"missing version", editor, batch(op("op", "patch", "id", 1, "movie", op("year", 2017))), http.StatusUnprocessableEntity},
+		{"invalid create", editor, batch(op("op", "delete", "id", 3), op("op", "create", "movie", op("title", "Up"))), http.StatusUnprocessableEntity},
+		{"stale version", editor, batch(op("op", "delete", "id", 3), op("op", "patch", "id", 1, "version", 2, "movie", op("year", 2017))), http.StatusConflict},
+		{"unknown movie", editor, batch(op("op", "delete", "id", 3), op("op", "delete", "id", 9)), http.StatusNotFound},
+		{"deleted twice", editor, batch(op("op", "delete", "id", 3), op("op", "delete", "id", 3)), http.StatusNotFound},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/movies/batch", tt.token, tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	// none of the rejected batches may have deleted the third movie
+	if res := ts.do(t, http.MethodGet, "/v1/movies/3", reader, nil); res.status != http.StatusOK {
+		t.Fatalf("got status %d for a movie deleted by a rejected batch; want %d", res.status, http.StatusOK)
+	}
+
+	res := ts.do(t, http.MethodPost, "/v1/movies/batch", editor, batch(
+		op("op", "create", "movie", op("title", "Moana", "year", 2016, "runtime", "107 mins", "genres", []string{"animation"})),
+		op("op", "patch", "id", 1, "version", 1, "movie", op("year", 2017)),
+		op("op", "patch", "id", 1, "version", 2, "movie", op("title", "Black Panther II")),
+		op("op", "delete", "id", 3),
+	))
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	var got struct {
+		Results []struct {
+			Op    string `json:"op"`
+			ID    int64  `json:"id"`
+			Movie *struct {
+				Title   string `json:"title"`
+				Year    int32  `json:"year"`
+				Version int32  `json:"version"`
+			} `json:"movie"`
+		} `json:"results"`
+	}
+	res.decode(t, &got)
+
+	if len(got.Results) != 4 {
+		t.Fatalf("got %d results; want 4", len(got.Results))
+	}
+
+	if r := got.Results[0]; r.Op != "create" || r.ID != 4 || r.Movie == nil || r.Movie.Title != "Moana" {
+		t.Errorf("got create result %+v", r)
+	}
+
+	if r := got.Results[2]; r.ID != 1 || r.Movie == nil || r.Movie.Title != "Black Panther II" || r.Movie.Year != 2017 || r.Movie.Version != 3 {
+		t.Errorf("got patch result %+v", r)
+	}
+
+	if r := got.Results[3]; r.Op != "delete" || r.ID != 3 || r.Movie != nil {
+		t.Errorf("got delete result %+v", r)
+	}
+
+	if res := ts.do(t, http.MethodGet, "/v1/movies/3", reader, nil); res.status != http.StatusNotFound {
+		t.Errorf("got status %d for a deleted movie; want %d", res.status, http.StatusNotFound)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	ops := []*data.MovieOperation{
+		{Op: data.MovieOpCreate, Movie: &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}},
+		{Op: data.MovieOpDelete, Movie: &data.Movie{ID: 1}},
+		{Op: data.MovieOpPatch, Movie: &data.Movie{ID: 1, Title: "Deadpool 2", Year: 2018, Runtime: 119, Genres: []string{"action"}, Version: 1}},
+	}
+
+	err := app.models.Movies.Batch(context.Background(), ops, 0)
+
+	var batchErr *data.BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 2 || !errors.Is(err, data.ErrEditConflict) {
+		t.Fatalf("got error %v; want an edit conflict on operation 2", err)
+	}
+
+	if _, err := app.models.Movies.Get(context.Background(), 1); err != nil {
+		t.Errorf("got error %v getting a movie whose deletion was rolled back", err)
+	}
+
+	if _, err := app.models.Movies.Get(context.Background(), 2); !errors.Is(err, data.ErrNoRecordFound) {
+		t.Errorf("got error %v getting a movie whose creation was rolled back; want %v", err, data.ErrNoRecordFound)
+	}
+
+	revisions, err := app.models.Revisions.GetAllForMovie(context.Background(), 1)
+	if err != nil || len(revisions) != 1 {
+		t.Errorf("got %d revisions (%v); want only the original one", len(revisions), err)
+	}
+}
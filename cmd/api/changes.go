@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/jsonlog"
+	"github.com/lib/pq"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	changeBufferSize   = 64 // changes queued for a subscriber before it is dropped as too slow
+	changeFetchSize    = 500
+	changePollInterval = 5 * time.Second // catches up on lost notifications and changes held back by older transactions
+	changeHeartbeat    = 15 * time.Second
+	changeRetry        = 3 * time.Second // how long EventSource clients wait before reconnecting
+)
+
+// changeBroker reads new entries of the movie change log whenever it is woken up and fans
+// them out to the subscribed streams
+type changeBroker struct {
+	changes data.MovieChangeStore
+	logger  *jsonlog.Logger
+	wakeup  chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[chan *data.MovieChange]struct{}
+	closed      bool
+}
+
+func newChangeBroker(changes data.MovieChangeStore, logger *jsonlog.Logger) *changeBroker {
+	return &changeBroker{
+		changes:     changes,
+		logger:      logger,
+		wakeup:      make(chan struct{}, 1),
+		subscribers: make(map[chan *data.MovieChange]struct{}),
+	}
+}
+
+// subscribe returns a channel receiving every change read from now on, along with a function
+// to unsubscribe. The channel is closed when the broker stops or the subscriber falls too far
+// behind, either way the client is expected to resume from the last change it got
+func (b *changeBroker) subscribe() (<-chan *data.MovieChange, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan *data.MovieChange, changeBufferSize)
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *changeBroker) publish(change *data.MovieChange) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- change:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every subscription and turns away new ones
+func (b *changeBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+
+	b.closed = true
+}
+
+// wake asks the broker to look for new changes. It never blocks
+func (b *changeBroker) wake() {
+	select {
+	case b.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes the changes following lastID as it is woken up, until ctx is cancelled
+func (b *changeBroker) run(ctx context.Context, lastID int64) {
+	defer b.close()
+
+	ticker := time.NewTicker(changePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.wakeup:
+		case <-ticker.C:
+		}
+
+		for {
+			changes, err := b.changes.GetAfter(ctx, lastID, changeFetchSize)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					b.logger.PrintError(err, nil)
+				}
+				break
+			}
+
+			for _, change := range changes {
+				b.publish(change)
+				lastID = change.ID
+			}
+
+			if len(changes) < changeFetchSize {
+				break
+			}
+		}
+	}
+}
+
+// runChangeBroker starts the broker from the latest change, retrying until the change log
+// can be read or ctx is cancelled
+func (app *application) runChangeBroker(ctx context.Context) {
+	for {
+		lastID, err := app.models.MovieChanges.LatestID(ctx)
+		if err == nil {
+			app.changes.run(ctx, lastID)
+			return
+		}
+
+		if !errors.Is(err, context.Canceled) {
+			app.logger.PrintError(err, nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			app.changes.close()
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// listenForChanges wakes the broker up whenever the movie_changes trigger sends a
+// notification, until ctx is cancelled
+func (app *application) listenForChanges(ctx context.Context) {
+	listener := pq.NewListener(app.config.db.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	defer listener.Close()
+
+	// the listener keeps trying to connect in the background when this fails
+	err := listener.Listen(data.MovieChangesChannel)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		// a nil notification follows a reconnection, after which the broker catches up all the same
+		case <-listener.Notify:
+			app.changes.wake()
+		case <-ticker.C:
+			go listener.Ping()
+		}
+	}
+}
+
+// purgeMovieChanges trims the change log once an hour until ctx is cancelled
+func (app *application) purgeMovieChanges(ctx context.Context) {
+	if app.config.changes.retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		purged, err := app.models.MovieChanges.DeleteBefore(ctx, time.Now().Add(-app.config.changes.retention))
+		switch {
+		case err != nil && !errors.Is(err, context.Canceled):
+			app.logger.PrintError(err, nil)
+		case purged > 0:
+			app.logger.PrintInfo("purged movie changes", map[string]string{"count": strconv.FormatInt(purged, 10)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeChange writes the change as a Server-Sent Event named after its action
+func writeChange(w http.ResponseWriter, change *data.MovieChange) error {
+	js, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.ID, change.Action, js)
+	return err
+}
+
+// movieChangesHandler streams the changes made to movies as Server-Sent Events. A client
+// sending Last-Event-ID first gets the changes it missed, as long as they are still in the log.
+// The stream ends when the server shuts down or the client can't keep up, EventSource
+// clients reconnect on their own and resume where they left off
+// curl -N -H 'Last-Event-ID: 42' localhost:4000/v1/movies/changes
+func (app *application) movieChangesHandler(w http.ResponseWriter, r *http.Request) {
+	var lastID int64
+	resume := false
+
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id < 0 {
+			app.badRequestResponse(w, r, errors.New("Last-Event-ID must be the id of a change"))
+			return
+		}
+
+		lastID, resume = id, true
+	}
+
+	// subscribe before reading the backlog so that nothing falls in between
+	changes, unsubscribe := app.changes.subscribe()
+	defer unsubscribe()
+
+	// the stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", changeRetry.Milliseconds())
+
+	// the last change sent, anything the broker publishes up to it came with the backlog
+	var last *data.MovieChange
+
+	for resume {
+		backlog, err := app.models.MovieChanges.GetAfter(r.Context(), lastID, changeFetchSize)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				app.logError(r, err)
+			}
+			return
+		}
+
+		for _, change := range backlog {
+			if err := writeChange(w, change); err != nil {
+				return
+			}
+			lastID, last = change.ID, change
+		}
+
+		resume = len(backlog) == changeFetchSize
+	}
+
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			// already sent from the backlog
+			if last != nil && !last.Before(change) {
+				continue
+			}
+
+			if err := writeChange(w, change); err != nil {
+				return
+			}
+			last = change
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/4925k/greenlight/internal/data"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// openChangeStream connects to the change feed, failing the test unless the stream starts
+func openChangeStream(t *testing.T, ts *testServer, token, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d with content type %q; want an event stream", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	return bufio.NewReader(res.Body)
+}
+
+// nextEvent reads the stream up to the next event, skipping comments and retry hints
+func nextEvent(t *testing.T, r *bufio.Reader) (sseEvent, error) {
+	t.Helper()
+
+	var ev sseEvent
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return ev, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if ev.data != "" {
+				return ev, nil
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestMovieChanges(t *testing.T) {
+	app := newTestApplication(t)
+	app.changes = newChangeBroker(app.models.MovieChanges, app.logger)
+
+	ctx, stop := context.WithCancel(context.Background())
+	t.Cleanup(stop)
+
+	insertMovie(t, app, "Moana", 2016, 107, "animation")
+	insertMovie(t, app, "Up", 2009, 96, "animation")
+
+	go app.changes.run(ctx, 2)
+
+	ts := newTestServer(t, app.routes())
+
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+	editor := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write")
+
+	t.Run("invalid Last-Event-ID", func(t *testing.T) {
+		res := ts.do(t, http.MethodGet, "/v1/movies/changes", reader, nil, "Last-Event-ID", "latest")
+		if res.status != http.StatusBadRequest {
+			t.Errorf("got status %d; want %d", res.status, http.StatusBadRequest)
+		}
+	})
+
+	resumed := openChangeStream(t, ts, reader, "1")
+	live := openChangeStream(t, ts, reader, "")
+
+	// the resumed stream starts with the change it missed
+	ev, err := nextEvent(t, resumed)
+	if err != nil || ev.id != "2" || ev.event != data.RevisionCreate {
+		t.Fatalf("got event %+v (%v); want the creation of the second movie", ev, err)
+	}
+
+	ts.do(t, http.MethodPatch, "/v1/movies/1", editor, map[string]interface{}{"year": 2017})
+	ts.do(t, http.MethodDelete, "/v1/movies/2", editor, nil)
+	app.changes.wake()
+
+	for name, stream := range map[string]*bufio.Reader{"resumed": resumed, "live": live} {
+		for _, want := range []struct{ id, event string }{{"3", data.RevisionUpdate}, {"4", data.RevisionDelete}} {
+			ev, err := nextEvent(t, stream)
+			if err != nil || ev.id != want.id || ev.event != want.event {
+				t.Fatalf("%s: got event %+v (%v); want %s %s", name, ev, err, want.id, want.event)
+			}
+
+			var change data.MovieChange
+			if err := json.Unmarshal([]byte(ev.data), &change); err != nil {
+				t.Fatal(err)
+			}
+
+			if want.event == data.RevisionUpdate && (change.MovieID != 1 || change.Movie.Year != 2017 || change.Movie.Version != 2) {
+				t.Errorf("%s: got change %+v; want movie 1 at version 2", name, change)
+			}
+		}
+	}
+
+	t.Run("shutdown ends the streams", func(t *testing.T) {
+		stop()
+
+		for name, stream := range map[string]*bufio.Reader{"resumed": resumed, "live": live} {
+			if _, err := nextEvent(t, stream); !errors.Is(err, io.EOF) {
+				t.Errorf("%s: got error %v; want the stream to end", name, err)
+			}
+		}
+	})
+}
+
+func TestChangeBrokerDropsSlowSubscribers(t *testing.T) {
+	app := newTestApplication(t)
+	broker := newChangeBroker(app.models.MovieChanges, app.logger)
+
+	slow, _ := broker.subscribe()
+	fast, unsubscribe := broker.subscribe()
+	defer unsubscribe()
+
+	for i := 1; i <= changeBufferSize+1; i++ {
+		broker.publish(&data.MovieChange{ID: int64(i)})
+
+		// keep the fast subscriber's queue empty
+		<-fast
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+
+	if received != changeBufferSize {
+		t.Errorf("got %d changes before the slow subscriber was dropped; want %d", received, changeBufferSize)
+	}
+
+	broker.publish(&data.MovieChange{ID: changeBufferSize + 2})
+
+	if change, ok := <-fast; !ok || change.ID != changeBufferSize+2 {
+		t.Errorf("got change %v, open %t; want the fast subscriber still subscribed", change, ok)
+	}
+}
+
+func TestMovieChangeOrder(t *testing.T) {
+	// ids are handed out as changes are made, but the log follows the order transactions commit in
+	first := &data.MovieChange{ID: 7, TxID: 100}
+	second := &data.MovieChange{ID: 5, TxID: 101}
+	third := &data.MovieChange{ID: 8, TxID: 101}
+
+	for _, tt := range []struct {
+		a, b *data.MovieChange
+		want bool
+	}{
+		{first, second, true},
+		{second, first, false},
+		{second, third, true},
+		{third, second, false},
+		{first, first, false},
+	} {
+		if got := tt.a.Before(tt.b); got != tt.want {
+			t.Errorf("change %d before change %d: got %t; want %t", tt.a.ID, tt.b.ID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"net/http"
+	"net/url"
+)
+
+// readInclude parses the comma separated include parameter, recording a validation error
+// for anything not in allowed
+func (app *application) readInclude(qs url.Values, v *validator.Validator, allowed ...string) map[string]bool {
+	include := make(map[string]bool)
+
+	for _, value := range app.readCSV(qs, "include", []string{}) {
+		if !validator.In(value, allowed...) {
+			v.AddError("include", fmt.Sprintf("unknown value %q", value))
+			continue
+		}
+
+		include[value] = true
+	}
+
+	return include
+}
+
+// attachCredits fills in the credits of every movie with a single query
+func (app *application) attachCredits(ctx context.Context, movies ...*data.Movie) error {
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+
+	credits, err := app.models.Credits.GetAllForMovies(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		movie.Credits = credits[movie.ID]
+		if movie.Credits == nil {
+			movie.Credits = []*data.Credit{}
+		}
+	}
+
+	return nil
+}
+
+// listCreditsHandler returns everyone credited on a movie
+// curl localhost:4000/v1/movies/123/credits
+func (app *application) listCreditsHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovie(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.attachCredits(r.Context(), movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"credits": movie.Credits}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createCreditHandler credits a person on a movie
+// curl -X POST -d '{"person_id": 1, "role": "actor", "character": "Wade Wilson"}' localhost:4000/v1/movies/123/credits
+func (app *application) createCreditHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovie(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		PersonID  int64  `json:"person_id"`
+		Role      string `json:"role"`
+		Character string `json:"character"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	credit := &data.Credit{
+		MovieID:   movie.ID,
+		PersonID:  input.PersonID,
+		Role:      input.Role,
+		Character: input.Character,
+	}
+
+	v := validator.New()
+	if data.ValidateCredit(v, credit); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Credits.Insert(r.Context(), credit)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCredit):
+			v.AddError("credit", "this person is already credited in this role")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrNoRecordFound):
+			v.AddError("person_id", "person does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/movies/%d/credits", movie.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"credit": credit}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCreditHandler removes a single credit from a movie
+// curl -X DELETE localhost:4000/v1/movies/123/credits/4
+func (app *application) deleteCreditHandler(w http.ResponseWriter, r *http.Request) {
+	movie, ok := app.readMovie(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := app.readInt64Param(r, "credit_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Credits.Delete(r.Context(), movie.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "credit successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
@@ -53,6 +56,11 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, http.StatusText(http.StatusConflict))
 }
 
+// preconditionFailedResponse is sent when the If-Match header does not match the resource's current ETag
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusPreconditionFailed, "the resource has been modified since you last fetched it")
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	app.errorResponse(w, r, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
 }
@@ -77,3 +85,15 @@ func (app *application) invalidAccountResponse(w http.ResponseWriter, r *http.Re
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	app.errorResponse(w, r, http.StatusForbidden, "account does not have necessary privilege to access resource")
 }
+
+// notAcceptableResponse is sent when none of the media types in the Accept header can be produced
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, offered []string) {
+	message := "supported media types are " + strings.Join(offered, ", ")
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
+// unsupportedMediaTypeResponse is sent when the request body is in a format the endpoint doesn't read
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported []string) {
+	message := "Content-Type must be one of " + strings.Join(supported, ", ")
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
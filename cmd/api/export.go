@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mediaTypeJSON   = "application/json"
+	mediaTypeCSV    = "text/csv"
+	mediaTypeNDJSON = "application/x-ndjson"
+
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+const (
+	// exportFlushEvery is how many rows are buffered before they are flushed to the client
+	exportFlushEvery = 100
+
+	// exportWriteTimeout is how long a client gets to read each batch of rows before the
+	// export is given up on
+	exportWriteTimeout = 30 * time.Second
+
+	// exportTimeout caps an export as a whole, however quickly the client reads
+	exportTimeout = 15 * time.Minute
+)
+
+// exportExtensions names the file an export is saved as by its media type
+var exportExtensions = map[string]string{
+	mediaTypeCSV:    "csv",
+	mediaTypeNDJSON: "ndjson",
+}
+
+// negotiate picks the media type in offered the client prefers according to its Accept
+// header, breaking ties in the order of offered. A missing header accepts the first offer
+// and an empty result means none of them are acceptable
+func negotiate(r *http.Request, offered ...string) string {
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return offered[0]
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offered {
+		q := 0.0
+		specificity := -1
+
+		for _, part := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+
+			// the most specific range that matches the offer sets its quality
+			s := 0
+			switch {
+			case mediaType == offer:
+				s = 2
+			case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")):
+				s = 1
+			case mediaType == "*/*":
+				s = 0
+			default:
+				continue
+			}
+
+			if s <= specificity {
+				continue
+			}
+
+			specificity, q = s, 1
+
+			if value, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// movieWriter encodes movies one at a time in a format other than the JSON envelope
+type movieWriter interface {
+	Write(movie *data.Movie) error
+	Flush() error
+}
+
+// newMovieWriter returns a writer for the media type, which must be CSV or NDJSON. Only the
+// given fields are written, all of them when fields is empty
+func newMovieWriter(w io.Writer, mediaType string, fields []string) (movieWriter, error) {
+	if mediaType == mediaTypeCSV {
+		return newCSVMovieWriter(w, fields)
+	}
+
+	return &ndjsonMovieWriter{enc: json.NewEncoder(w), fields: fields}, nil
+}
+
+// ndjsonMovieWriter writes a movie per line, shaped as in the JSON responses
+type ndjsonMovieWriter struct {
+	enc    *json.Encoder
+	fields []string
+}
+
+func (nw *ndjsonMovieWriter) Write(movie *data.Movie) error {
+	return nw.enc.Encode(movie.Project(nw.fields))
+}
+
+func (nw *ndjsonMovieWriter) Flush() error {
+	return nil
+}
+
+// csvMovieWriter writes a header row of the fields followed by a row per movie. Genres are
+// joined with commas into a single cell and runtimes are plain minutes
+type csvMovieWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func newCSVMovieWriter(w io.Writer, fields []string) (*csvMovieWriter, error) {
+	if len(fields) == 0 {
+		fields = data.MovieFields
+	}
+
+	cw := &csvMovieWriter{w: csv.NewWriter(w), fields: fields}
+
+	return cw, cw.w.Write(fields)
+}
+
+func (cw *csvMovieWriter) Write(movie *data.Movie) error {
+	record := make([]string, len(cw.fields))
+
+	for i, field := range cw.fields {
+		switch field {
+		case "id":
+			record[i] = strconv.FormatInt(movie.ID, 10)
+		case "title":
+			record[i] = movie.Title
+		case "year":
+			record[i] = strconv.Itoa(int(movie.Year))
+		case "runtime":
+			record[i] = strconv.Itoa(int(movie.Runtime))
+		case "genres":
+			record[i] = strings.Join(movie.Genres, ",")
+		case "version":
+			record[i] = strconv.Itoa(int(movie.Version))
+		case "average_rating":
+			record[i] = strconv.FormatFloat(movie.AverageRating, 'f', -1, 64)
+		case "rating_count":
+			record[i] = strconv.Itoa(int(movie.RatingCount))
+		}
+	}
+
+	return cw.w.Write(record)
+}
+
+func (cw *csvMovieWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// writeMovies writes a page of movies as CSV or NDJSON. The listing metadata doesn't fit in
+// either format, so the total and the next cursor are sent as headers instead
+func (app *application) writeMovies(w http.ResponseWriter, mediaType string, movies []*data.Movie, metadata data.Metadata, fields []string) error {
+	w.Header().Set("Content-Type", mediaType)
+
+	if metadata.TotalRecords > 0 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(metadata.TotalRecords))
+	}
+
+	if metadata.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", metadata.NextCursor)
+	}
+
+	mw, err := newMovieWriter(w, mediaType, fields)
+	if err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		err = mw.Write(movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Flush()
+}
+
+// exportMoviesHandler streams every movie matching the same criteria as the listing, in CSV
+// when asked for and NDJSON otherwise. Rows are written as they are read from the database,
+// so an export takes constant memory however large the catalogue is
+// curl -H 'Accept: text/csv' localhost:4000/v1/movies/export?genres=drama
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	offered := []string{mediaTypeNDJSON, mediaTypeCSV}
+
+	w.Header().Add("Vary", "Accept")
+
+	mediaType := negotiate(r, offered...)
+	if mediaType == "" {
+		app.notAcceptableResponse(w, r, offered)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	q := app.readMovieQuery(qs, v)
+
+	filters := data.Filters{
+		Page:         1,
+		PageSize:     1,
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafeList: movieSortSafeList,
+	}
+
+	if filters.Sort == "relevance" {
+		v.Check(q.Title != "", "sort", "relevance requires a title search")
+	}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the export outlives the server's write timeout. Instead each batch of rows gets a write
+	// deadline of its own, so a client which stops reading is dropped while one which keeps
+	// up can carry on until exportTimeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+	ctx, cancel := context.WithTimeout(r.Context(), exportTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", `attachment; filename="movies.`+exportExtensions[mediaType]+`"`)
+
+	mw, err := newMovieWriter(w, mediaType, q.Fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	rows := 0
+
+	err = app.models.Movies.Export(ctx, q, filters, func(movie *data.Movie) error {
+		err := mw.Write(movie)
+		if err != nil {
+			return err
+		}
+
+		if rows++; rows%exportFlushEvery == 0 {
+			if err := mw.Flush(); err != nil {
+				return err
+			}
+
+			rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+
+			return rc.Flush()
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = mw.Flush()
+	}
+
+	// the status line has gone out with the first rows, so a failure can only cut the export
+	// short. A client hanging up isn't worth logging
+	if err != nil && !errors.Is(err, context.Canceled) {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offered := []string{mediaTypeJSON, mediaTypeNDJSON, mediaTypeCSV}
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", mediaTypeJSON},
+		{"*/*", mediaTypeJSON},
+		{"text/csv", mediaTypeCSV},
+		{"text/*", mediaTypeCSV},
+		{"application/x-ndjson, application/json;q=0.5", mediaTypeNDJSON},
+		{"application/json;q=0.5, text/csv;q=0.9", mediaTypeCSV},
+		{"text/csv;q=0, */*;q=0.1", mediaTypeJSON},
+		{"text/html", ""},
+		{"application/*;q=0, text/csv;q=0", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			if got := negotiate(r, offered...); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListMoviesFormats(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+
+	res := ts.do(t, http.MethodGet, "/v1/movies?genres=action&fields=id,title,genres", token, nil, "Accept", "text/csv")
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	if res.header.Get("Content-Type") != mediaTypeCSV || res.header.Get("X-Total-Count") != "2" {
+		t.Errorf("got headers %v", res.header)
+	}
+
+	if !strings.Contains(strings.Join(res.header.Values("Vary"), ","), "Accept") {
+		t.Errorf("got Vary %q; want Accept in it", res.header.Values("Vary"))
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(res.body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"id", "title", "genres"}, {"1", "Black Panther", "action,adventure"}, {"2", "Deadpool", "action,comedy"}}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Errorf("got %v; want %v", records, want)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies?page_size=2&sort=-year", token, nil, "Accept", "application/x-ndjson")
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(res.body)), "\n")
+	if len(lines) != 2 || res.header.Get("X-Next-Cursor") == "" {
+		t.Fatalf("got %d lines and cursor %q; want 2 lines and a cursor", len(lines), res.header.Get("X-Next-Cursor"))
+	}
+
+	var movie struct {
+		Title string `json:"title"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[0]), &movie); err != nil || movie.Title != "Black Panther" {
+		t.Errorf("got %s (%v); want Black Panther", lines[0], err)
+	}
+
+	rejected := []struct {
+		name       string
+		path       string
+		accept     string
+		wantStatus int
+	}{
+		{"unsupported media type", "/v1/movies", "text/html", http.StatusNotAcceptable},
+		{"facets in CSV", "/v1/movies?facets=genres", "text/csv", http.StatusUnprocessableEntity},
+		{"credits in CSV", "/v1/movies?include=credits", "text/csv", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, token, nil, "Accept", tt.accept)
+
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestExportMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	// more than exportFlushEvery rows, so the export is flushed along the way
+	for i := 1; i <= 250; i++ {
+		genre := "drama"
+		if i%2 == 0 {
+			genre = "comedy"
+		}
+
+		insertMovie(t, app, fmt.Sprintf("Movie %03d", i), 2000, 90, genre)
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/movies/export?genres=comedy&sort=-title", token, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	if res.header.Get("Content-Type") != mediaTypeNDJSON {
+		t.Errorf("got Content-Type %q; want %q", res.header.Get("Content-Type"), mediaTypeNDJSON)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(res.body)), "\n")
+	if len(lines) != 125 {
+		t.Fatalf("got %d movies; want 125", len(lines))
+	}
+
+	var movie struct {
+		Title string `json:"title"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[0]), &movie); err != nil || movie.Title != "Movie 250" {
+		t.Errorf("got %s (%v); want Movie 250 first", lines[0], err)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/export?fields=title", token, nil, "Accept", "text/csv")
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(res.body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 251 || records[0][0] != "title" || records[250][0] != "Movie 250" {
+		t.Errorf("got %d records starting with %v", len(records), records[0])
+	}
+
+	rejected := []struct {
+		name       string
+		path       string
+		accept     string
+		wantStatus int
+	}{
+		{"JSON", "/v1/movies/export", "application/json", http.StatusNotAcceptable},
+		{"unknown field", "/v1/movies/export?fields=bio", "", http.StatusUnprocessableEntity},
+		{"relevance without title", "/v1/movies/export?sort=relevance", "", http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, token, nil, "Accept", tt.accept)
+
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
@@ -7,24 +7,31 @@ import (
 	"github.com/4925k/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type envelope map[string]interface{}
 
 // readIDParam will retrieve the ID URL parameter from the request context and return it as an in64
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readInt64Param(r, "id")
+}
+
+// readInt64Param will retrieve the named URL parameter from the request context and return it as an int64
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	i, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil {
-		return -1, errors.New("invalid id parameter")
+		return -1, fmt.Errorf("invalid %s parameter", name)
 	}
 
-	return id, nil
+	return i, nil
 }
 
 /*
@@ -149,6 +156,108 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readInt32 reads an integer stored in 32 bits, rejecting values which would wrap around once
+// narrowed rather than quietly turning them into another number
+func (app *application) readInt32(qs url.Values, key string, defaultValue int32, v *validator.Validator) int32 {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		switch {
+		case errors.Is(err, strconv.ErrRange):
+			v.AddError(key, fmt.Sprintf("must be between %d and %d", math.MinInt32, math.MaxInt32))
+		default:
+			v.AddError(key, "must be an integer value")
+		}
+		return defaultValue
+	}
+
+	return int32(i)
+}
+
+// readTime accepts either an RFC 3339 timestamp or a plain date, which is taken as midnight UTC.
+// The zero time is returned when the key is absent
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a date (2006-01-02) or an RFC 3339 timestamp")
+	return time.Time{}
+}
+
+// readBool returns nil if the key is absent, so callers can tell "not filtered" apart from false
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// matchETag reports whether an If-Match or If-None-Match header value lists the given
+// entity tag. Weak comparison ignores the W/ prefix as If-None-Match requires, whereas
+// strong comparison (for If-Match) never treats a weak tag as matching
+func matchETag(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff is how long to wait before trying again after the nth failed attempt, doubling
+// from base with every attempt up to limit
+func backoff(base, limit time.Duration, attempts int) time.Duration {
+	wait := base
+
+	for i := 1; i < attempts && wait < limit; i++ {
+		wait *= 2
+	}
+
+	if wait > limit {
+		wait = limit
+	}
+
+	return wait
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/tomasen/realip"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotencyRecorder passes the response through to the client while keeping a copy of it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *idempotencyRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// requestHash fingerprints a request by its method, URL and body
+func requestHash(r *http.Request, body []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	hash.Write(body)
+
+	return hash.Sum(nil)
+}
+
+// idempotency makes POST requests carrying an Idempotency-Key header safe to retry. The first
+// response for a key is stored per user and replayed to every retry until it expires, while a
+// retry arriving before the first request has finished is turned away. Reusing a key for a
+// different request is rejected. Server errors aren't stored so that a retry gets another go.
+// Anonymous requests all share one user, so their keys are scoped to the client's address and
+// the route instead. Responses are kept in the database as they were sent, so it is never
+// wrapped around routes whose responses carry secrets, such as the authentication token
+func (app *application) idempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+
+		if key == "" || r.Method != http.MethodPost || app.config.idempotency.ttl <= 0 {
+			next(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key must not be more than 255 bytes long"))
+			return
+		}
+
+		// read the body to fingerprint the request, handing the handler a copy. Bodies bigger
+		// than any endpoint accepts are cut short, the handler rejects them anyway
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxImportBytes+1))
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		user := app.contextGetUser(r)
+
+		rec := &data.IdempotencyRecord{
+			Key:         key,
+			UserID:      user.ID,
+			RequestHash: requestHash(r, body),
+			ExpiresAt:   time.Now().Add(app.config.idempotency.ttl),
+		}
+
+		if user.IsAnonymous() {
+			rec.Key = realip.FromRequest(r) + " " + r.URL.Path + " " + key
+		}
+
+		existing, err := app.models.Idempotency.Reserve(r.Context(), rec)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case !bytes.Equal(existing.RequestHash, rec.RequestHash):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request")
+			case existing.Status == 0:
+				app.errorResponse(w, r, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+			default:
+				for name, values := range existing.Header {
+					w.Header()[name] = values
+				}
+
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(existing.Body)
+			}
+			return
+		}
+
+		rw := &idempotencyRecorder{ResponseWriter: w}
+
+		// the outcome is stored even if the client has gone away, that's when it retries
+		ctx := context.Background()
+
+		defer func() {
+			if rw.status == 0 || rw.status >= http.StatusInternalServerError {
+				err := app.models.Idempotency.Release(ctx, rec.Key, rec.UserID)
+				if err != nil {
+					app.logError(r, err)
+				}
+				return
+			}
+
+			rec.Status, rec.Header, rec.Body = rw.status, w.Header().Clone(), rw.body.Bytes()
+
+			err := app.models.Idempotency.Complete(ctx, rec)
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next(rw, r)
+	}
+}
+
+// purgeIdempotencyKeys removes expired idempotency records once an hour until ctx is cancelled
+func (app *application) purgeIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		purged, err := app.models.Idempotency.DeleteExpired(ctx)
+		switch {
+		case err != nil && !errors.Is(err, context.Canceled):
+			app.logger.PrintError(err, nil)
+		case purged > 0:
+			app.logger.PrintInfo("purged expired idempotency keys", map[string]string{"count": strconv.FormatInt(purged, 10)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.idempotency.ttl = time.Hour
+
+	ts := newTestServer(t, app.routes())
+
+	writer := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	other := authenticatedUser(t, app, "other@example.com", "movies:read", "movies:write")
+
+	movie := map[string]interface{}{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}}
+
+	first := ts.do(t, http.MethodPost, "/v1/movies", writer, movie, "Idempotency-Key", "create-moana")
+	if first.status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d (%s)", first.status, http.StatusCreated, first.body)
+	}
+
+	steps := []struct {
+		name         string
+		token        string
+		key          string
+		body         interface{}
+		wantStatus   int
+		wantReplayed bool
+	}{
+		{"retry", writer, "create-moana", movie, http.StatusCreated, true},
+		{"retry again", writer, "create-moana", movie, http.StatusCreated, true},
+		{"different body", writer, "create-moana", map[string]interface{}{"title": "Up"}, http.StatusUnprocessableEntity, false},
+		{"same key for another user", other, "create-moana", movie, http.StatusCreated, false},
+		{"key too long", writer, strings.Repeat("k", 256), movie, http.StatusBadRequest, false},
+		{"no key", writer, "", movie, http.StatusCreated, false},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/movies", step.token, step.body, "Idempotency-Key", step.key)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+
+			replayed := res.header.Get("Idempotent-Replayed") == "true"
+			if replayed != step.wantReplayed {
+				t.Errorf("got replayed %t; want %t", replayed, step.wantReplayed)
+			}
+
+			if replayed && (!bytes.Equal(res.body, first.body) || res.header.Get("Location") != first.header.Get("Location")) {
+				t.Errorf("got replayed response %s; want %s", res.body, first.body)
+			}
+		})
+	}
+
+	var list struct {
+		Metadata data.Metadata `json:"metadata"`
+	}
+	ts.do(t, http.MethodGet, "/v1/movies", writer, nil).decode(t, &list)
+
+	// the first request, the other user's and the one without a key
+	if list.Metadata.TotalRecords != 3 {
+		t.Errorf("got %d movies; want 3", list.Metadata.TotalRecords)
+	}
+
+	t.Run("in flight", func(t *testing.T) {
+		user, err := app.models.Users.GetForToken(context.Background(), data.ScopeAuthentication, writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := &data.IdempotencyRecord{Key: "in-flight", UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+
+		// fingerprint the request the same way the middleware does so only the state differs
+		body := `{"title":"Up","year":2009,"runtime":"96 mins","genres":["animation"]}`
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/v1/movies", strings.NewReader(body))
+		rec.RequestHash = requestHash(req, []byte(body))
+
+		if _, err := app.models.Idempotency.Reserve(context.Background(), rec); err != nil {
+			t.Fatal(err)
+		}
+
+		res := ts.do(t, http.MethodPost, "/v1/movies", writer, body, "Idempotency-Key", "in-flight")
+		if res.status != http.StatusConflict {
+			t.Errorf("got status %d; want %d (%s)", res.status, http.StatusConflict, res.body)
+		}
+	})
+
+	t.Run("anonymous keys are scoped to the client and route", func(t *testing.T) {
+		body := map[string]interface{}{"email": "other@example.com"}
+
+		steps := []struct {
+			name         string
+			path         string
+			client       string
+			wantReplayed bool
+		}{
+			{"first request", "/v1/tokens/password-reset", "192.0.2.1", false},
+			{"retry", "/v1/tokens/password-reset", "192.0.2.1", true},
+			{"another client", "/v1/tokens/password-reset", "192.0.2.2", false},
+			{"another route", "/v1/tokens/activation", "192.0.2.1", false},
+		}
+
+		for _, step := range steps {
+			res := ts.do(t, http.MethodPost, step.path, "", body, "Idempotency-Key", "reset-other", "X-Forwarded-For", step.client)
+			if res.status >= http.StatusInternalServerError {
+				t.Fatalf("%s: got status %d (%s)", step.name, res.status, res.body)
+			}
+
+			replayed := res.header.Get("Idempotent-Replayed") == "true"
+			if replayed != step.wantReplayed {
+				t.Errorf("%s: got replayed %t; want %t", step.name, replayed, step.wantReplayed)
+			}
+		}
+	})
+
+	t.Run("authentication tokens ignore the key", func(t *testing.T) {
+		body := map[string]interface{}{"email": "other@example.com", "password": testPassword}
+
+		tokens := map[string]bool{}
+
+		for i := 0; i < 2; i++ {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", body, "Idempotency-Key", "login-other")
+			if res.status != http.StatusCreated || res.header.Get("Idempotent-Replayed") != "" {
+				t.Fatalf("attempt %d: got status %d, replayed %q; want a fresh %d (%s)", i, res.status, res.header.Get("Idempotent-Replayed"), http.StatusCreated, res.body)
+			}
+
+			tokens[string(res.body)] = true
+		}
+
+		if len(tokens) != 2 {
+			t.Errorf("got %d distinct tokens; want 2", len(tokens))
+		}
+
+		// nothing was kept for the anonymous requests
+		existing, err := app.models.Idempotency.Reserve(context.Background(), &data.IdempotencyRecord{Key: "login-other", ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil || existing != nil {
+			t.Errorf("got record %+v (%v); want none stored", existing, err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		app.config.idempotency.ttl = time.Nanosecond
+
+		for i := 0; i < 2; i++ {
+			res := ts.do(t, http.MethodPost, "/v1/movies", writer, movie, "Idempotency-Key", "short-lived")
+			if res.status != http.StatusCreated || res.header.Get("Idempotent-Replayed") != "" {
+				t.Fatalf("attempt %d: got status %d, replayed %q; want a fresh %d", i, res.status, res.header.Get("Idempotent-Replayed"), http.StatusCreated)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+
+		purged, err := app.models.Idempotency.DeleteExpired(context.Background())
+		if err != nil || purged == 0 {
+			t.Errorf("got %d purged keys (%v); want some", purged, err)
+		}
+	})
+}
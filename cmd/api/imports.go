@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxImportBytes  = 16 << 20
+	importBatchSize = 500
+
+	// importAbandonedAfter is how long an unfinished import may go without progress before
+	// its runner is taken to be gone. A batch takes well under a second to insert
+	importAbandonedAfter = 10 * time.Minute
+)
+
+// importFormats names the upload formats by their media type
+var importFormats = map[string]string{
+	mediaTypeCSV:    "csv",
+	mediaTypeNDJSON: "ndjson",
+}
+
+// importRow is a movie read from an upload, or the reasons it couldn't be read
+type importRow struct {
+	line   int
+	movie  *data.Movie
+	errors map[string]string
+}
+
+// readCSVImport reads an upload laid out like the CSV export. The title, year, runtime and
+// genres columns are required and any other column is ignored, so an export can be imported again
+func readCSVImport(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("header must contain a %q column", name)
+		}
+	}
+
+	rows := []importRow{}
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := importRow{line: line, movie: &data.Movie{}, errors: make(map[string]string)}
+
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row.movie.Title = field("title")
+
+		// parsed as 32 bits, so a huge year is rejected rather than wrapping around into range
+		if year := field("year"); year != "" {
+			n, err := strconv.ParseInt(year, 10, 32)
+			if err != nil {
+				row.errors["year"] = "must be an integer"
+			}
+			row.movie.Year = int32(n)
+		}
+
+		if runtime := field("runtime"); runtime != "" {
+			n, err := strconv.ParseInt(runtime, 10, 32)
+			if err != nil {
+				row.errors["runtime"] = "must be an integer"
+			}
+			row.movie.Runtime = data.Runtime(n)
+		}
+
+		row.movie.Genres = []string{}
+		for _, genre := range strings.Split(field("genres"), ",") {
+			if genre = strings.TrimSpace(genre); genre != "" {
+				row.movie.Genres = append(row.movie.Genres, genre)
+			}
+		}
+
+		if len(row.errors) == 0 {
+			row.errors = nil
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// readNDJSONImport reads an upload with a movie per line, shaped like the body of createMovieHandler.
+// Blank lines are skipped
+func readNDJSONImport(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	rows := []importRow{}
+
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+
+		row := importRow{line: line}
+
+		err := json.Unmarshal(scanner.Bytes(), &input)
+		if err != nil {
+			row.errors = map[string]string{"row": err.Error()}
+		} else {
+			row.movie = &data.Movie{Title: input.Title, Year: input.Year, Runtime: input.Runtime, Genres: input.Genres}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, scanner.Err()
+}
+
+// runImport validates and inserts the rows of the import in batches, recording its progress
+// after each so that clients polling the import can follow along. It gives up if the import
+// has been finished from elsewhere, see failAbandonedImports
+func (app *application) runImport(imp *data.Import, rows []importRow) {
+	ctx := context.Background()
+
+	update := func() bool {
+		err := app.models.Imports.Update(ctx, imp)
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			return false
+		case err != nil:
+			app.logger.PrintError(err, map[string]string{"import_id": strconv.FormatInt(imp.ID, 10)})
+		}
+
+		return true
+	}
+
+	imp.Status = data.ImportRunning
+	if !update() {
+		return
+	}
+
+	for start := 0; start < len(rows); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		batch := []*data.Movie{}
+
+		for _, row := range rows[start:end] {
+			if row.errors == nil {
+				v := validator.New()
+				if data.ValidateMovie(v, row.movie); !v.Valid() {
+					row.errors = v.Errors
+				}
+			}
+
+			if row.errors != nil {
+				imp.AddRowError(row.line, row.errors)
+				continue
+			}
+
+			batch = append(batch, row.movie)
+		}
+
+		if len(batch) > 0 {
+			err := app.models.Movies.InsertMany(ctx, batch, imp.UserID)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"import_id": strconv.FormatInt(imp.ID, 10)})
+
+				now := time.Now()
+				imp.Status, imp.Error, imp.FinishedAt = data.ImportFailed, "the server encountered a problem inserting the movies", &now
+				update()
+				return
+			}
+		}
+
+		imp.ImportedRows += len(batch)
+		imp.ProcessedRows = end
+		if !update() {
+			return
+		}
+	}
+
+	now := time.Now()
+	imp.Status, imp.FinishedAt = data.ImportCompleted, &now
+	update()
+}
+
+// failAbandonedImports fails the imports whose runner went away with a crash or a restart,
+// as the uploaded rows went with it. It runs at startup and then every few minutes until
+// ctx is cancelled, only touching imports which have stopped making progress so that those
+// still running on other instances are left alone
+func (app *application) failAbandonedImports(ctx context.Context) {
+	ticker := time.NewTicker(importAbandonedAfter / 2)
+	defer ticker.Stop()
+
+	for {
+		failed, err := app.models.Imports.FailAbandoned(ctx, time.Now().Add(-importAbandonedAfter), "the import was interrupted, please upload it again")
+		switch {
+		case err != nil && !errors.Is(err, context.Canceled):
+			app.logger.PrintError(err, nil)
+		case failed > 0:
+			app.logger.PrintInfo("failed abandoned imports", map[string]string{"count": strconv.FormatInt(failed, 10)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// createImportHandler accepts a CSV or NDJSON upload of movies and inserts them in the
+// background. Rows failing validation are skipped and reported on the import
+// curl -X POST -H 'Content-Type: text/csv' --data-binary @movies.csv localhost:4000/v1/movies/import
+func (app *application) createImportHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	format, ok := importFormats[mediaType]
+	if !ok {
+		app.unsupportedMediaTypeResponse(w, r, []string{mediaTypeCSV, mediaTypeNDJSON})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var rows []importRow
+	var err error
+
+	if mediaType == mediaTypeCSV {
+		rows, err = readCSVImport(r.Body)
+	} else {
+		rows, err = readNDJSONImport(r.Body)
+	}
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit))
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(rows) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must contain at least one movie"))
+		return
+	}
+
+	imp := &data.Import{
+		Status:    data.ImportPending,
+		Format:    format,
+		TotalRows: len(rows),
+		Errors:    []data.ImportRowError{},
+		UserID:    app.contextGetUser(r).ID,
+	}
+
+	err = app.models.Imports.Insert(r.Context(), imp)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/imports/%d", imp.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"import": imp}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	// started once the response is written, as the import is updated while it runs
+	app.background(func() {
+		app.runImport(imp, rows)
+	})
+}
+
+// showImportHandler reports the progress of one of the user's imports
+// curl localhost:4000/v1/imports/1
+func (app *application) showImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	imp, err := app.models.Imports.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// imports of other users don't exist as far as the client can tell
+	if imp.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": imp}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
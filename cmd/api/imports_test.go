@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestImportMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	editor := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write")
+	other := authenticatedUser(t, app, "other@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	uploads := []struct {
+		name        string
+		contentType string
+		body        string
+		wantTotal   int
+		wantErrors  []data.ImportRowError
+	}{
+		{
+			name:        "csv",
+			contentType: "text/csv; charset=utf-8",
+			body: "id,title,year,runtime,genres\n" +
+				"9,Black Panther,2018,134,\"action,adventure\"\n" +
+				",Deadpool,2016,long,\"action,comedy\"\n" +
+				",,2016,108,comedy\n" +
+				",The Breakfast Club,1985,97,\"comedy,drama\"\n" +
+				",Wraparound,4294969312,97,drama\n",
+			wantTotal: 5,
+			wantErrors: []data.ImportRowError{
+				{Line: 3, Errors: map[string]string{"runtime": "must be an integer"}},
+				{Line: 4, Errors: map[string]string{"title": "must be provided"}},
+				{Line: 6, Errors: map[string]string{"year": "must be an integer"}},
+			},
+		},
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson",
+			body: `{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}` + "\n\n" +
+				`{"title": "Moana", "year": 2016, "runtime": 107}` + "\n" +
+				`{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": ["animation", "animation"]}` + "\n",
+			wantTotal: 3,
+			wantErrors: []data.ImportRowError{
+				{Line: 3, Errors: map[string]string{"row": "invalid runtime format"}},
+				{Line: 4, Errors: map[string]string{"genres": "must contain unique values"}},
+			},
+		},
+	}
+
+	for i, upload := range uploads {
+		t.Run(upload.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/movies/import", editor, upload.body, "Content-Type", upload.contentType)
+			if res.status != http.StatusAccepted {
+				t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusAccepted, res.body)
+			}
+
+			var created struct {
+				Import data.Import `json:"import"`
+			}
+			res.decode(t, &created)
+
+			if created.Import.TotalRows != upload.wantTotal || created.Import.ID != int64(i+1) {
+				t.Fatalf("got import %+v", created.Import)
+			}
+
+			app.wg.Wait()
+
+			var got struct {
+				Import data.Import `json:"import"`
+			}
+			ts.do(t, http.MethodGet, res.header.Get("Location"), editor, nil).decode(t, &got)
+
+			imp := got.Import
+			if imp.Status != data.ImportCompleted || imp.ProcessedRows != upload.wantTotal || imp.FinishedAt == nil {
+				t.Fatalf("got import %+v; want it completed", imp)
+			}
+
+			if imp.FailedRows != len(upload.wantErrors) || imp.ImportedRows != upload.wantTotal-len(upload.wantErrors) {
+				t.Errorf("got %d imported and %d failed rows", imp.ImportedRows, imp.FailedRows)
+			}
+
+			if len(imp.Errors) != len(upload.wantErrors) {
+				t.Fatalf("got errors %+v; want %+v", imp.Errors, upload.wantErrors)
+			}
+
+			for j, want := range upload.wantErrors {
+				if imp.Errors[j].Line != want.Line || len(imp.Errors[j].Errors) != len(want.Errors) {
+					t.Errorf("got error %+v; want %+v", imp.Errors[j], want)
+				}
+
+				for key, message := range want.Errors {
+					if imp.Errors[j].Errors[key] != message {
+						t.Errorf("line %d: got %q for %s; want %q", want.Line, imp.Errors[j].Errors[key], key, message)
+					}
+				}
+			}
+		})
+	}
+
+	var list struct {
+		Metadata data.Metadata `json:"metadata"`
+	}
+	ts.do(t, http.MethodGet, "/v1/movies", reader, nil).decode(t, &list)
+
+	if list.Metadata.TotalRecords != 3 {
+		t.Errorf("got %d movies; want 3", list.Metadata.TotalRecords)
+	}
+
+	rejected := []struct {
+		name        string
+		method      string
+		path        string
+		token       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"JSON upload", http.MethodPost, "/v1/movies/import", editor, "application/json", `{"title": "Up"}`, http.StatusUnsupportedMediaType},
+		{"missing column", http.MethodPost, "/v1/movies/import", editor, "text/csv", "title,year\nUp,2009\n", http.StatusBadRequest},
+		{"no rows", http.MethodPost, "/v1/movies/import", editor, "application/x-ndjson", "\n\n", http.StatusBadRequest},
+		{"missing permission", http.MethodPost, "/v1/movies/import", reader, "text/csv", "title,year,runtime,genres\n", http.StatusForbidden},
+		{"other user's import", http.MethodGet, "/v1/imports/1", other, "", "", http.StatusNotFound},
+		{"unknown import", http.MethodGet, "/v1/imports/9", editor, "", "", http.StatusNotFound},
+		{"post to a movie", http.MethodPost, "/v1/movies/1", editor, "text/csv", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, tt.method, tt.path, tt.token, tt.body, "Content-Type", tt.contentType)
+
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestFailAbandonedImports(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write")
+	user, err := app.models.Users.GetForToken(context.Background(), data.ScopeAuthentication, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an import left running by a server which went away
+	imp := &data.Import{Status: data.ImportRunning, Format: "csv", TotalRows: 2000, Errors: []data.ImportRowError{}, UserID: user.ID}
+	if err := app.models.Imports.Insert(context.Background(), imp); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := app.models.Imports.FailAbandoned(context.Background(), time.Now().Add(-importAbandonedAfter), "interrupted")
+	if err != nil || failed != 0 {
+		t.Fatalf("failed %d imports (%v); want a recent import left alone", failed, err)
+	}
+
+	failed, err = app.models.Imports.FailAbandoned(context.Background(), time.Now().Add(time.Second), "interrupted")
+	if err != nil || failed != 1 {
+		t.Fatalf("failed %d imports (%v); want 1", failed, err)
+	}
+
+	var got struct {
+		Import data.Import `json:"import"`
+	}
+	ts.do(t, http.MethodGet, "/v1/imports/1", token, nil).decode(t, &got)
+
+	if got.Import.Status != data.ImportFailed || got.Import.Error != "interrupted" || got.Import.FinishedAt == nil {
+		t.Fatalf("got import %+v; want it failed", got.Import)
+	}
+
+	// a runner which was only slow stops instead of bringing the import back to life
+	app.runImport(imp, []importRow{{line: 2, movie: &data.Movie{Title: "Up", Year: 2009, Runtime: 96, Genres: []string{"animation"}}}})
+
+	ts.do(t, http.MethodGet, "/v1/imports/1", token, nil).decode(t, &got)
+
+	if got.Import.Status != data.ImportFailed || got.Import.ProcessedRows != 0 {
+		t.Errorf("got import %+v; want it left failed", got.Import)
+	}
+}
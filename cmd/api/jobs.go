@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	jobSendWelcomeEmail       = "send_welcome_email"
+	jobSendActivationEmail    = "send_activation_email"
+	jobSendPasswordResetEmail = "send_password_reset_email"
+
+	jobPollInterval = time.Second
+	jobBaseBackoff  = 10 * time.Second
+	jobMaxBackoff   = time.Hour
+)
+
+// jobHandler runs a job of a given type. Returning an error gets the job tried again later
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+// jobHandlers maps every job type to the handler running it. Workers build it once and hand it
+// to every job they run
+func (app *application) jobHandlers() map[string]jobHandler {
+	handlers := map[string]jobHandler{}
+
+	for jobType, email := range userEmails {
+		handlers[jobType] = app.sendUserEmailJob(email)
+	}
+
+	return handlers
+}
+
+// newJob returns a job of the given type with the configured number of attempts, for
+// queueing along with a change through the models
+func (app *application) newJob(jobType string) *data.Job {
+	return &data.Job{
+		Type:        jobType,
+		MaxAttempts: app.config.jobs.maxAttempts,
+	}
+}
+
+// enqueueJob queues a job of the given type for the workers to pick up
+func (app *application) enqueueJob(ctx context.Context, jobType string, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	job := app.newJob(jobType)
+	job.Payload = js
+
+	return app.models.Jobs.Enqueue(ctx, job)
+}
+
+// userEmail is an email sent to a user along with a token of theirs
+type userEmail struct {
+	template string
+	scope    string
+	ttl      time.Duration
+	tokenKey string // the name the template knows the token by
+}
+
+// userEmails are the emails sent by the jobs of each type, whose payload is a data.UserJob.
+// The token is created as the email is sent so that it never sits in the queue, and its
+// lifetime starts then too
+var userEmails = map[string]userEmail{
+	jobSendWelcomeEmail:       {"user_welcome.tmpl", data.ScopeActivation, 72 * time.Hour, "activationToken"},
+	jobSendActivationEmail:    {"token_activation.tmpl", data.ScopeActivation, 72 * time.Hour, "activationToken"},
+	jobSendPasswordResetEmail: {"token_password_reset.tmpl", data.ScopePasswordReset, 45 * time.Minute, "passwordResetToken"},
+}
+
+// sendUserEmailJob returns the handler sending the email to the user named by the job. The
+// email is dropped if the user is gone, or is already activated for an activation token
+func (app *application) sendUserEmailJob(email userEmail) jobHandler {
+	return func(ctx context.Context, payload json.RawMessage) error {
+		var job data.UserJob
+
+		err := json.Unmarshal(payload, &job)
+		if err != nil {
+			return err
+		}
+
+		user, err := app.models.Users.Get(ctx, job.UserID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNoRecordFound):
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if email.scope == data.ScopeActivation && user.Activated {
+			return nil
+		}
+
+		token, err := app.models.Tokens.New(ctx, user.ID, email.ttl, email.scope)
+		if err != nil {
+			return err
+		}
+
+		tmplData := map[string]interface{}{
+			email.tokenKey: token.Plaintext,
+			"userID":       user.ID,
+		}
+
+		return app.mailer.Send(ctx, user.Email, email.template, tmplData)
+	}
+}
+
+// runJob runs the job with its handler, turning a panic into an error
+func (app *application) runJob(ctx context.Context, handlers map[string]jobHandler, job *data.Job) (err error) {
+	handler, ok := handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("unknown job type %q", job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, app.config.jobs.timeout)
+	defer cancel()
+
+	return handler(ctx, job.Payload)
+}
+
+// jobLease is how long a claimed job is left alone by other workers. A job which overruns its
+// timeout may still take a moment to notice, and its outcome has to be saved too, so the lease
+// is well over the timeout. Another worker picking the job up while it is running would send
+// the email twice
+func (app *application) jobLease() time.Duration {
+	return 2*app.config.jobs.timeout + 30*time.Second
+}
+
+// runNextJob claims the next job which is due and runs it, reporting whether there was one.
+// A failed job is tried again after a backoff until it runs out of attempts, at which point it
+// is left in the queue as dead. ctx only governs the claim: once claimed, the job runs on a
+// context of its own bounded by the job timeout, so shutting down doesn't cut it short and
+// charge it an attempt
+func (app *application) runNextJob(ctx context.Context, handlers map[string]jobHandler) (bool, error) {
+	job, err := app.models.Jobs.Claim(ctx, app.jobLease())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	// the job is run and its outcome saved even while shutting down, it would run again otherwise
+	done := context.Background()
+
+	// a job claimed again because its worker died may have been on its last attempt
+	if job.Attempts > job.MaxAttempts {
+		job.Status, job.LastError = data.JobDead, "worker stopped during the last attempt"
+		return true, app.models.Jobs.Fail(done, job)
+	}
+
+	err = app.runJob(done, handlers, job)
+	if err == nil {
+		return true, app.models.Jobs.Complete(done, job.ID)
+	}
+
+	job.LastError = err.Error()
+
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = data.JobDead
+
+		app.logger.PrintError(err, map[string]string{
+			"job_id":   strconv.FormatInt(job.ID, 10),
+			"job_type": job.Type,
+			"attempts": strconv.Itoa(job.Attempts),
+		})
+	} else {
+		job.Status = data.JobPending
+		job.RunAt = time.Now().Add(backoff(jobBaseBackoff, jobMaxBackoff, job.Attempts))
+	}
+
+	return true, app.models.Jobs.Fail(done, job)
+}
+
+// work runs jobs one after the other until ctx is cancelled, checking for new ones every
+// jobPollInterval once the queue is empty. Cancelling ctx stops it claiming jobs, the job in
+// hand is finished before returning
+func (app *application) work(ctx context.Context) {
+	handlers := app.jobHandlers()
+
+	for {
+		for ctx.Err() == nil {
+			ran, err := app.runNextJob(ctx, handlers)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				app.logger.PrintError(err, nil)
+			}
+
+			if !ran || err != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// listJobsHandler pages through the job queue, most useful to look into dead jobs
+// curl localhost:4000/v1/jobs?status=dead
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	v.Check(status == "" || validator.In(status, data.JobPending, data.JobRunning, data.JobDead), "status", "invalid status")
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	filters.Sort = app.readString(qs, "sort", "run_at")
+	filters.SortSafeList = []string{"run_at", "created_at", "updated_at", "-run_at", "-created_at", "-updated_at"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, metadata, err := app.models.Jobs.GetAll(r.Context(), status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "jobs": jobs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// retryJobHandler puts a dead job back in the queue with a fresh set of attempts
+// curl -X POST localhost:4000/v1/jobs/1/retry
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Requeue(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// queuedJobs lists the jobs with the given status through the admin endpoint
+func queuedJobs(t *testing.T, ts *testServer, token, status string) []data.Job {
+	t.Helper()
+
+	res := ts.do(t, http.MethodGet, "/v1/jobs?status="+status, token, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	var got struct {
+		Jobs []data.Job `json:"jobs"`
+	}
+	res.decode(t, &got)
+
+	return got.Jobs
+}
+
+func TestEmailJobs(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin := authenticatedUser(t, app, "admin@example.com", "admin")
+	mailer := app.mailer.(*testMailer)
+
+	user := insertUser(t, app, "alice@example.com", false)
+
+	err := app.enqueueJob(context.Background(), jobSendWelcomeEmail, data.UserJob{UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is sent until a worker runs the job
+	if sent := mailer.messages(); len(sent) != 0 {
+		t.Fatalf("got %d emails before the job ran; want 0", len(sent))
+	}
+
+	t.Run("failure is retried after a backoff", func(t *testing.T) {
+		mailer.fail(errors.New("smtp unavailable"))
+
+		if ran := runJobs(t, app); ran != 1 {
+			t.Fatalf("ran %d jobs; want 1", ran)
+		}
+
+		jobs := queuedJobs(t, ts, admin, data.JobPending)
+		if len(jobs) != 1 || jobs[0].Attempts != 1 || jobs[0].LastError != "smtp unavailable" {
+			t.Fatalf("got jobs %+v; want one pending job after a failed attempt", jobs)
+		}
+
+		if wait := time.Until(jobs[0].RunAt); wait < jobBaseBackoff/2 || wait > jobBaseBackoff*2 {
+			t.Errorf("job runs again in %s; want about %s", wait, jobBaseBackoff)
+		}
+
+		if ran := runJobs(t, app); ran != 0 {
+			t.Errorf("ran %d jobs during the backoff; want 0", ran)
+		}
+	})
+
+	t.Run("abandoned job is claimed again", func(t *testing.T) {
+		mailer.fail(nil)
+
+		// a worker which dies leaves the job running until its lease runs out
+		for i := 0; i < 2; i++ {
+			requeueDue(t, app)
+			if _, err := app.models.Jobs.Claim(context.Background(), -time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the lease ran out on the last attempt, so the job is given up on without running
+		if ran := runJobs(t, app); ran != 1 {
+			t.Fatalf("ran %d jobs; want 1", ran)
+		}
+
+		jobs := queuedJobs(t, ts, admin, data.JobDead)
+		if len(jobs) != 1 || jobs[0].Attempts != app.config.jobs.maxAttempts+1 {
+			t.Fatalf("got dead jobs %+v; want the abandoned one", jobs)
+		}
+
+		if sent := mailer.messages(); len(sent) != 0 {
+			t.Errorf("got %d emails; want 0", len(sent))
+		}
+	})
+
+	t.Run("dead job is retried", func(t *testing.T) {
+		res := ts.do(t, http.MethodPost, "/v1/jobs/1/retry", admin, nil)
+		if res.status != http.StatusAccepted {
+			t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusAccepted, res.body)
+		}
+
+		res = ts.do(t, http.MethodPost, "/v1/jobs/1/retry", admin, nil)
+		if res.status != http.StatusNotFound {
+			t.Errorf("retrying a pending job got status %d; want %d", res.status, http.StatusNotFound)
+		}
+
+		// the queue only ever held the user's id
+		jobs, _, err := app.models.Jobs.GetAll(context.Background(), "", data.Filters{Page: 1, PageSize: 20, Sort: "run_at", SortSafeList: []string{"run_at"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jobs) != 1 || string(jobs[0].Payload) != fmt.Sprintf(`{"user_id":%d}`, user.ID) {
+			t.Fatalf("got jobs %+v; want the welcome email naming only the user", jobs)
+		}
+
+		sent := app.mails(t)
+		if len(sent) != 1 || sent[0].recipient != user.Email || sent[0].template != "user_welcome.tmpl" {
+			t.Fatalf("got emails %+v; want the welcome email", sent)
+		}
+
+		tmplData := sent[0].data.(map[string]interface{})
+
+		if id := fmt.Sprint(tmplData["userID"]); id != fmt.Sprint(user.ID) {
+			t.Errorf("got userID %s; want %d", id, user.ID)
+		}
+
+		// the token was made as the email went out
+		activated, err := app.models.Users.GetForToken(context.Background(), data.ScopeActivation, fmt.Sprint(tmplData["activationToken"]))
+		if err != nil || activated.ID != user.ID {
+			t.Errorf("got user %+v (%v) for the emailed token; want %d", activated, err, user.ID)
+		}
+
+		if jobs := queuedJobs(t, ts, admin, ""); len(jobs) != 0 {
+			t.Errorf("got jobs %+v; want the sent email's job removed", jobs)
+		}
+	})
+}
+
+// requeueDue makes the pending jobs due straight away, skipping their backoff
+func requeueDue(t *testing.T, app *application) {
+	t.Helper()
+
+	jobs, _, err := app.models.Jobs.GetAll(context.Background(), data.JobPending, data.Filters{Page: 1, PageSize: 100, Sort: "run_at", SortSafeList: []string{"run_at"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		job.RunAt = time.Now().Add(-time.Second)
+		if err := app.models.Jobs.Fail(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJobGivesUpAfterMaxAttempts(t *testing.T) {
+	app := newTestApplication(t)
+	app.mailer.(*testMailer).fail(errors.New("mailbox full"))
+
+	user := insertUser(t, app, "alice@example.com", false)
+
+	err := app.enqueueJob(context.Background(), jobSendActivationEmail, data.UserJob{UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < app.config.jobs.maxAttempts; i++ {
+		requeueDue(t, app)
+		runJobs(t, app)
+	}
+
+	jobs, _, err := app.models.Jobs.GetAll(context.Background(), data.JobDead, data.Filters{Page: 1, PageSize: 20, Sort: "run_at", SortSafeList: []string{"run_at"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].Attempts != app.config.jobs.maxAttempts || jobs[0].LastError != "mailbox full" {
+		t.Fatalf("got dead jobs %+v; want the email after %d attempts", jobs, app.config.jobs.maxAttempts)
+	}
+
+	if ran := runJobs(t, app); ran != 0 {
+		t.Errorf("ran %d jobs; want dead jobs left alone", ran)
+	}
+}
+
+func TestUserEmailJobsWithNothingToSend(t *testing.T) {
+	app := newTestApplication(t)
+
+	active := insertUser(t, app, "active@example.com", true)
+
+	for _, job := range []struct {
+		jobType string
+		userID  int64
+	}{
+		{jobSendActivationEmail, active.ID},
+		{jobSendWelcomeEmail, 999},
+	} {
+		err := app.enqueueJob(context.Background(), job.jobType, data.UserJob{UserID: job.userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ran := runJobs(t, app); ran != 2 {
+		t.Fatalf("ran %d jobs; want 2", ran)
+	}
+
+	if sent := app.mails(t); len(sent) != 0 {
+		t.Errorf("got emails %+v; want none for an activated or missing user", sent)
+	}
+
+	jobs, _, err := app.models.Jobs.GetAll(context.Background(), "", data.Filters{Page: 1, PageSize: 20, Sort: "run_at", SortSafeList: []string{"run_at"}})
+	if err != nil || len(jobs) != 0 {
+		t.Errorf("got jobs %+v (%v); want both completed", jobs, err)
+	}
+}
+
+func TestUnknownJobType(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.jobs.maxAttempts = 1
+
+	err := app.enqueueJob(context.Background(), "reticulate_splines", map[string]int{"count": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runJobs(t, app)
+
+	jobs, _, err := app.models.Jobs.GetAll(context.Background(), data.JobDead, data.Filters{Page: 1, PageSize: 20, Sort: "run_at", SortSafeList: []string{"run_at"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].LastError != `unknown job type "reticulate_splines"` {
+		t.Errorf("got dead jobs %+v; want the unknown job", jobs)
+	}
+}
+
+func TestJobOutlivesShutdown(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.jobs.maxAttempts = 1
+
+	err := app.enqueueJob(context.Background(), "send_slowly", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	handlers := map[string]jobHandler{
+		"send_slowly": func(ctx context.Context, payload json.RawMessage) error {
+			// shutdown starts while the job is running
+			stop()
+
+			if _, ok := ctx.Deadline(); !ok {
+				return errors.New("job is not bounded by its timeout")
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+				return nil
+			}
+		},
+	}
+
+	ran, err := app.runNextJob(shutdown, handlers)
+	if !ran || err != nil {
+		t.Fatalf("got ran %t (%v); want the job run", ran, err)
+	}
+
+	jobs, _, err := app.models.Jobs.GetAll(context.Background(), "", data.Filters{Page: 1, PageSize: 20, Sort: "run_at", SortSafeList: []string{"run_at"}})
+	if err != nil || len(jobs) != 0 {
+		t.Errorf("got jobs %+v (%v); want the job completed", jobs, err)
+	}
+}
+
+func TestJobsRequireAdmin(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user := authenticatedUser(t, app, "alice@example.com", "movies:read", "movies:write")
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/v1/jobs"},
+		{http.MethodPost, "/v1/jobs/1/retry"},
+	} {
+		res := ts.do(t, req.method, req.path, user, nil)
+		if res.status != http.StatusForbidden {
+			t.Errorf("%s %s got status %d; want %d", req.method, req.path, res.status, http.StatusForbidden)
+		}
+	}
+
+	admin := authenticatedUser(t, app, "admin@example.com", "admin")
+
+	res := ts.do(t, http.MethodGet, "/v1/jobs?status=stuck", admin, nil)
+	if res.status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid status got %d; want %d", res.status, http.StatusUnprocessableEntity)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"github.com/4925k/greenlight/internal/mailer"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+)
+
+// previewMailHandler renders an email template with sample data, the .tmpl extension is optional
+// curl localhost:4000/v1/admin/mail/preview/user_welcome
+func (app *application) previewMailHandler(w http.ResponseWriter, r *http.Request) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("template")
+	if !strings.HasSuffix(name, ".tmpl") {
+		name += ".tmpl"
+	}
+
+	msg, err := app.mailer.Preview(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrUnknownTemplate):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"template": name, "preview": msg}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/jsonlog"
+	"github.com/4925k/greenlight/internal/mailer"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailTransports(t *testing.T) {
+	var cfg config
+
+	msg := mailer.Message{
+		From:      "no-reply@greenlight.example",
+		To:        "alice@example.com",
+		Subject:   "Activate your Greenlight account",
+		PlainBody: "Your token is Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		HTMLBody:  "<p>Your token is Y3QMGX3PJ3WLRL2YRTQGQ6KRHU</p>",
+	}
+
+	t.Run("file", func(t *testing.T) {
+		cfg.smtp.transport = "file"
+		cfg.smtp.dir = filepath.Join(t.TempDir(), "mail")
+
+		transport, err := newMailTransport(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = transport.Send(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := filepath.Glob(filepath.Join(cfg.smtp.dir, "*.eml"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("got files %v (%v); want one .eml file", files, err)
+		}
+
+		eml, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{"To: alice@example.com", "Subject: Activate your Greenlight account", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"} {
+			if !bytes.Contains(eml, []byte(want)) {
+				t.Errorf("message is missing %q:\n%s", want, eml)
+			}
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		var out bytes.Buffer
+
+		cfg.smtp.transport = "log"
+
+		transport, err := newMailTransport(cfg, jsonlog.New(&out, jsonlog.LevelInfo))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = transport.Send(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(out.String(), `"to":"alice@example.com"`) {
+			t.Errorf("got log %q; want the email logged", out.String())
+		}
+	})
+
+	t.Run("smtp", func(t *testing.T) {
+		received := make(chan string, 1)
+		cfg.smtp.transport = "smtp"
+		cfg.smtp.host, cfg.smtp.port = fakeSMTPServer(t, func(conn net.Conn) {
+			received <- smtpConversation(conn)
+		})
+
+		transport, err := newMailTransport(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = transport.Send(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := <-received
+		for _, want := range []string{"MAIL FROM:<no-reply@greenlight.example>", "RCPT TO:<alice@example.com>", "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"} {
+			if !strings.Contains(data, want) {
+				t.Errorf("conversation is missing %q:\n%s", want, data)
+			}
+		}
+	})
+
+	t.Run("smtp server hanging", func(t *testing.T) {
+		hung := make(chan struct{})
+		defer close(hung)
+
+		cfg.smtp.transport = "smtp"
+		cfg.smtp.host, cfg.smtp.port = fakeSMTPServer(t, func(conn net.Conn) {
+			// accept the connection but never greet the client
+			<-hung
+		})
+
+		transport, err := newMailTransport(cfg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+
+		err = transport.Send(ctx, msg)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got error %v; want %v", err, context.DeadlineExceeded)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("send took %s; want it cut off by the context", elapsed)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		cfg.smtp.transport = "pigeon"
+
+		if _, err := newMailTransport(cfg, nil); err == nil {
+			t.Error("got no error for an unknown transport")
+		}
+	})
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := mailer.NewMemoryTransport()
+
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		err := transport.Send(context.Background(), mailer.Message{To: to, Subject: "Welcome to Greenlight!"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := transport.Messages()
+	if len(sent) != 2 || sent[0].To != "alice@example.com" || sent[1].To != "bob@example.com" {
+		t.Fatalf("got messages %+v; want both in the order sent", sent)
+	}
+
+	// the returned slice is a copy
+	sent[0].To = "mallory@example.com"
+
+	if transport.Messages()[0].To != "alice@example.com" {
+		t.Error("changing the returned messages changed the recorded ones")
+	}
+}
+
+func TestPreviewMailHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin := authenticatedUser(t, app, "admin@example.com", "admin")
+	user := authenticatedUser(t, app, "alice@example.com", "movies:read", "movies:write")
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"welcome", "/v1/admin/mail/preview/user_welcome", admin, http.StatusOK, "your user ID number is 42"},
+		{"with extension", "/v1/admin/mail/preview/token_password_reset.tmpl", admin, http.StatusOK, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"},
+		{"activation", "/v1/admin/mail/preview/token_activation", admin, http.StatusOK, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"},
+		{"unknown template", "/v1/admin/mail/preview/newsletter", admin, http.StatusNotFound, ""},
+		{"not an admin", "/v1/admin/mail/preview/user_welcome", user, http.StatusForbidden, ""},
+		{"anonymous", "/v1/admin/mail/preview/user_welcome", "", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, tt.token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Preview mailer.Message `json:"preview"`
+			}
+			res.decode(t, &got)
+
+			if got.Preview.Subject == "" || !strings.Contains(got.Preview.HTMLBody, tt.wantBody) || !strings.Contains(got.Preview.PlainBody, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU") {
+				t.Errorf("got preview %+v; want the subject and both bodies rendered", got.Preview)
+			}
+		})
+	}
+}
+
+// fakeSMTPServer listens on a local port, handing the first connection to serve
+func fakeSMTPServer(t *testing.T, serve func(conn net.Conn)) (string, int) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		serve(conn)
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// smtpConversation accepts a single message without any extensions, returning everything the
+// client said
+func smtpConversation(conn net.Conn) string {
+	var said strings.Builder
+
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+
+	inData := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return said.String()
+		}
+		said.WriteString(line)
+
+		switch {
+		case inData:
+			if line == ".\r\n" {
+				inData = false
+				fmt.Fprint(conn, "250 queued\r\n")
+			}
+		case strings.HasPrefix(line, "DATA"):
+			inData = true
+			fmt.Fprint(conn, "354 go ahead\r\n")
+		case strings.HasPrefix(line, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return said.String()
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
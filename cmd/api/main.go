@@ -25,38 +25,70 @@ var (
 
 // config will hold all the configuration settings for out application
 type config struct {
-	port int
-	env  string
-	db   struct {
-		dsn         string
-		maxOpenCons int
-		maxIdleCons int
-		maxIdleTime string
+	port  int
+	env   string
+	store string
+	db    struct {
+		dsn          string
+		maxOpenCons  int
+		maxIdleCons  int
+		maxIdleTime  string
+		queryTimeout time.Duration
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps          float64
+		burst        int
+		suggestRPS   float64
+		suggestBurst int
+		enabled      bool
 	}
 	smtp struct {
-		host     string
-		port     int
-		username string
-		password string
-		sender   string
+		transport string
+		dir       string
+		host      string
+		port      int
+		username  string
+		password  string
+		sender    string
 	}
 	cors struct {
 		trustedOrigins []string
 	}
+	trash struct {
+		retention time.Duration
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	webhooks struct {
+		maxAttempts int
+		timeout     time.Duration
+	}
+	changes struct {
+		retention time.Duration
+	}
+	jobs struct {
+		workers     int
+		maxAttempts int
+		timeout     time.Duration
+	}
+}
+
+// mailSender is satisfied by mailer.Mailer. Handlers depend on this rather than the
+// concrete type so tests can capture outgoing emails instead of dialing SMTP
+type mailSender interface {
+	Send(ctx context.Context, recipient, templateFile string, data interface{}) error
+	Preview(templateFile string) (mailer.Message, error)
 }
 
 // application will hold all the dependencies for out HTTP handlers, helpers and middleware
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailSender
+	changes *changeBroker
+	wg      sync.WaitGroup
 }
 
 func main() {
@@ -67,22 +99,29 @@ func main() {
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
 
+	flag.StringVar(&cfg.store, "store", "postgres", "Where data is kept (postgres|memory), the memory store starts empty and is lost on exit")
+
 	// db config
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 	flag.IntVar(&cfg.db.maxOpenCons, "db-max-open-cons", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleCons, "db-max-idle-cons", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL per-query timeout")
 
 	// rate limit config
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.Float64Var(&cfg.limiter.suggestRPS, "limiter-suggest-rps", 10, "Rate limiter maximum autocomplete requests per second")
+	flag.IntVar(&cfg.limiter.suggestBurst, "limiter-suggest-burst", 20, "Rate limiter maximum autocomplete burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enabled rate limiter")
 
 	// smtp config
+	flag.StringVar(&cfg.smtp.transport, "smtp-transport", "smtp", "How emails are delivered (smtp|file|log)")
+	flag.StringVar(&cfg.smtp.dir, "smtp-dir", "tmp/mail", "Directory the file transport writes .eml files to")
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "75793c5cae1279", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "26e3ede53b1daa", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "from@example.com", "SMTP sender")
 
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
@@ -90,6 +129,20 @@ func main() {
 		return nil
 	})
 
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted movies are kept before being purged (0 keeps them forever)")
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are replayed (0 ignores the header)")
+
+	// webhook config
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 10, "Attempts at sending a webhook delivery before giving up on it")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "Timeout of a single webhook delivery attempt")
+
+	flag.DurationVar(&cfg.changes.retention, "changes-retention", 7*24*time.Hour, "How long movie changes are kept for change feed clients to resume from (0 keeps them forever)")
+
+	// job queue config
+	flag.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Background jobs run at the same time")
+	flag.IntVar(&cfg.jobs.maxAttempts, "jobs-max-attempts", 5, "Attempts at running a background job before it is marked dead")
+	flag.DurationVar(&cfg.jobs.timeout, "jobs-timeout", 30*time.Second, "Timeout of a single background job attempt")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -103,31 +156,62 @@ func main() {
 	// set up logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	db, err := openDB(cfg)
-	if err != nil {
-		logger.PrintFatal(err, nil)
+	// every query would start on an already expired context
+	if cfg.db.queryTimeout <= 0 {
+		logger.PrintFatal(fmt.Errorf("db-query-timeout must be greater than zero, got %s", cfg.db.queryTimeout), nil)
+	}
+
+	var models data.Models
+
+	switch cfg.store {
+	case "postgres":
+		db, err := openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer db.Close()
+		logger.PrintInfo("database connection established", nil)
+
+		expvar.Publish("database", expvar.Func(func() any { // database stats
+			return db.Stats()
+		}))
+
+		models = data.NewModels(db, cfg.db.queryTimeout)
+	case "memory":
+		logger.PrintInfo("using the in-memory store, nothing is kept once the server stops", nil)
+
+		models = data.NewMemoryModels()
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown store %q", cfg.store), nil)
 	}
-	defer db.Close()
-	logger.PrintInfo("database connection established", nil)
 
 	// publish variables to expvar handler
 	expvar.NewString("version").Set(version)              // app version
 	expvar.Publish("goroutines", expvar.Func(func() any { // go routines
 		return runtime.NumGoroutine()
 	}))
-	expvar.Publish("database", expvar.Func(func() any { // database stats
-		return db.Stats()
-	}))
 	expvar.Publish("timestamp", expvar.Func(func() any { // unix timestamp
 		return time.Now().Unix()
 	}))
 
+	transport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// a broken email template stops the server here rather than failing every send
+	mail, err := mailer.New(transport, cfg.smtp.sender)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// instance of the application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  models,
+		mailer:  mail,
+		changes: newChangeBroker(models.MovieChanges, logger),
 	}
 
 	err = app.serve()
@@ -136,6 +220,21 @@ func main() {
 	}
 }
 
+// newMailTransport returns the transport picked with -smtp-transport. Only smtp sends emails,
+// file and log keep them on the machine for local development
+func newMailTransport(cfg config, logger *jsonlog.Logger) (mailer.Transport, error) {
+	switch cfg.smtp.transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.smtp.dir)
+	case "log":
+		return mailer.NewLogTransport(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown smtp transport %q", cfg.smtp.transport)
+	}
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"github.com/4925k/greenlight/internal/data"
 	"github.com/4925k/greenlight/internal/validator"
 	"github.com/felixge/httpsnoop"
+	"github.com/julienschmidt/httprouter"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 	"net/http"
@@ -29,55 +30,105 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-// Using this pattern for rate-limiting will only work if your API application is running on a
-// single-machine. If your infrastructure is distributed, with your application running on
-// multiple servers behind a load balancer, then you’ll need to use an alternative approach
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+// ipLimiter hands out a token bucket per client IP, forgetting clients that haven't been
+// seen for a few minutes
+type ipLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*ipClient
+	rps       float64
+	burst     int
+	lastSweep time.Time
+}
+
+type ipClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiter(rps float64, burst int) *ipLimiter {
+	return &ipLimiter{
+		clients:   make(map[string]*ipClient),
+		rps:       rps,
+		burst:     burst,
+		lastSweep: time.Now(),
 	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-
-	go func() {
-		time.Sleep(time.Minute)
-
-		mu.Lock()
-		for ip, user := range clients {
-			if time.Since(user.lastSeen) > 3*time.Minute {
-				delete(clients, ip)
+}
+
+func (l *ipLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// forget stale clients once a minute as requests come in, rather than from a goroutine
+	// which would outlive the limiter
+	if time.Since(l.lastSweep) > time.Minute {
+		for ip, client := range l.clients {
+			if time.Since(client.lastSeen) > 3*time.Minute {
+				delete(l.clients, ip)
 			}
 		}
-		mu.Unlock()
-	}()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if app.config.limiter.enabled {
-			// use real ip function to get clients real  ip address
-			ip := realip.FromRequest(r)
+		l.lastSweep = time.Now()
+	}
 
-			mu.Lock()
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &ipClient{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+		l.clients[ip] = client
+	}
 
-			if _, ok := clients[ip]; !ok {
-				clients[ip] = &client{rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst), time.Now()}
-			}
+	client.lastSeen = time.Now()
 
-			if !clients[ip].limiter.Allow() {
-				app.rateLimitExceededResponse(w, r)
-				mu.Unlock()
-				return
-			}
+	return client.limiter.Allow()
+}
+
+// rateLimit throttles every request with the global bucket, except those to the routes of
+// ownBucket, which are throttled by a bucket of their own further down. ownBucket matches a
+// request the way the main router does, so no spelling of a path gets past both limiters
+//
+// Using this pattern for rate-limiting will only work if your API application is running on a
+// single-machine. If your infrastructure is distributed, with your application running on
+// multiple servers behind a load balancer, then you’ll need to use an alternative approach
+func (app *application) rateLimit(next http.Handler, ownBucket *httprouter.Router) http.Handler {
+	if !app.config.limiter.enabled {
+		return next
+	}
+
+	limiter := newIPLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, _, _ := ownBucket.Lookup(r.Method, r.URL.Path); h != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			mu.Unlock()
+		// use real ip function to get clients real  ip address
+		if !limiter.allow(realip.FromRequest(r)) {
+			app.rateLimitExceededResponse(w, r)
+			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// suggestRateLimit throttles the autocomplete endpoint with a bucket separate from rateLimit
+func (app *application) suggestRateLimit(next http.HandlerFunc) http.HandlerFunc {
+	if !app.config.limiter.enabled {
+		return next
+	}
+
+	limiter := newIPLimiter(app.config.limiter.suggestRPS, app.config.limiter.suggestBurst)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(realip.FromRequest(r)) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -105,7 +156,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrNoRecordFound):
@@ -157,7 +208,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
 
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -189,11 +240,12 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for _, or := range app.config.cors.trustedOrigins {
 				if or == origin {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag, Location, Idempotent-Replayed")
 
 					// add necessary response headers for preflight CORS request
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, If-None-Match")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -209,11 +261,11 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 
 // metrics keeps track of request level metrics
 func (app *application) metrics(next http.Handler) http.Handler {
-	totalRequestReceived := expvar.NewInt("total_requests_received")
-	totalResponseSent := expvar.NewInt("total_response_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_us")
-	totalActiveRequests := expvar.NewInt("total_active_requests")
-	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+	totalRequestReceived := expvarInt("total_requests_received")
+	totalResponseSent := expvarInt("total_response_sent")
+	totalProcessingTimeMicroseconds := expvarInt("total_processing_time_us")
+	totalActiveRequests := expvarInt("total_active_requests")
+	totalResponsesSentByStatus := expvarMap("total_responses_sent_by_status")
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		totalRequestReceived.Add(1)
@@ -229,3 +281,23 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	})
 
 }
+
+// expvarInt returns the published integer with the given name, creating it on first use.
+// expvar panics when a name is published twice, which would otherwise stop routes() from
+// being built more than once in the same process (as the tests do)
+func expvarInt(name string) *expvar.Int {
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+
+	return expvar.NewInt(name)
+}
+
+// expvarMap is the expvar.Map counterpart of expvarInt
+func expvarMap(name string) *expvar.Map {
+	if v, ok := expvar.Get(name).(*expvar.Map); ok {
+		return v
+	}
+
+	return expvar.NewMap(name)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"healthcheck", http.MethodGet, "/v1/healthcheck", http.StatusOK},
+		{"unknown route", http.MethodGet, "/v1/unknown", http.StatusNotFound},
+		{"method not allowed", http.MethodPut, "/v1/healthcheck", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, tt.method, tt.path, "", nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"wrong scheme", "Basic dXNlcjpwYXNz"},
+		{"malformed token", "Bearer abc"},
+		{"unknown token", "Bearer AAAAAAAAAAAAAAAAAAAAAAAAAA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil, "Authorization", tt.header)
+
+			if res.status != http.StatusUnauthorized {
+				t.Fatalf("got status %d; want %d", res.status, http.StatusUnauthorized)
+			}
+
+			if got := res.header.Get("WWW-Authenticate"); got != "Bearer" {
+				t.Errorf("got WWW-Authenticate %q; want %q", got, "Bearer")
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 1
+	app.config.limiter.burst = 2
+
+	ts := newTestServer(t, app.routes())
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+
+		if res.status != want {
+			t.Fatalf("request %d: got status %d; want %d", i, res.status, want)
+		}
+	}
+}
+
+func TestEnableCORS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.cors.trustedOrigins = []string{"https://trusted.example.com"}
+
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name       string
+		origin     string
+		wantOrigin string
+	}{
+		{"trusted origin", "https://trusted.example.com", "https://trusted.example.com"},
+		{"untrusted origin", "https://evil.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodOptions, "/v1/movies", "", nil,
+				"Origin", tt.origin, "Access-Control-Request-Method", http.MethodPatch)
+
+			if got := res.header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q; want %q", got, tt.wantOrigin)
+			}
+
+			if tt.wantOrigin != "" && res.status != http.StatusOK {
+				t.Errorf("got preflight status %d; want %d", res.status, http.StatusOK)
+			}
+
+			// browsers only send and show the headers they are told about
+			if tt.wantOrigin != "" {
+				for name, want := range map[string]string{
+					"Access-Control-Allow-Headers":  "Idempotency-Key",
+					"Access-Control-Expose-Headers": "Idempotent-Replayed",
+				} {
+					if got := res.header.Get(name); !strings.Contains(got, want) {
+						t.Errorf("got %s %q; want it to include %s", name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
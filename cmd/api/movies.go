@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/jsonpatch"
 	"github.com/4925k/greenlight/internal/validator"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 )
 
 // createMovieHandler will create a new movie entry
@@ -50,7 +55,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// insert into database
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie, app.contextGetUser(r).ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -59,6 +64,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// reply to client
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -77,7 +83,17 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	v := validator.New()
+
+	include := app.readInclude(r.URL.Query(), v, "credits")
+
+	fields := app.readCSV(r.URL.Query(), "fields", []string{})
+	if data.ValidateMovieFields(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrNoRecordFound):
@@ -88,8 +104,29 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	headers := make(http.Header)
+
+	if include["credits"] {
+		err = app.attachCredits(r.Context(), movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		// credits aren't versioned with the movie, so only the bare movie can be revalidated
+		// by its ETag. Let clients revalidate a cached copy without downloading it again
+		etag := movieETag(movie)
+		if match := r.Header.Get("If-None-Match"); match != "" && matchETag(match, etag, true) {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		headers.Set("ETag", etag)
+	}
+
 	// return movie details
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie.Project(fields)}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -103,7 +140,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrNoRecordFound):
@@ -114,41 +151,68 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	var input struct {
-		Title   *string       `json:"title,omitempty"`
-		Year    *int32        `json:"year,omitempty"`
-		Runtime *data.Runtime `json:"runtime,omitempty"`
-		Genres  []string      `json:"genres,omitempty"`
-	}
-
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	// reject the update if the client's copy is stale, otherwise changes made between
+	// their GET and this PATCH would be silently overwritten
+	if match := r.Header.Get("If-Match"); match != "" && !matchETag(match, movieETag(movie), false) {
+		app.preconditionFailedResponse(w, r)
 		return
 	}
 
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
+	v := validator.New()
 
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
+	// merge patches and JSON patches are applied to the movie document, which also lets clients
+	// remove fields, edit genres one at a time and make the update conditional with test ops.
+	// Any other body is read as the fields to change
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case mediaTypeMergePatch, mediaTypeJSONPatch:
+		var patch json.RawMessage
+
+		err = app.readJSON(w, r, &patch)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		err = app.patchMovie(movie, mediaType, patch, v)
+		if err != nil {
+			switch {
+			case errors.Is(err, jsonpatch.ErrInvalidPatch):
+				app.badRequestResponse(w, r, err)
+			case errors.Is(err, jsonpatch.ErrTestFailed):
+				app.errorResponse(w, r, http.StatusConflict, err.Error())
+			case errors.Is(err, jsonpatch.ErrPathNotFound):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
 
-	if input.Genres != nil {
-		movie.Genres = input.Genres
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+	default:
+		var input moviePatch
+
+		err = app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		input.apply(movie)
 	}
 
-	v := validator.New()
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -159,7 +223,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, http.Header{"ETag": []string{movieETag(movie)}})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -173,9 +237,35 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = app.models.Movies.Delete(id)
+	// with If-Match the delete only goes through while the movie is still at the version the
+	// client has, a concurrent update fails it rather than being thrown away
+	var version int32
+
+	if match := r.Header.Get("If-Match"); match != "" {
+		movie, err := app.models.Movies.Get(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNoRecordFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !matchETag(match, movieETag(movie), false) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+
+		version = movie.Version
+	}
+
+	err = app.models.Movies.Delete(r.Context(), id, version, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrNoRecordFound):
 			app.notFoundResponse(w, r)
 		default:
@@ -191,41 +281,234 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// movieETag derives a strong entity tag from the movie's id and version. The version is
+// bumped on every update, reviews change the rating aggregates without bumping it so those
+// are part of the tag too. Either way the tag changes whenever the representation does
+func movieETag(movie *data.Movie) string {
+	return fmt.Sprintf(`"%d-%d-%d-%s"`, movie.ID, movie.Version, movie.RatingCount, strconv.FormatFloat(movie.AverageRating, 'f', -1, 64))
+}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieQuery
 		data.Filters
 	}
 
+	// CSV and NDJSON give the page as plain rows, see writeMovies
+	offered := []string{mediaTypeJSON, mediaTypeNDJSON, mediaTypeCSV}
+
+	// the body depends on Accept, so caches must not hand one format to a client asking for another
+	w.Header().Add("Vary", "Accept")
+
+	mediaType := negotiate(r, offered...)
+	if mediaType == "" {
+		app.notAcceptableResponse(w, r, offered)
+		return
+	}
+
 	v := validator.New()
 
 	qs := r.URL.Query()
 
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.MovieQuery = app.readMovieQuery(qs, v)
+
+	include := app.readInclude(qs, v, "credits")
+	facets := app.readCSV(qs, "facets", []string{})
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafeList = movieSortSafeList
+
+	// next_cursor from a previous page continues the listing without an offset, which stays
+	// fast deep into the results and doesn't repeat rows inserted while scrolling
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+
+	if count := app.readBool(qs, "count", v); count != nil {
+		input.Filters.SkipCount = !*count
+	}
+
+	data.ValidateFacets(v, facets)
+
+	if mediaType != mediaTypeJSON {
+		v.Check(len(facets) == 0, "facets", "only available in JSON responses")
+	}
+
+	if mediaType == mediaTypeCSV {
+		v.Check(!include["credits"], "include", "credits cannot be included in CSV responses")
+	}
+
+	if input.Filters.Sort == "relevance" {
+		v.Check(input.Title != "", "sort", "relevance requires a title search")
+		v.Check(input.Filters.Cursor == "", "cursor", "cannot be used when sorting by relevance")
+	}
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.MovieQuery, input.Filters)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("cursor", "invalid cursor")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "movies": movies}, nil)
+	// facets count every movie matching the query, not just the ones on this page
+	if len(facets) > 0 {
+		metadata.Facets, err = app.models.Movies.Facets(r.Context(), input.MovieQuery, facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if include["credits"] && len(movies) > 0 {
+		err = app.attachCredits(r.Context(), movies...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if mediaType != mediaTypeJSON {
+		err = app.writeMovies(w, mediaType, movies, metadata, input.Fields)
+	} else {
+		err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "movies": data.ProjectMovies(movies, input.Fields)}, nil)
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
 }
+
+// moviePatch holds the fields of a movie a client wants to change, nil ones are left as they are
+type moviePatch struct {
+	Title   *string       `json:"title,omitempty"`
+	Year    *int32        `json:"year,omitempty"`
+	Runtime *data.Runtime `json:"runtime,omitempty"`
+	Genres  []string      `json:"genres,omitempty"`
+}
+
+func (p moviePatch) apply(movie *data.Movie) {
+	if p.Title != nil {
+		movie.Title = *p.Title
+	}
+
+	if p.Year != nil {
+		movie.Year = *p.Year
+	}
+
+	if p.Runtime != nil {
+		movie.Runtime = *p.Runtime
+	}
+
+	if p.Genres != nil {
+		movie.Genres = p.Genres
+	}
+}
+
+// patchMovie applies a merge patch or JSON patch to the document made of the movie's editable
+// fields. Fields removed by the patch are zeroed, so validation reports them as missing, while
+// fields the patched document can't hold are recorded on v
+func (app *application) patchMovie(movie *data.Movie, mediaType string, patch []byte, v *validator.Validator) error {
+	doc, err := json.Marshal(moviePatch{Title: &movie.Title, Year: &movie.Year, Runtime: &movie.Runtime, Genres: movie.Genres})
+	if err != nil {
+		return err
+	}
+
+	if mediaType == mediaTypeMergePatch {
+		doc, err = jsonpatch.MergePatch(doc, patch)
+	} else {
+		doc, err = jsonpatch.Apply(doc, patch)
+	}
+	if err != nil {
+		return err
+	}
+
+	var patched map[string]json.RawMessage
+
+	err = json.Unmarshal(doc, &patched)
+	if err != nil {
+		v.AddError("movie", "must be an object")
+		return nil
+	}
+
+	movie.Title, movie.Year, movie.Runtime, movie.Genres = "", 0, 0, nil
+
+	// decoded one field at a time so that every field at fault is reported
+	for key, value := range patched {
+		var dst interface{}
+
+		switch key {
+		case "title":
+			dst = &movie.Title
+		case "year":
+			dst = &movie.Year
+		case "runtime":
+			dst = &movie.Runtime
+		case "genres":
+			dst = &movie.Genres
+		default:
+			v.AddError(key, "cannot be changed")
+			continue
+		}
+
+		err = json.Unmarshal(value, dst)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvalidRuntimeFormat):
+				v.AddError(key, "must be formatted as \"<minutes> mins\"")
+			default:
+				v.AddError(key, "has the wrong JSON type")
+			}
+		}
+	}
+
+	return nil
+}
+
+// movieSortSafeList are the sort values accepted by the movie listing and export
+var movieSortSafeList = []string{
+	"id", "title", "year", "runtime", "average_rating", "rating_count", "relevance",
+	"-id", "-title", "-year", "-runtime", "-average_rating", "-rating_count",
+}
+
+// readMovieQuery reads and validates the criteria shared by the movie listing and export
+func (app *application) readMovieQuery(qs url.Values, v *validator.Validator) data.MovieQuery {
+	var q data.MovieQuery
+
+	q.Title = app.readString(qs, "title", "")
+	q.Match = app.readString(qs, "match", data.MatchExact)
+	q.Language = app.readString(qs, "language", "simple")
+	q.PersonID = int64(app.readInt(qs, "person_id", 0, v))
+
+	// genres predates genres_all and is kept as its alias
+	q.Genres = app.readCSV(qs, "genres_all", app.readCSV(qs, "genres", []string{}))
+	q.GenresAny = app.readCSV(qs, "genres_any", []string{})
+	q.ExcludeGenres = app.readCSV(qs, "exclude_genres", []string{})
+
+	q.YearMin = app.readInt32(qs, "year_min", 0, v)
+	q.YearMax = app.readInt32(qs, "year_max", 0, v)
+	q.RuntimeMin = app.readInt32(qs, "runtime_min", 0, v)
+	q.RuntimeMax = app.readInt32(qs, "runtime_max", 0, v)
+
+	q.CreatedAfter = app.readTime(qs, "created_after", v)
+	q.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	// only the requested fields are read from the database
+	q.Fields = app.readCSV(qs, "fields", nil)
+
+	data.ValidateMovieQuery(v, q)
+	data.ValidateMovieFields(v, q.Fields)
+
+	return q
+}
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCreateMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	writer := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	inactive := insertUser(t, app, "inactive@example.com", false, "movies:read", "movies:write")
+	inactiveToken := newToken(t, app, inactive, data.ScopeAuthentication)
+
+	valid := map[string]interface{}{
+		"title":   "Moana",
+		"year":    2016,
+		"runtime": "107 mins",
+		"genres":  []string{"animation", "adventure"},
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"valid", writer, valid, http.StatusCreated},
+		{"anonymous", "", valid, http.StatusUnauthorized},
+		{"inactive account", inactiveToken, valid, http.StatusForbidden},
+		{"missing permission", reader, valid, http.StatusForbidden},
+		{"malformed JSON", writer, `{"title": "Moana",}`, http.StatusBadRequest},
+		{"truncated JSON", writer, `{"title": "Moana"`, http.StatusBadRequest},
+		{"wrong JSON type", writer, `{"title": 123}`, http.StatusBadRequest},
+		{"unknown field", writer, `{"rating": 5}`, http.StatusBadRequest},
+		{"empty body", writer, "", http.StatusBadRequest},
+		{"multiple JSON values", writer, `{"title": "Moana"}{}`, http.StatusBadRequest},
+		{"invalid runtime format", writer, `{"runtime": "107"}`, http.StatusBadRequest},
+		{"failed validation", writer, map[string]interface{}{"title": "", "year": 1500}, http.StatusUnprocessableEntity},
+		{"duplicate genres", writer, map[string]interface{}{
+			"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"a", "a"},
+		}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/movies", tt.token, tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus == http.StatusCreated {
+				var got struct {
+					Movie struct {
+						ID      int64  `json:"ID"`
+						Title   string `json:"title"`
+						Version int32  `json:"version"`
+					} `json:"movie"`
+				}
+				res.decode(t, &got)
+
+				if got.Movie.Title != "Moana" || got.Movie.Version != 1 {
+					t.Errorf("got movie %+v", got.Movie)
+				}
+
+				if loc := res.header.Get("Location"); loc != "/v1/movies/1" {
+					t.Errorf("got Location %q; want %q", loc, "/v1/movies/1")
+				}
+			}
+		})
+	}
+}
+
+func TestShowMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+	movie := insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"existing", "/v1/movies/1", http.StatusOK},
+		{"missing", "/v1/movies/2", http.StatusNotFound},
+		{"negative id", "/v1/movies/-1", http.StatusNotFound},
+		{"non numeric id", "/v1/movies/foo", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus == http.StatusOK {
+				var got struct {
+					Movie struct {
+						Title   string `json:"title"`
+						Runtime string `json:"runtime"`
+					} `json:"movie"`
+				}
+				res.decode(t, &got)
+
+				if got.Movie.Title != movie.Title || got.Movie.Runtime != "134 mins" {
+					t.Errorf("got movie %+v", got.Movie)
+				}
+			}
+		})
+	}
+}
+
+// conflictingMovies simulates another client updating the movie between the handler's
+// read and its write
+type conflictingMovies struct {
+	data.MovieStore
+}
+
+func (m conflictingMovies) Update(ctx context.Context, movie *data.Movie, userID int64) error {
+	return data.ErrEditConflict
+}
+
+func TestUpdateMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	tests := []struct {
+		name       string
+		path       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"partial update", "/v1/movies/1", map[string]interface{}{"year": 2017}, http.StatusOK},
+		{"missing movie", "/v1/movies/2", map[string]interface{}{"year": 2017}, http.StatusNotFound},
+		{"non numeric id", "/v1/movies/foo", map[string]interface{}{"year": 2017}, http.StatusNotFound},
+		{"malformed JSON", "/v1/movies/1", `{"year": }`, http.StatusBadRequest},
+		{"failed validation", "/v1/movies/1", map[string]interface{}{"title": ""}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPatch, tt.path, token, tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	movie, err := app.models.Movies.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.Year != 2017 || movie.Title != "Deadpool" || movie.Version != 2 {
+		t.Errorf("got stored movie %+v", movie)
+	}
+
+	t.Run("edit conflict", func(t *testing.T) {
+		app.models.Movies = conflictingMovies{app.models.Movies}
+		ts := newTestServer(t, app.routes())
+
+		res := ts.do(t, http.MethodPatch, "/v1/movies/1", token, map[string]interface{}{"year": 2018})
+		if res.status != http.StatusConflict {
+			t.Fatalf("got status %d; want %d", res.status, http.StatusConflict)
+		}
+	})
+}
+
+func TestPatchMovieDocuments(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	const (
+		merge = "application/merge-patch+json"
+		patch = "application/json-patch+json"
+	)
+
+	// the steps run in order against the same movie
+	steps := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantTitle   string
+		wantGenres  string
+	}{
+		{"merge", merge, `{"title": "Deadpool 2", "year": 2018}`, http.StatusOK, "Deadpool 2", "[action comedy]"},
+		{"merge removing a field", merge, `{"genres": null}`, http.StatusUnprocessableEntity, "", ""},
+		{"merge read-only field", merge, `{"version": 9}`, http.StatusUnprocessableEntity, "", ""},
+		{"merge wrong type", merge, `{"year": "2018"}`, http.StatusUnprocessableEntity, "", ""},
+		{"merge malformed", merge, `{"year": }`, http.StatusBadRequest, "", ""},
+		{"append genre", patch, `[{"op": "add", "path": "/genres/-", "value": "sci-fi"}]`, http.StatusOK, "Deadpool 2", "[action comedy sci-fi]"},
+		{"remove genre", patch, `[{"op": "remove", "path": "/genres/1"}]`, http.StatusOK, "Deadpool 2", "[action sci-fi]"},
+		{
+			"test then replace", patch,
+			`[{"op": "test", "path": "/runtime", "value": "108 mins"}, {"op": "replace", "path": "/title", "value": "Deadpool & Wolverine"}]`,
+			http.StatusOK, "Deadpool & Wolverine", "[action sci-fi]",
+		},
+		{
+			"failed test", patch,
+			`[{"op": "test", "path": "/title", "value": "Deadpool"}, {"op": "replace", "path": "/year", "value": 2024}]`,
+			http.StatusConflict, "", "",
+		},
+		{"move", patch, `[{"op": "move", "from": "/genres/0", "path": "/genres/1"}]`, http.StatusOK, "Deadpool & Wolverine", "[sci-fi action]"},
+		{"missing path", patch, `[{"op": "remove", "path": "/genres/5"}]`, http.StatusUnprocessableEntity, "", ""},
+		{"unknown op", patch, `[{"op": "upsert", "path": "/year", "value": 2024}]`, http.StatusBadRequest, "", ""},
+		{"not an array", patch, `{"op": "remove", "path": "/year"}`, http.StatusBadRequest, "", ""},
+		{"invalid result", patch, `[{"op": "remove", "path": "/title"}]`, http.StatusUnprocessableEntity, "", ""},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPatch, "/v1/movies/1", token, step.body, "Content-Type", step.contentType)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+
+			if step.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Movie struct {
+					Title  string   `json:"title"`
+					Genres []string `json:"genres"`
+				} `json:"movie"`
+			}
+			res.decode(t, &got)
+
+			if got.Movie.Title != step.wantTitle || fmt.Sprint(got.Movie.Genres) != step.wantGenres {
+				t.Errorf("got %+v; want %q with genres %s", got.Movie, step.wantTitle, step.wantGenres)
+			}
+		})
+	}
+
+	movie, err := app.models.Movies.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every rejected patch must have left the movie alone
+	if movie.Year != 2018 || movie.Runtime != 108 || movie.Version != 6 {
+		t.Errorf("got stored movie %+v", movie)
+	}
+}
+
+func TestDeleteMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	tests := []struct {
+		name       string
+		token      string
+		path       string
+		wantStatus int
+	}{
+		{"missing permission", reader, "/v1/movies/1", http.StatusForbidden},
+		{"existing", token, "/v1/movies/1", http.StatusOK},
+		{"already deleted", token, "/v1/movies/1", http.StatusNotFound},
+		{"non numeric id", token, "/v1/movies/foo", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodDelete, tt.path, tt.token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestListMoviesHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "The Club", 2001, 90, "drama")
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTitles []string
+		wantTotal  int
+	}{
+		{"all", "", http.StatusOK, []string{"The Breakfast Club", "Black Panther", "Deadpool", "The Club"}, 4},
+		{"title search", "?title=the+club", http.StatusOK, []string{"The Breakfast Club", "The Club"}, 2},
+		{"genres", "?genres=action,comedy", http.StatusOK, []string{"Deadpool"}, 1},
+		{"sort descending", "?sort=-year", http.StatusOK, []string{"Black Panther", "Deadpool", "The Club", "The Breakfast Club"}, 4},
+		{"paginated", "?sort=title&page=2&page_size=2", http.StatusOK, []string{"The Breakfast Club", "The Club"}, 4},
+		{"no matches", "?title=moana", http.StatusOK, []string{}, 0},
+		{"year range", "?year_min=2000&year_max=2016", http.StatusOK, []string{"Deadpool", "The Club"}, 2},
+		{"minimum runtime", "?runtime_min=100", http.StatusOK, []string{"Black Panther", "Deadpool"}, 2},
+		{"runtime range", "?runtime_min=90&runtime_max=100", http.StatusOK, []string{"The Breakfast Club", "The Club"}, 2},
+		{"any genre", "?genres_any=comedy,adventure", http.StatusOK, []string{"The Breakfast Club", "Black Panther", "Deadpool"}, 3},
+		{"all genres", "?genres_all=action,comedy", http.StatusOK, []string{"Deadpool"}, 1},
+		{"excluded genres", "?exclude_genres=drama", http.StatusOK, []string{"Black Panther", "Deadpool"}, 2},
+		{"any genre minus excluded", "?genres_any=comedy&exclude_genres=action", http.StatusOK, []string{"The Breakfast Club"}, 1},
+		{"created after", "?created_after=2000-01-01", http.StatusOK, []string{"The Breakfast Club", "Black Panther", "Deadpool", "The Club"}, 4},
+		{"created before", "?created_before=2000-01-01T00:00:00Z", http.StatusOK, []string{}, 0},
+		{"inverted year range", "?year_min=2016&year_max=2000", http.StatusUnprocessableEntity, nil, 0},
+		{"negative runtime", "?runtime_min=-1", http.StatusUnprocessableEntity, nil, 0},
+		{"year wrapping around to 2016", "?year_min=4294969312", http.StatusUnprocessableEntity, nil, 0},
+		{"runtime beyond 32 bits", "?runtime_max=99999999999", http.StatusUnprocessableEntity, nil, 0},
+		{"invalid date", "?created_after=yesterday", http.StatusUnprocessableEntity, nil, 0},
+		{"inverted dates", "?created_after=2020-01-02&created_before=2020-01-01", http.StatusUnprocessableEntity, nil, 0},
+		{"invalid page", "?page=0", http.StatusUnprocessableEntity, nil, 0},
+		{"non integer page size", "?page_size=abc", http.StatusUnprocessableEntity, nil, 0},
+		{"page size too large", "?page_size=101", http.StatusUnprocessableEntity, nil, 0},
+		{"unsafe sort", "?sort=created_at", http.StatusUnprocessableEntity, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Metadata data.Metadata `json:"metadata"`
+				Movies   []struct {
+					Title string `json:"title"`
+				} `json:"movies"`
+			}
+			res.decode(t, &got)
+
+			if len(got.Movies) != len(tt.wantTitles) {
+				t.Fatalf("got %d movies; want %d", len(got.Movies), len(tt.wantTitles))
+			}
+
+			for i, movie := range got.Movies {
+				if movie.Title != tt.wantTitles[i] {
+					t.Errorf("movie %d: got %q; want %q", i, movie.Title, tt.wantTitles[i])
+				}
+			}
+
+			if got.Metadata.TotalRecords != tt.wantTotal {
+				t.Errorf("got total_records %d; want %d", got.Metadata.TotalRecords, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestMovieETags(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	res := ts.do(t, http.MethodGet, "/v1/movies/1", token, nil)
+	etag := res.header.Get("ETag")
+	if etag != `"1-1-0-0"` {
+		t.Fatalf("got ETag %q; want %q", etag, `"1-1-0-0"`)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/1", token, nil, "If-None-Match", etag)
+	if res.status != http.StatusNotModified || len(res.body) != 0 {
+		t.Fatalf("got status %d with %d byte body; want %d and no body", res.status, len(res.body), http.StatusNotModified)
+	}
+
+	res = ts.do(t, http.MethodPatch, "/v1/movies/1", token, map[string]interface{}{"year": 2017}, "If-Match", etag)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", res.status, http.StatusOK)
+	}
+
+	newETag := res.header.Get("ETag")
+	if newETag != `"1-2-0-0"` {
+		t.Fatalf("got ETag %q after update; want %q", newETag, `"1-2-0-0"`)
+	}
+
+	// a review changes the rating aggregates without bumping the version
+	reviewer := authenticatedUser(t, app, "reviewer@example.com", "movies:read")
+
+	res = ts.do(t, http.MethodPost, "/v1/movies/1/reviews", reviewer, map[string]interface{}{"rating": 4})
+	if res.status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusCreated, res.body)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/1", token, nil, "If-None-Match", newETag)
+	if res.status != http.StatusOK || res.header.Get("ETag") != `"1-2-1-4"` {
+		t.Fatalf("got status %d with ETag %q after a review; want %d with %q", res.status, res.header.Get("ETag"), http.StatusOK, `"1-2-1-4"`)
+	}
+
+	staleETag, newETag := newETag, res.header.Get("ETag")
+
+	tests := []struct {
+		name       string
+		method     string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{"stale If-None-Match", http.MethodGet, "If-None-Match", etag, http.StatusOK},
+		{"weak If-None-Match", http.MethodGet, "If-None-Match", "W/" + newETag, http.StatusNotModified},
+		{"stale If-Match on update", http.MethodPatch, "If-Match", etag, http.StatusPreconditionFailed},
+		{"weak If-Match on update", http.MethodPatch, "If-Match", "W/" + newETag, http.StatusPreconditionFailed},
+		{"stale If-Match on delete", http.MethodDelete, "If-Match", etag, http.StatusPreconditionFailed},
+		{"If-Match from before the review", http.MethodPatch, "If-Match", staleETag, http.StatusPreconditionFailed},
+		{"current If-Match in list on delete", http.MethodDelete, "If-Match", `"9-9-0-0", ` + newETag, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body interface{}
+			if tt.method == http.MethodPatch {
+				body = map[string]interface{}{"year": 2018}
+			}
+
+			res := ts.do(t, tt.method, "/v1/movies/1", token, body, tt.header, tt.value)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+}
+
+func TestListMoviesCursor(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "The Club", 2001, 90, "drama")
+	insertMovie(t, app, "Moana", 2016, 107, "animation")
+
+	type page struct {
+		Metadata data.Metadata `json:"metadata"`
+		Movies   []struct {
+			ID int64 `json:"ID"`
+		} `json:"movies"`
+	}
+
+	list := func(t *testing.T, query string) page {
+		res := ts.do(t, http.MethodGet, "/v1/movies"+query, token, nil)
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+		}
+
+		var got page
+		res.decode(t, &got)
+
+		return got
+	}
+
+	for _, sort := range []string{"id", "-id", "title", "-year", "year", "runtime", "-average_rating", "rating_count"} {
+		t.Run(sort, func(t *testing.T) {
+			var want []int64
+			for _, movie := range list(t, "?page_size=100&sort="+sort).Movies {
+				want = append(want, movie.ID)
+			}
+
+			var got []int64
+
+			next := list(t, "?page_size=2&sort="+sort)
+			for {
+				for _, movie := range next.Movies {
+					got = append(got, movie.ID)
+				}
+
+				if next.Metadata.NextCursor == "" {
+					break
+				}
+
+				if next.Metadata.TotalRecords != len(want) {
+					t.Errorf("got total_records %d; want %d", next.Metadata.TotalRecords, len(want))
+				}
+
+				next = list(t, "?page_size=2&sort="+sort+"&cursor="+next.Metadata.NextCursor)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got ids %v; want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("insert while scrolling", func(t *testing.T) {
+		first := list(t, "?page_size=2&sort=title")
+
+		insertMovie(t, app, "Avatar", 2009, 162, "action")
+
+		second := list(t, "?page_size=2&sort=title&cursor="+first.Metadata.NextCursor)
+
+		for _, movie := range second.Movies {
+			if movie.ID == first.Movies[0].ID || movie.ID == first.Movies[1].ID {
+				t.Errorf("got movie %d on both pages", movie.ID)
+			}
+		}
+	})
+
+	t.Run("skip count", func(t *testing.T) {
+		got := list(t, "?page_size=2&count=false")
+
+		if got.Metadata.TotalRecords != 0 || got.Metadata.LastPage != 0 || got.Metadata.NextCursor == "" {
+			t.Errorf("got metadata %+v; want no count and a next cursor", got.Metadata)
+		}
+	})
+
+	cursor := list(t, "?page_size=2&sort=title").Metadata.NextCursor
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"malformed cursor", "?cursor=not-a-cursor"},
+		{"cursor for another sort", "?sort=-title&cursor=" + cursor},
+		{"cursor with page", "?sort=title&page=2&cursor=" + cursor},
+		{"invalid count", "?count=maybe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, nil)
+
+			if res.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusUnprocessableEntity, res.body)
+			}
+		})
+	}
+}
+
+func TestSearchMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "The Godfather Part II", 1974, 202, "crime", "drama")
+	insertMovie(t, app, "The Godfather", 1972, 175, "crime", "drama")
+	insertMovie(t, app, "Godzilla", 2014, 123, "action")
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+	insertMovie(t, app, "Heist <img src=x onerror=alert(1)> \uE001Night", 2020, 90, "crime")
+
+	tests := []struct {
+		name           string
+		query          string
+		wantStatus     int
+		wantTitles     []string
+		wantHighlights []string
+	}{
+		{"exact needs whole words", "?title=godf", http.StatusOK, []string{}, nil},
+		{"prefix", "?title=godf&match=prefix", http.StatusOK,
+			[]string{"The Godfather Part II", "The Godfather"},
+			[]string{"The <mark>Godfather</mark> Part II", "The <mark>Godfather</mark>"}},
+		{"fuzzy tolerates typos", "?title=godfathr&match=fuzzy", http.StatusOK, []string{"The Godfather Part II", "The Godfather"}, nil},
+		{"fuzzy without typos", "?title=breakfast+club&match=fuzzy", http.StatusOK,
+			[]string{"The Breakfast Club"},
+			[]string{"The <mark>Breakfast</mark> <mark>Club</mark>"}},
+		{"markup in the title is escaped", "?title=heist", http.StatusOK,
+			[]string{"Heist <img src=x onerror=alert(1)> \uE001Night"},
+			[]string{"<mark>Heist</mark> &lt;img src=x onerror=alert(1)&gt; Night"}},
+		{"relevance", "?title=godfather&sort=relevance", http.StatusOK, []string{"The Godfather", "The Godfather Part II"}, nil},
+		{"language", "?title=godfather&language=english", http.StatusOK, []string{"The Godfather Part II", "The Godfather"}, nil},
+		{"relevance without title", "?sort=relevance", http.StatusUnprocessableEntity, nil, nil},
+		{"unknown match mode", "?title=godfather&match=sounds-like", http.StatusUnprocessableEntity, nil, nil},
+		{"unknown language", "?title=godfather&language=klingon", http.StatusUnprocessableEntity, nil, nil},
+		{"relevance with cursor", "?title=godfather&sort=relevance&cursor=abc", http.StatusUnprocessableEntity, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/movies"+tt.query, token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Movies []struct {
+					Title     string `json:"title"`
+					Highlight string `json:"highlight"`
+				} `json:"movies"`
+			}
+			res.decode(t, &got)
+
+			if len(got.Movies) != len(tt.wantTitles) {
+				t.Fatalf("got %d movies; want %d", len(got.Movies), len(tt.wantTitles))
+			}
+
+			for i, movie := range got.Movies {
+				if movie.Title != tt.wantTitles[i] {
+					t.Errorf("movie %d: got %q; want %q", i, movie.Title, tt.wantTitles[i])
+				}
+
+				if tt.wantHighlights != nil && movie.Highlight != tt.wantHighlights[i] {
+					t.Errorf("movie %d: got highlight %q; want %q", i, movie.Highlight, tt.wantHighlights[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListMoviesFacets(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "The Breakfast Club", 1985, 97, "comedy", "drama")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "The Club", 2001, 90, "drama")
+	insertMovie(t, app, "Gone with the Wind", 1939, 238, "drama", "romance")
+
+	res := ts.do(t, http.MethodGet, "/v1/movies?genres_any=drama&page_size=1&facets=genres,decade,runtime_bucket", token, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+	}
+
+	var got struct {
+		Metadata data.Metadata `json:"metadata"`
+		Movies   []struct {
+			Title string `json:"title"`
+		} `json:"movies"`
+	}
+	res.decode(t, &got)
+
+	if len(got.Movies) != 1 || got.Metadata.TotalRecords != 3 {
+		t.Fatalf("got %d movies out of %d; want 1 out of 3", len(got.Movies), got.Metadata.TotalRecords)
+	}
+
+	want := map[string][]data.FacetCount{
+		"genres":         {{Value: "drama", Count: 3}, {Value: "comedy", Count: 1}, {Value: "romance", Count: 1}},
+		"decade":         {{Value: "1930s", Count: 1}, {Value: "1980s", Count: 1}, {Value: "2000s", Count: 1}},
+		"runtime_bucket": {{Value: "90-119", Count: 2}, {Value: "150+", Count: 1}},
+	}
+
+	if fmt.Sprint(got.Metadata.Facets) != fmt.Sprint(want) {
+		t.Errorf("got facets %v; want %v", got.Metadata.Facets, want)
+	}
+
+	got.Metadata = data.Metadata{}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies", token, nil)
+	if res.decode(t, &got); got.Metadata.Facets != nil {
+		t.Errorf("got facets %v without asking for them", got.Metadata.Facets)
+	}
+
+	for _, query := range []string{"?facets=studio", "?facets=genres,genres"} {
+		res := ts.do(t, http.MethodGet, "/v1/movies"+query, token, nil)
+		if res.status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d; want %d", query, res.status, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestMovieFields(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantKeys   string
+	}{
+		{"show", "/v1/movies/1?fields=title,year", http.StatusOK, "title,year"},
+		{"show with id", "/v1/movies/1?fields=id,genres", http.StatusOK, "ID,genres"},
+		{"show with credits", "/v1/movies/1?fields=title&include=credits", http.StatusOK, "credits,title"},
+		{"show everything", "/v1/movies/1", http.StatusOK, "ID,average_rating,genres,rating_count,runtime,title,version,year"},
+		{"list", "/v1/movies?fields=title,runtime&sort=-year", http.StatusOK, "runtime,title"},
+		{"list with highlight", "/v1/movies?fields=id&title=deadpool", http.StatusOK, "ID,highlight"},
+		{"unknown field", "/v1/movies/1?fields=created_at", http.StatusUnprocessableEntity, ""},
+		{"repeated field", "/v1/movies?fields=title,title", http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, tt.path, token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Movie  map[string]interface{}   `json:"movie"`
+				Movies []map[string]interface{} `json:"movies"`
+			}
+			res.decode(t, &got)
+
+			if got.Movie != nil {
+				got.Movies = append(got.Movies, got.Movie)
+			}
+
+			if len(got.Movies) == 0 {
+				t.Fatalf("got no movies (%s)", res.body)
+			}
+
+			for _, movie := range got.Movies {
+				keys := make([]string, 0, len(movie))
+				for key := range movie {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				if strings.Join(keys, ",") != tt.wantKeys {
+					t.Errorf("got keys %v; want %s", keys, tt.wantKeys)
+				}
+			}
+		})
+	}
+}
+
+func TestConditionalDeleteLosesToConcurrentUpdate(t *testing.T) {
+	app := newTestApplication(t)
+
+	movie := insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+
+	// an update lands between the If-Match check and the delete
+	movie.Year = 2017
+	if err := app.models.Movies.Update(context.Background(), movie, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	err := app.models.Movies.Delete(context.Background(), movie.ID, 1, 0)
+	if !errors.Is(err, data.ErrEditConflict) {
+		t.Fatalf("got error %v; want %v", err, data.ErrEditConflict)
+	}
+
+	if _, err := app.models.Movies.Get(context.Background(), movie.ID); err != nil {
+		t.Errorf("got error %v; want the updated movie kept", err)
+	}
+}
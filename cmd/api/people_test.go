@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPeopleAndCredits(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	editor := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write", "people:read", "people:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read", "people:read")
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"missing permission", http.MethodPost, "/v1/people", reader, map[string]interface{}{"name": "Ryan Reynolds"}, http.StatusForbidden},
+		{"missing name", http.MethodPost, "/v1/people", editor, map[string]interface{}{"birth_year": 1976}, http.StatusUnprocessableEntity},
+		{"create person", http.MethodPost, "/v1/people", editor, map[string]interface{}{"name": "Ryan Reynolds", "birth_year": 1976}, http.StatusCreated},
+		{"create another", http.MethodPost, "/v1/people", editor, map[string]interface{}{"name": "Tim Miller"}, http.StatusCreated},
+		{"show person", http.MethodGet, "/v1/people/1", reader, nil, http.StatusOK},
+		{"unknown person", http.MethodGet, "/v1/people/9", reader, nil, http.StatusNotFound},
+		{"update person", http.MethodPatch, "/v1/people/2", editor, map[string]interface{}{"bio": "Director"}, http.StatusOK},
+		{"list people", http.MethodGet, "/v1/people?name=ryan", reader, nil, http.StatusOK},
+		{"credit actor", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 1, "role": "actor", "character": "Wade Wilson"}, http.StatusCreated},
+		{"credit director", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 2, "role": "director"}, http.StatusCreated},
+		{"credit twice", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 2, "role": "director"}, http.StatusUnprocessableEntity},
+		{"unknown role", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 2, "role": "caterer"}, http.StatusUnprocessableEntity},
+		{"character for non-actor", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 2, "role": "writer", "character": "Wade"}, http.StatusUnprocessableEntity},
+		{"unknown person credit", http.MethodPost, "/v1/movies/1/credits", editor, map[string]interface{}{"person_id": 9, "role": "actor"}, http.StatusUnprocessableEntity},
+		{"credit without movies:write", http.MethodPost, "/v1/movies/1/credits", reader, map[string]interface{}{"person_id": 1, "role": "writer"}, http.StatusForbidden},
+		{"unknown include", http.MethodGet, "/v1/movies/1?include=reviews", reader, nil, http.StatusUnprocessableEntity},
+		{"invalid person_id", http.MethodGet, "/v1/movies?person_id=abc", reader, nil, http.StatusUnprocessableEntity},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			res := ts.do(t, step.method, step.path, step.token, step.body)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+		})
+	}
+
+	type credit struct {
+		ID         int64  `json:"id"`
+		PersonName string `json:"person_name"`
+		Role       string `json:"role"`
+		Character  string `json:"character"`
+	}
+
+	var show struct {
+		Movie struct {
+			Credits []credit `json:"credits"`
+		} `json:"movie"`
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/movies/1?include=credits", reader, nil)
+	res.decode(t, &show)
+
+	if len(show.Movie.Credits) != 2 || show.Movie.Credits[0].PersonName != "Ryan Reynolds" || show.Movie.Credits[0].Character != "Wade Wilson" {
+		t.Errorf("got credits %+v", show.Movie.Credits)
+	}
+
+	if res.header.Get("ETag") != "" {
+		t.Errorf("got ETag %q on a response with credits; want none", res.header.Get("ETag"))
+	}
+
+	var list struct {
+		Movies []struct {
+			Title   string   `json:"title"`
+			Credits []credit `json:"credits"`
+		} `json:"movies"`
+	}
+
+	ts.do(t, http.MethodGet, "/v1/movies?person_id=1&include=credits", reader, nil).decode(t, &list)
+
+	if len(list.Movies) != 1 || list.Movies[0].Title != "Deadpool" || len(list.Movies[0].Credits) != 2 {
+		t.Errorf("got movies %+v; want Deadpool with its credits", list.Movies)
+	}
+
+	res = ts.do(t, http.MethodDelete, "/v1/people/1", editor, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d deleting person; want %d", res.status, http.StatusOK)
+	}
+
+	var credits struct {
+		Credits []credit `json:"credits"`
+	}
+
+	ts.do(t, http.MethodGet, "/v1/movies/1/credits", reader, nil).decode(t, &credits)
+
+	if len(credits.Credits) != 1 || credits.Credits[0].Role != "director" {
+		t.Fatalf("got credits %+v; want only the director", credits.Credits)
+	}
+
+	res = ts.do(t, http.MethodDelete, "/v1/movies/2/credits/2", editor, nil)
+	if res.status != http.StatusNotFound {
+		t.Errorf("got status %d deleting another movie's credit; want %d", res.status, http.StatusNotFound)
+	}
+
+	res = ts.do(t, http.MethodDelete, "/v1/movies/1/credits/2", editor, nil)
+	if res.status != http.StatusOK {
+		t.Errorf("got status %d deleting credit; want %d", res.status, http.StatusOK)
+	}
+}
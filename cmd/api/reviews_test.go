@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestMovieReviews(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := authenticatedUser(t, app, "alice@example.com", "movies:read")
+	bob := authenticatedUser(t, app, "bob@example.com", "movies:read")
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"anonymous", http.MethodPost, "/v1/movies/1/reviews", "", map[string]interface{}{"rating": 4}, http.StatusUnauthorized},
+		{"unknown movie", http.MethodPost, "/v1/movies/9/reviews", alice, map[string]interface{}{"rating": 4}, http.StatusNotFound},
+		{"rating out of range", http.MethodPost, "/v1/movies/1/reviews", alice, map[string]interface{}{"rating": 6}, http.StatusUnprocessableEntity},
+		{"malformed JSON", http.MethodPost, "/v1/movies/1/reviews", alice, `{"rating": "4"}`, http.StatusBadRequest},
+		{"alice reviews", http.MethodPost, "/v1/movies/1/reviews", alice, map[string]interface{}{"rating": 4, "body": "Fun"}, http.StatusCreated},
+		{"alice reviews twice", http.MethodPost, "/v1/movies/1/reviews", alice, map[string]interface{}{"rating": 2}, http.StatusUnprocessableEntity},
+		{"bob reviews", http.MethodPost, "/v1/movies/1/reviews", bob, map[string]interface{}{"rating": 3}, http.StatusCreated},
+		{"bob reviews another movie", http.MethodPost, "/v1/movies/2/reviews", bob, map[string]interface{}{"rating": 4}, http.StatusCreated},
+		{"bob updates his review", http.MethodPatch, "/v1/movies/1/reviews", bob, map[string]interface{}{"rating": 5}, http.StatusOK},
+		{"alice has no review to update", http.MethodPatch, "/v1/movies/2/reviews", alice, map[string]interface{}{"rating": 5}, http.StatusNotFound},
+		{"list", http.MethodGet, "/v1/movies/1/reviews?sort=-rating", alice, nil, http.StatusOK},
+		{"invalid sort", http.MethodGet, "/v1/movies/1/reviews?sort=body", alice, nil, http.StatusUnprocessableEntity},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			res := ts.do(t, step.method, step.path, step.token, step.body)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+		})
+	}
+
+	movie, err := app.models.Movies.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.AverageRating != 4.5 || movie.RatingCount != 2 {
+		t.Errorf("got average %v over %d ratings; want 4.5 over 2", movie.AverageRating, movie.RatingCount)
+	}
+
+	res := ts.do(t, http.MethodGet, "/v1/movies?sort=-average_rating", alice, nil)
+
+	var got struct {
+		Movies []struct {
+			Title         string  `json:"title"`
+			AverageRating float64 `json:"average_rating"`
+			RatingCount   int32   `json:"rating_count"`
+		} `json:"movies"`
+	}
+	res.decode(t, &got)
+
+	if len(got.Movies) != 2 || got.Movies[0].Title != "Deadpool" || got.Movies[0].RatingCount != 2 {
+		t.Fatalf("got movies %+v; want Deadpool first", got.Movies)
+	}
+
+	res = ts.do(t, http.MethodDelete, "/v1/movies/1/reviews", bob, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d deleting review; want %d", res.status, http.StatusOK)
+	}
+
+	movie, err = app.models.Movies.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.AverageRating != 4 || movie.RatingCount != 1 {
+		t.Errorf("got average %v over %d ratings after delete; want 4 over 1", movie.AverageRating, movie.RatingCount)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestMovieRevisions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	writer := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	res := ts.do(t, http.MethodPost, "/v1/movies", writer, map[string]interface{}{
+		"title": "Deadpool", "year": 2016, "runtime": "108 mins", "genres": []string{"action"},
+	})
+	if res.status != http.StatusCreated {
+		t.Fatalf("got status %d creating movie; want %d", res.status, http.StatusCreated)
+	}
+
+	res = ts.do(t, http.MethodPatch, "/v1/movies/1", writer, map[string]interface{}{"title": "Deadpool 2", "year": 2018})
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d updating movie; want %d", res.status, http.StatusOK)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/1/revisions", reader, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d listing revisions; want %d", res.status, http.StatusOK)
+	}
+
+	var got struct {
+		Revisions []struct {
+			Version  int32  `json:"version"`
+			Action   string `json:"action"`
+			UserName string `json:"user_name"`
+			Changes  map[string]struct {
+				From interface{} `json:"from"`
+				To   interface{} `json:"to"`
+			} `json:"changes"`
+		} `json:"revisions"`
+	}
+	res.decode(t, &got)
+
+	if len(got.Revisions) != 2 {
+		t.Fatalf("got %d revisions; want 2", len(got.Revisions))
+	}
+
+	update := got.Revisions[1]
+	if update.Action != "update" || update.Version != 2 || update.UserName != "Test User" {
+		t.Errorf("got revision %+v", update)
+	}
+
+	if len(update.Changes) != 2 || update.Changes["title"].From != "Deadpool" || update.Changes["title"].To != "Deadpool 2" {
+		t.Errorf("got changes %+v; want title and year", update.Changes)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		path       string
+		wantStatus int
+	}{
+		{"missing permission", reader, "/v1/movies/1/revisions/1/restore", http.StatusForbidden},
+		{"unknown version", writer, "/v1/movies/1/revisions/9/restore", http.StatusNotFound},
+		{"version wrapping around to 1", writer, "/v1/movies/1/revisions/4294967297/restore", http.StatusNotFound},
+		{"unknown movie", writer, "/v1/movies/2/revisions/1/restore", http.StatusNotFound},
+		{"restore first version", writer, "/v1/movies/1/revisions/1/restore", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, tt.path, tt.token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	movie, err := app.models.Movies.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if movie.Title != "Deadpool" || movie.Year != 2016 || movie.Version != 3 {
+		t.Errorf("got restored movie %+v", movie)
+	}
+
+	res = ts.do(t, http.MethodGet, "/v1/movies/2/revisions", reader, nil)
+	if res.status != http.StatusNotFound {
+		t.Errorf("got status %d for a movie without history; want %d", res.status, http.StatusNotFound)
+	}
+}
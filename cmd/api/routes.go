@@ -14,6 +14,14 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowed)
 
+	// autocomplete fires on every keystroke, so it is throttled by a roomier bucket of its own
+	// rather than eating into the client's global allowance. Its route is also registered on
+	// bucketed, which tells rateLimit to leave it alone
+	suggest := app.suggestRateLimit(app.requirePermission("movies:read", app.suggestMoviesHandler))
+
+	bucketed := httprouter.New()
+	bucketed.HandlerFunc(http.MethodGet, "/v1/movies/suggest", suggest)
+
 	// register relevant methods, URL patterns and handler functions for our endpoints
 
 	// SERVER ENDPOINT
@@ -21,23 +29,93 @@ func (app *application) routes() http.Handler {
 
 	// MOVIES ENDPOINT
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.idempotency(app.createMovieHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id", app.routeParam("id", map[string]http.HandlerFunc{
+		"import": app.requirePermission("movies:write", app.idempotency(app.createImportHandler)),
+		"batch":  app.requirePermission("movies:write", app.idempotency(app.batchMoviesHandler)),
+	}, app.methodNotAllowed))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.routeParam("id", map[string]http.HandlerFunc{
+		"trash":   app.requirePermission("movies:write", app.listTrashedMoviesHandler),
+		"suggest": suggest,
+		"export":  app.requirePermission("movies:read", app.exportMoviesHandler),
+		"changes": app.requirePermission("movies:read", app.movieChangesHandler),
+	}, app.requirePermission("movies:read", app.showMovieHandler)))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission("movies:write", app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions", app.requirePermission("movies:read", app.listMovieRevisionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/revisions/:version/restore", app.requirePermission("movies:write", app.restoreMovieRevisionHandler))
+
+	// REVIEWS ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requireActivatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews", app.requireActivatedUser(app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews", app.requireActivatedUser(app.deleteReviewHandler))
+
+	// CREDITS ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/credits", app.requirePermission("movies:read", app.listCreditsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/credits", app.requirePermission("movies:write", app.createCreditHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/credits/:credit_id", app.requirePermission("movies:write", app.deleteCreditHandler))
+
+	// PEOPLE ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/people", app.requirePermission("people:read", app.listPeopleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/people", app.requirePermission("people:write", app.createPersonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requirePermission("people:read", app.showPersonHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/people/:id", app.requirePermission("people:write", app.updatePersonHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/people/:id", app.requirePermission("people:write", app.deletePersonHandler))
+
+	// IMPORTS ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/imports/:id", app.requirePermission("movies:write", app.showImportHandler))
 
 	// USER ENDPOINT
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPut, "v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	// WATCHLIST ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlist", app.requirePermission("movies:read", app.listWatchlistHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlist", app.requirePermission("movies:read", app.addToWatchlistHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlist/:movie_id", app.requireActivatedUser(app.updateWatchlistItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlist/:movie_id", app.requireActivatedUser(app.removeFromWatchlistHandler))
 
 	// TOKENS ENDPOINT
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationToken)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetToken)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationToken)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.idempotency(app.createPasswordResetToken))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.idempotency(app.createActivationToken))
+
+	// WEBHOOKS ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePermission("admin", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePermission("admin", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePermission("admin", app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("admin", app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("admin", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("admin", app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries/:delivery_id", app.requirePermission("admin", app.showWebhookDeliveryHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", app.requirePermission("admin", app.redeliverWebhookHandler))
+
+	// JOBS ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/jobs", app.requirePermission("admin", app.listJobsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/jobs/:id/retry", app.requirePermission("admin", app.retryJobHandler))
+
+	// ADMIN ENDPOINT
+	router.HandlerFunc(http.MethodGet, "/v1/admin/mail/preview/:template", app.requirePermission("admin", app.previewMailHandler))
 
 	// METRICS
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router), bucketed))))
+}
+
+// routeParam sends requests whose URL parameter equals one of the fixed values to the matching
+// handler and everything else to next. httprouter refuses to register a static segment such as
+// /v1/movies/trash alongside /v1/movies/:id, so fixed views are dispatched from the :id route
+func (app *application) routeParam(name string, fixed map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := fixed[httprouter.ParamsFromContext(r.Context()).ByName(name)]; ok {
+			h(w, r)
+			return
+		}
+
+		next(w, r)
+	}
 }
@@ -20,6 +20,48 @@ func (app *application) serve() error {
 		IdleTimeout:  time.Minute,
 	}
 
+	// ctx is cancelled as soon as shutdown starts so long-running background loops can exit
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	app.background(func() {
+		app.purgeTrash(ctx)
+	})
+
+	app.background(func() {
+		app.purgeIdempotencyKeys(ctx)
+	})
+
+	app.background(func() {
+		app.dispatchWebhooks(ctx)
+	})
+
+	app.background(func() {
+		app.failAbandonedImports(ctx)
+	})
+
+	app.background(func() {
+		app.purgeMovieChanges(ctx)
+	})
+
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.background(func() {
+			app.work(ctx)
+		})
+	}
+
+	// cancelling ctx also ends the change streams, which Shutdown would otherwise wait on
+	app.background(func() {
+		app.runChangeBroker(ctx)
+	})
+
+	// the memory store has nothing to listen to, the broker's polling picks its changes up
+	if app.config.store == "postgres" {
+		app.background(func() {
+			app.listenForChanges(ctx)
+		})
+	}
+
 	shutdownError := make(chan error)
 
 	go func() {
@@ -32,13 +74,15 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		stopBackground()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
 		// The Shutdown() method does not wait for any background tasks to complete, nor does it
 		// close hijacked long-lived connections like WebSockets.
 		// you will need to implement your own logic to coordinate a graceful shutdown of these things.
-		err := srv.Shutdown(ctx)
+		err := srv.Shutdown(shutdownCtx)
 		if err != nil {
 			shutdownError <- err
 		}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSuggestMovies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "The Godfather Part II", 1974, 202, "crime", "drama")
+	insertMovie(t, app, "The Godfather", 1972, 175, "crime", "drama")
+	insertMovie(t, app, "Godzilla", 2014, 123, "action")
+	insertMovie(t, app, "Gods of Egypt", 2016, 127, "fantasy")
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTitles []string
+	}{
+		{"title prefix first", "?q=god", http.StatusOK, []string{"Gods of Egypt", "Godzilla", "The Godfather", "The Godfather Part II"}},
+		{"word prefix", "?q=the+godf", http.StatusOK, []string{"The Godfather", "The Godfather Part II"}},
+		{"typo", "?q=godfathr", http.StatusOK, []string{"The Godfather", "The Godfather Part II"}},
+		{"limit", "?q=god&limit=2", http.StatusOK, []string{"Gods of Egypt", "Godzilla"}},
+		{"wildcards are literal", "?q=%25", http.StatusOK, []string{}},
+		{"missing q", "", http.StatusUnprocessableEntity, nil},
+		{"limit too large", "?q=god&limit=21", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodGet, "/v1/movies/suggest"+tt.query, token, nil)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got struct {
+				Suggestions []struct {
+					ID    int64  `json:"id"`
+					Title string `json:"title"`
+					Year  int32  `json:"year"`
+				} `json:"suggestions"`
+			}
+			res.decode(t, &got)
+
+			if len(got.Suggestions) != len(tt.wantTitles) {
+				t.Fatalf("got %+v; want %v", got.Suggestions, tt.wantTitles)
+			}
+
+			for i, suggestion := range got.Suggestions {
+				if suggestion.Title != tt.wantTitles[i] || suggestion.ID == 0 || suggestion.Year == 0 {
+					t.Errorf("suggestion %d: got %+v; want %q", i, suggestion, tt.wantTitles[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSuggestRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 1
+	app.config.limiter.burst = 1
+	app.config.limiter.suggestRPS = 1
+	app.config.limiter.suggestBurst = 3
+
+	ts := newTestServer(t, app.routes())
+
+	token := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	// suggestions draw from their own bucket and leave the global one untouched
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		res := ts.do(t, http.MethodGet, "/v1/movies/suggest?q=god", token, nil)
+
+		if res.status != want {
+			t.Fatalf("suggestion %d: got status %d; want %d", i, res.status, want)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		res := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+
+		if res.status != want {
+			t.Fatalf("request %d: got status %d; want %d", i, res.status, want)
+		}
+	}
+	// other spellings of the path aren't the suggestions route, so they are charged to the
+	// global bucket like any other request
+	res := ts.do(t, http.MethodGet, "/v1/movies/suggest/?q=god", token, nil)
+	if res.status != http.StatusTooManyRequests {
+		t.Errorf("trailing slash got status %d; want %d", res.status, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/jsonlog"
+	"github.com/4925k/greenlight/internal/mailer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentMail is a single email captured by testMailer
+type sentMail struct {
+	recipient string
+	template  string
+	data      interface{}
+}
+
+// testMailer records every email instead of sending it, after rendering it with the real
+// templates so that data a template can't render fails the test. Sends fail with err while
+// it is set
+type testMailer struct {
+	mailer.Mailer
+
+	mu   sync.Mutex
+	sent []sentMail
+	err  error
+}
+
+func (m *testMailer) Send(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	_, err := m.Render(recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.sent = append(m.sent, sentMail{recipient: recipient, template: templateFile, data: data})
+	return nil
+}
+
+func (m *testMailer) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+}
+
+func (m *testMailer) messages() []sentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]sentMail(nil), m.sent...)
+}
+
+// newTestApplication returns an application backed by the in-memory models and a
+// capturing mailer, with logging silenced and the rate limiter disabled
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+
+	cfg := config{env: "testing"}
+	cfg.jobs.maxAttempts = 3
+	cfg.jobs.timeout = 5 * time.Second
+
+	m, err := mailer.New(mailer.NewMemoryTransport(), "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		config: cfg,
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.NewMemoryModels(),
+		mailer: &testMailer{Mailer: m},
+	}
+}
+
+// mails returns the emails captured so far, after waiting for background tasks to finish
+// and running the jobs which are due
+func (app *application) mails(t *testing.T) []sentMail {
+	t.Helper()
+
+	app.wg.Wait()
+	runJobs(t, app)
+
+	return app.mailer.(*testMailer).messages()
+}
+
+// runJobs runs the queued jobs which are due, as a worker would, and returns how many ran
+func runJobs(t *testing.T, app *application) int {
+	t.Helper()
+
+	handlers := app.jobHandlers()
+
+	n := 0
+	for {
+		ran, err := app.runNextJob(context.Background(), handlers)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ran {
+			return n
+		}
+		n++
+	}
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	return &testServer{ts}
+}
+
+// testResponse holds the parts of a response the tests assert on
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// decode unmarshals the response body into dst, failing the test on error
+func (r testResponse) decode(t *testing.T, dst interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(r.body, dst)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", r.body, err)
+	}
+}
+
+// do sends a request with an optional bearer token. A string body is sent as is so
+// malformed JSON can be exercised; anything else is marshalled first
+func (ts *testServer) do(t *testing.T, method, path, token string, body interface{}, headers ...string) testResponse {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = bytes.NewBufferString(b)
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewBuffer(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testResponse{status: res.StatusCode, header: res.Header, body: resBody}
+}
+
+const testPassword = "pa55word1234"
+
+// insertUser stores a user with the given activation state and permissions
+func insertUser(t *testing.T, app *application, email string, activated bool, permissions ...string) *data.User {
+	t.Helper()
+
+	user := &data.User{Name: "Test User", Email: email, Activated: activated}
+
+	err := user.Password.Set(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Permissions.AddForUser(context.Background(), user.ID, permissions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// newToken issues a token for the user and returns its plaintext
+func newToken(t *testing.T, app *application, user *data.User, scope string) string {
+	t.Helper()
+
+	token, err := app.models.Tokens.New(context.Background(), user.ID, time.Hour, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Plaintext
+}
+
+// authenticatedUser stores an activated user with the given permissions and returns an
+// authentication token for it
+func authenticatedUser(t *testing.T, app *application, email string, permissions ...string) string {
+	t.Helper()
+
+	user := insertUser(t, app, email, true, permissions...)
+	return newToken(t, app, user, data.ScopeAuthentication)
+}
+
+// insertMovie stores a movie directly through the models
+func insertMovie(t *testing.T, app *application, title string, year int32, runtime data.Runtime, genres ...string) *data.Movie {
+	t.Helper()
+
+	movie := &data.Movie{Title: title, Year: year, Runtime: runtime, Genres: genres}
+
+	err := app.models.Movies.Insert(context.Background(), movie, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return movie
+}
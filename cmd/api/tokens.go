@@ -32,7 +32,7 @@ func (app *application) createAuthenticationToken(w http.ResponseWriter, r *http
 	}
 
 	// get user info by email
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrNoRecordFound):
@@ -56,9 +56,10 @@ func (app *application) createAuthenticationToken(w http.ResponseWriter, r *http
 	}
 
 	// generate a new token with 24 hour validity
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
 	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
@@ -85,7 +86,7 @@ func (app *application) createPasswordResetToken(w http.ResponseWriter, r *http.
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrNoRecordFound):
@@ -103,23 +104,13 @@ func (app *application) createPasswordResetToken(w http.ResponseWriter, r *http.
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	// the token is created as the email goes out, see sendUserEmailJob
+	err = app.enqueueJob(r.Context(), jobSendPasswordResetEmail, data.UserJob{UserID: user.ID})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	app.background(func() {
-		payload := map[string]interface{}{
-			"passwordResetToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_password-reset.tmpl", payload)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
 
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
@@ -148,7 +139,7 @@ func (app *application) createActivationToken(w http.ResponseWriter, r *http.Req
 	}
 
 	// get user details
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrNoRecordFound):
@@ -167,24 +158,13 @@ func (app *application) createActivationToken(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	// email user with activation token, which is created as the email goes out
+	err = app.enqueueJob(r.Context(), jobSendActivationEmail, data.UserJob{UserID: user.ID})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// email user with activation token
-	app.background(func() {
-		load := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", load)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	// reply to request
 	env := envelope{"message": "an email will be sent to you with activation guide"}
 	err = app.writeJSON(w, http.StatusOK, env, nil)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateAuthenticationToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	insertUser(t, app, "alice@example.com", true, "movies:read")
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"valid", map[string]string{"email": "alice@example.com", "password": testPassword}, http.StatusCreated},
+		{"wrong password", map[string]string{"email": "alice@example.com", "password": "wr0ng-password"}, http.StatusUnauthorized},
+		{"unknown email", map[string]string{"email": "bob@example.com", "password": testPassword}, http.StatusUnauthorized},
+		{"invalid email", map[string]string{"email": "alice", "password": testPassword}, http.StatusUnprocessableEntity},
+		{"missing password", map[string]string{"email": "alice@example.com"}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `{"email": "alice@example.com" "password": ""}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var got struct {
+				Token struct {
+					Token string `json:"token"`
+				} `json:"authentication_token"`
+			}
+			res.decode(t, &got)
+
+			// the issued token must grant access to protected endpoints
+			res = ts.do(t, http.MethodGet, "/v1/movies", got.Token.Token, nil)
+			if res.status != http.StatusOK {
+				t.Errorf("got status %d using the issued token; want %d", res.status, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestCreatePasswordResetToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	insertUser(t, app, "alice@example.com", true)
+	insertUser(t, app, "inactive@example.com", false)
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"valid", map[string]string{"email": "alice@example.com"}, http.StatusAccepted},
+		{"inactive account", map[string]string{"email": "inactive@example.com"}, http.StatusUnprocessableEntity},
+		{"unknown email", map[string]string{"email": "bob@example.com"}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `{`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/password-reset", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	mails := app.mails(t)
+	if len(mails) != 1 || mails[0].recipient != "alice@example.com" {
+		t.Fatalf("got emails %+v; want one to alice@example.com", mails)
+	}
+}
+
+func TestCreateActivationToken(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	insertUser(t, app, "alice@example.com", false)
+	insertUser(t, app, "active@example.com", true)
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"valid", map[string]string{"email": "alice@example.com"}, http.StatusOK},
+		{"already activated", map[string]string{"email": "active@example.com"}, http.StatusUnprocessableEntity},
+		{"unknown email", map[string]string{"email": "bob@example.com"}, http.StatusUnprocessableEntity},
+		{"empty body", "", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/tokens/activation", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	mails := app.mails(t)
+	if len(mails) != 1 || mails[0].template != "token_activation.tmpl" {
+		t.Fatalf("got emails %+v; want one activation email", mails)
+	}
+}
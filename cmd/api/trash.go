@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// listTrashedMoviesHandler lists deleted movies that can still be restored
+// curl localhost:4000/v1/movies/trash
+func (app *application) listTrashedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	filters.SortSafeList = []string{"id", "title", "year", "runtime", "deleted_at", "-id", "-title", "-year", "-runtime", "-deleted_at"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetTrash(r.Context(), filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "movies": movies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreMovieHandler takes a deleted movie back out of the trash
+// curl -X POST localhost:4000/v1/movies/123/restore
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Undelete(r.Context(), id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, http.Header{"ETag": []string{movieETag(movie)}})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// purgeTrash permanently removes movies that have been in the trash for longer than the
+// configured retention. It runs once an hour until ctx is cancelled
+func (app *application) purgeTrash(ctx context.Context) {
+	if app.config.trash.retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		purged, err := app.models.Movies.PurgeDeleted(ctx, time.Now().Add(-app.config.trash.retention))
+		switch {
+		case err != nil && !errors.Is(err, context.Canceled):
+			app.logger.PrintError(err, nil)
+		case purged > 0:
+			app.logger.PrintInfo("purged deleted movies", map[string]string{"count": strconv.FormatInt(purged, 10)})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMovieTrash(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	writer := authenticatedUser(t, app, "writer@example.com", "movies:read", "movies:write")
+	reader := authenticatedUser(t, app, "reader@example.com", "movies:read")
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+
+	res := ts.do(t, http.MethodDelete, "/v1/movies/1", writer, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d deleting; want %d", res.status, http.StatusOK)
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantCount  int
+	}{
+		{"trashed movie is hidden", http.MethodGet, "/v1/movies/1", reader, http.StatusNotFound, 0},
+		{"trashed movie is not listed", http.MethodGet, "/v1/movies", reader, http.StatusOK, 1},
+		{"trash needs write permission", http.MethodGet, "/v1/movies/trash", reader, http.StatusForbidden, 0},
+		{"trash lists the movie", http.MethodGet, "/v1/movies/trash", writer, http.StatusOK, 1},
+		{"trashed movie cannot be updated", http.MethodPatch, "/v1/movies/1", writer, http.StatusNotFound, 0},
+		{"live movie cannot be restored", http.MethodPost, "/v1/movies/2/restore", writer, http.StatusNotFound, 0},
+		{"restore", http.MethodPost, "/v1/movies/1/restore", writer, http.StatusOK, 0},
+		{"restored movie is visible", http.MethodGet, "/v1/movies/1", reader, http.StatusOK, 0},
+		{"trash is empty", http.MethodGet, "/v1/movies/trash", writer, http.StatusOK, 0},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			var body interface{}
+			if step.method == http.MethodPatch {
+				body = map[string]interface{}{"year": 2017}
+			}
+
+			res := ts.do(t, step.method, step.path, step.token, body)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+
+			if step.method == http.MethodGet && step.wantStatus == http.StatusOK && step.path != "/v1/movies/1" {
+				var got struct {
+					Movies []struct{} `json:"movies"`
+				}
+				res.decode(t, &got)
+
+				if len(got.Movies) != step.wantCount {
+					t.Errorf("got %d movies; want %d", len(got.Movies), step.wantCount)
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	app := newTestApplication(t)
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+
+	err := app.models.Movies.Delete(context.Background(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := app.models.Movies.PurgeDeleted(context.Background(), time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Fatalf("got %d purged (err %v) before the retention elapsed; want 0", purged, err)
+	}
+
+	purged, err = app.models.Movies.PurgeDeleted(context.Background(), time.Now().Add(time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatalf("got %d purged (err %v); want 1", purged, err)
+	}
+
+	_, err = app.models.Movies.Undelete(context.Background(), 1, 0)
+	if err == nil {
+		t.Error("purged movie should not be restorable")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"github.com/4925k/greenlight/internal/data"
+	"net/http"
+	"testing"
+)
+
+func TestRegisterUserHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	insertUser(t, app, "taken@example.com", true)
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"valid", map[string]string{"name": "Alice", "email": "alice@example.com", "password": testPassword}, http.StatusAccepted},
+		{"duplicate email", map[string]string{"name": "Bob", "email": "TAKEN@example.com", "password": testPassword}, http.StatusUnprocessableEntity},
+		{"invalid email", map[string]string{"name": "Bob", "email": "bob", "password": testPassword}, http.StatusUnprocessableEntity},
+		{"short password", map[string]string{"name": "Bob", "email": "bob@example.com", "password": "short"}, http.StatusUnprocessableEntity},
+		{"missing name", map[string]string{"email": "bob@example.com", "password": testPassword}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `{"name": "Bob"`, http.StatusBadRequest},
+		{"unknown field", `{"admin": true}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/users", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	mails := app.mails(t)
+	if len(mails) != 1 {
+		t.Fatalf("got %d emails; want 1", len(mails))
+	}
+
+	if mails[0].recipient != "alice@example.com" || mails[0].template != "user_welcome.tmpl" {
+		t.Errorf("got email %+v", mails[0])
+	}
+
+	user, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Activated {
+		t.Error("new user should not be activated")
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !permissions.Include("movies:read") || permissions.Include("movies:write") {
+		t.Errorf("got permissions %v; want [movies:read]", permissions)
+	}
+}
+
+func TestActivateUserHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user := insertUser(t, app, "alice@example.com", false)
+	activation := newToken(t, app, user, data.ScopeActivation)
+	authentication := newToken(t, app, user, data.ScopeAuthentication)
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"wrong scope", map[string]string{"token": authentication}, http.StatusUnprocessableEntity},
+		{"malformed token", map[string]string{"token": "abc"}, http.StatusUnprocessableEntity},
+		{"unknown token", map[string]string{"token": "AAAAAAAAAAAAAAAAAAAAAAAAAA"}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `{"token": `, http.StatusBadRequest},
+		{"valid", map[string]string{"token": activation}, http.StatusOK},
+		{"token already used", map[string]string{"token": activation}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPut, "/v1/users/activated", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	got, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Activated {
+		t.Error("user should be activated")
+	}
+}
+
+func TestUpdateUserPasswordHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user := insertUser(t, app, "alice@example.com", true)
+	reset := newToken(t, app, user, data.ScopePasswordReset)
+
+	const newPassword = "n3w-pa55word"
+
+	tests := []struct {
+		name       string
+		body       interface{}
+		wantStatus int
+	}{
+		{"short password", map[string]string{"password": "short", "token": reset}, http.StatusUnprocessableEntity},
+		{"unknown token", map[string]string{"password": newPassword, "token": "AAAAAAAAAAAAAAAAAAAAAAAAAA"}, http.StatusUnprocessableEntity},
+		{"malformed JSON", `["password"]`, http.StatusBadRequest},
+		{"valid", map[string]string{"password": newPassword, "token": reset}, http.StatusOK},
+		{"token already used", map[string]string{"password": newPassword, "token": reset}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPut, "/v1/users/password", "", tt.body)
+
+			if res.status != tt.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	got, err := app.models.Users.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match, err := got.Password.Matches(newPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !match {
+		t.Error("password was not updated")
+	}
+}
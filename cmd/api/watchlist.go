@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// watchlistSortSafeList are the watchlist's own sort values followed by the movie listing's,
+// bar relevance which only means something in a title search
+var watchlistSortSafeList = func() []string {
+	list := []string{"position", "added_at", "watched_at", "-position", "-added_at", "-watched_at"}
+
+	for _, sort := range movieSortSafeList {
+		if strings.TrimPrefix(sort, "-") != "relevance" {
+			list = append(list, sort)
+		}
+	}
+
+	return list
+}()
+
+// listWatchlistHandler returns a page of the authenticated user's watchlist. It takes the
+// same page, page_size and sort parameters as /v1/movies plus an optional watched filter
+// curl localhost:4000/v1/users/me/watchlist?watched=false&sort=-added_at
+func (app *application) listWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	watched := app.readBool(qs, "watched", v)
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	filters.Sort = app.readString(qs, "sort", "position")
+	filters.SortSafeList = watchlistSortSafeList
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	items, metadata, err := app.models.Watchlists.GetAll(r.Context(), app.contextGetUser(r).ID, watched, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "watchlist": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addToWatchlistHandler appends a movie to the end of the authenticated user's watchlist
+// curl -X POST -d '{"movie_id": 123}' localhost:4000/v1/users/me/watchlist
+func (app *application) addToWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MovieID int64 `json:"movie_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.MovieID > 0, "movie_id", "must be a positive integer"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(r.Context(), input.MovieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			v.AddError("movie_id", "movie does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	item, err := app.models.Watchlists.Add(r.Context(), app.contextGetUser(r).ID, movie.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateWatchlistItem):
+			v.AddError("movie_id", "movie is already on your watchlist")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrNoRecordFound):
+			v.AddError("movie_id", "movie does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	item.Movie = movie
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/users/me/watchlist/%d", movie.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"item": item}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWatchlistItemHandler marks a watchlist entry as watched or unwatched and moves it
+// to a new position
+// curl -X PATCH -d '{"watched": true, "position": 1}' localhost:4000/v1/users/me/watchlist/123
+func (app *application) updateWatchlistItemHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readInt64Param(r, "movie_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	item, err := app.models.Watchlists.Get(r.Context(), user.ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Watched  *bool  `json:"watched"`
+		Position *int32 `json:"position"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Position != nil {
+		v.Check(*input.Position > 0, "position", "must be greater than zero")
+		item.Position = *input.Position
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// only stamp watched_at on the transition so repeating the request keeps the original time
+	if input.Watched != nil && *input.Watched != item.Watched {
+		item.Watched = *input.Watched
+		item.WatchedAt = nil
+
+		if item.Watched {
+			now := time.Now().Truncate(time.Second)
+			item.WatchedAt = &now
+		}
+	}
+
+	err = app.models.Watchlists.Update(r.Context(), item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeFromWatchlistHandler takes a movie off the authenticated user's watchlist
+// curl -X DELETE localhost:4000/v1/users/me/watchlist/123
+func (app *application) removeFromWatchlistHandler(w http.ResponseWriter, r *http.Request) {
+	movieID, err := app.readInt64Param(r, "movie_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Watchlists.Remove(r.Context(), app.contextGetUser(r).ID, movieID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully removed from watchlist"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
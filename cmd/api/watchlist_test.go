@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWatchlist(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := authenticatedUser(t, app, "alice@example.com", "movies:read")
+	bob := authenticatedUser(t, app, "bob@example.com", "movies:read")
+
+	insertMovie(t, app, "Deadpool", 2016, 108, "action", "comedy")
+	insertMovie(t, app, "Black Panther", 2018, 134, "action", "adventure")
+	insertMovie(t, app, "Moana", 2016, 107, "animation")
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"anonymous", http.MethodGet, "/v1/users/me/watchlist", "", nil, http.StatusUnauthorized},
+		{"unknown movie", http.MethodPost, "/v1/users/me/watchlist", alice, map[string]interface{}{"movie_id": 9}, http.StatusUnprocessableEntity},
+		{"add first", http.MethodPost, "/v1/users/me/watchlist", alice, map[string]interface{}{"movie_id": 1}, http.StatusCreated},
+		{"add second", http.MethodPost, "/v1/users/me/watchlist", alice, map[string]interface{}{"movie_id": 2}, http.StatusCreated},
+		{"add third", http.MethodPost, "/v1/users/me/watchlist", alice, map[string]interface{}{"movie_id": 3}, http.StatusCreated},
+		{"add twice", http.MethodPost, "/v1/users/me/watchlist", alice, map[string]interface{}{"movie_id": 1}, http.StatusUnprocessableEntity},
+		{"move third to the top", http.MethodPatch, "/v1/users/me/watchlist/3", alice, map[string]interface{}{"position": 1}, http.StatusOK},
+		{"mark watched", http.MethodPatch, "/v1/users/me/watchlist/1", alice, map[string]interface{}{"watched": true}, http.StatusOK},
+		{"invalid position", http.MethodPatch, "/v1/users/me/watchlist/1", alice, map[string]interface{}{"position": 0}, http.StatusUnprocessableEntity},
+		{"not on bob's list", http.MethodPatch, "/v1/users/me/watchlist/1", bob, map[string]interface{}{"watched": true}, http.StatusNotFound},
+		{"remove from bob's list", http.MethodDelete, "/v1/users/me/watchlist/1", bob, nil, http.StatusNotFound},
+		{"invalid watched filter", http.MethodGet, "/v1/users/me/watchlist?watched=maybe", alice, nil, http.StatusUnprocessableEntity},
+		{"invalid sort", http.MethodGet, "/v1/users/me/watchlist?sort=genres", alice, nil, http.StatusUnprocessableEntity},
+		{"relevance sort", http.MethodGet, "/v1/users/me/watchlist?sort=relevance", alice, nil, http.StatusUnprocessableEntity},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			res := ts.do(t, step.method, step.path, step.token, step.body)
+
+			if res.status != step.wantStatus {
+				t.Fatalf("got status %d; want %d (%s)", res.status, step.wantStatus, res.body)
+			}
+		})
+	}
+
+	type watchlist struct {
+		Watchlist []struct {
+			MovieID   int64       `json:"movie_id"`
+			Position  int32       `json:"position"`
+			Watched   bool        `json:"watched"`
+			WatchedAt interface{} `json:"watched_at"`
+			Movie     struct {
+				Title string `json:"title"`
+			} `json:"movie"`
+		} `json:"watchlist"`
+		Metadata struct {
+			TotalRecords int `json:"total_records"`
+		} `json:"metadata"`
+	}
+
+	var got watchlist
+	ts.do(t, http.MethodGet, "/v1/users/me/watchlist", alice, nil).decode(t, &got)
+
+	order := []int64{3, 1, 2}
+	if len(got.Watchlist) != len(order) {
+		t.Fatalf("got %d items; want %d", len(got.Watchlist), len(order))
+	}
+
+	for i, item := range got.Watchlist {
+		if item.MovieID != order[i] || item.Position != int32(i+1) {
+			t.Errorf("got movie %d at position %d; want movie %d at %d", item.MovieID, item.Position, order[i], i+1)
+		}
+	}
+
+	if got.Watchlist[1].Movie.Title != "Deadpool" || !got.Watchlist[1].Watched || got.Watchlist[1].WatchedAt == nil {
+		t.Errorf("got item %+v; want watched Deadpool", got.Watchlist[1])
+	}
+
+	got = watchlist{}
+	ts.do(t, http.MethodGet, "/v1/users/me/watchlist?watched=false&sort=-title", alice, nil).decode(t, &got)
+
+	if got.Metadata.TotalRecords != 2 || got.Watchlist[0].Movie.Title != "Moana" {
+		t.Errorf("got %+v; want Moana then Black Panther", got)
+	}
+
+	res := ts.do(t, http.MethodDelete, "/v1/users/me/watchlist/3", alice, nil)
+	if res.status != http.StatusOK {
+		t.Fatalf("got status %d removing item; want %d", res.status, http.StatusOK)
+	}
+
+	got = watchlist{}
+	ts.do(t, http.MethodGet, "/v1/users/me/watchlist", alice, nil).decode(t, &got)
+
+	if len(got.Watchlist) != 2 || got.Watchlist[0].MovieID != 1 || got.Watchlist[0].Position != 1 {
+		t.Errorf("got %+v; want positions to close the gap", got.Watchlist)
+	}
+
+	got = watchlist{}
+	ts.do(t, http.MethodGet, "/v1/users/me/watchlist", bob, nil).decode(t, &got)
+
+	if len(got.Watchlist) != 0 {
+		t.Errorf("got %d items on bob's list; want 0", len(got.Watchlist))
+	}
+}
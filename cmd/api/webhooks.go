@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"github.com/4925k/greenlight/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookBatchSize    = 50
+	webhookPollInterval = 5 * time.Second
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 12 * time.Hour
+)
+
+// readWebhook fetches the webhook named in the URL, sending a 404 and returning false when it
+// doesn't exist
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	webhook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return webhook, true
+}
+
+// createWebhookHandler subscribes a URL to events. The secret signing the deliveries is only
+// ever returned here
+// curl -X POST -d '{"url": "https://example.com/hooks", "events": ["movie.created"]}' localhost:4000/v1/webhooks
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+		Active: input.Active == nil || *input.Active,
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhook.Secret, err = data.NewWebhookSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(r.Context(), webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook, "secret": webhook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhooksHandler returns every webhook
+// curl localhost:4000/v1/webhooks
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showWebhookHandler returns a single webhook
+// curl localhost:4000/v1/webhooks/1
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWebhookHandler changes the URL or events of a webhook, or pauses it. Deliveries of a
+// paused webhook wait until it is active again
+// curl -X PATCH -d '{"active": false}' localhost:4000/v1/webhooks/1
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(r.Context(), webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWebhookHandler removes a webhook along with its deliveries
+// curl -X DELETE localhost:4000/v1/webhooks/1
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Webhooks.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler pages through the deliveries of a webhook, newest first
+// curl localhost:4000/v1/webhooks/1/deliveries?status=failed
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	v.Check(status == "" || validator.In(status, data.DeliveryPending, data.DeliveryDelivered, data.DeliveryFailed), "status", "invalid status")
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	filters.Sort = app.readString(qs, "sort", "-created_at")
+	filters.SortSafeList = []string{"created_at", "next_attempt_at", "-created_at", "-next_attempt_at"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(r.Context(), webhook.ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "deliveries": deliveries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readDelivery fetches the delivery named in the URL, sending a 404 and returning false when
+// it doesn't exist or belongs to another webhook
+func (app *application) readDelivery(w http.ResponseWriter, r *http.Request) (*data.WebhookDelivery, bool) {
+	webhookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readInt64Param(r, "delivery_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	delivery, err := app.models.Webhooks.GetDelivery(r.Context(), webhookID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return delivery, true
+}
+
+// showWebhookDeliveryHandler returns a delivery along with the log of its attempts
+// curl localhost:4000/v1/webhooks/1/deliveries/1
+func (app *application) showWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := app.readDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	attempts, err := app.models.Webhooks.GetAttempts(r.Context(), delivery.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery, "attempts": attempts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// redeliverWebhookHandler queues a delivery to be sent again straight away, whether it went
+// through, failed for good or is still being retried. One being sent right now is refused
+// curl -X POST localhost:4000/v1/webhooks/1/deliveries/1/redeliver
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	delivery, ok := app.readDelivery(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, err := app.models.Webhooks.Redeliver(r.Context(), delivery.WebhookID, delivery.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNoRecordFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.errorResponse(w, r, http.StatusConflict, "the delivery is being sent right now, try again once it has finished")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// signWebhook computes the X-Greenlight-Signature of a delivery: the hex encoded HMAC-SHA256,
+// keyed with the webhook's secret, of the timestamp and the body joined by a dot. Signing the
+// timestamp lets receivers turn away replays of old deliveries
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookLease is how long a claimed delivery is left alone by other dispatchers. It must
+// outlast the request with room to spare for recording the attempt, or another dispatcher
+// could pick the delivery up while it is still being sent
+func (app *application) webhookLease() time.Duration {
+	return 2*app.config.webhooks.timeout + 30*time.Second
+}
+
+// deliverWebhooks sends the deliveries which are due, returning how many it claimed. Each
+// outcome is logged as an attempt: a 2xx response completes the delivery while anything else
+// schedules another attempt with an exponential backoff, until the attempts run out
+func (app *application) deliverWebhooks(ctx context.Context) (int, error) {
+	deliveries, err := app.models.Webhooks.ClaimDue(ctx, webhookBatchSize, app.webhookLease())
+	if err != nil {
+		return 0, err
+	}
+
+	client := &http.Client{
+		Timeout: app.config.webhooks.timeout,
+		// a redirect counts as a failure, the webhook should be updated to the new URL
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var wg sync.WaitGroup
+
+	for _, delivery := range deliveries {
+		wg.Add(1)
+
+		go func(delivery *data.WebhookDelivery) {
+			defer wg.Done()
+
+			err := app.deliverWebhook(ctx, client, delivery)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				app.logger.PrintError(err, map[string]string{"delivery_id": strconv.FormatInt(delivery.ID, 10)})
+			}
+		}(delivery)
+	}
+
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+func (app *application) deliverWebhook(ctx context.Context, client *http.Client, delivery *data.WebhookDelivery) error {
+	body, err := json.Marshal(envelope{
+		"id":         delivery.ID,
+		"event":      delivery.Event,
+		"created_at": delivery.CreatedAt,
+		"data":       delivery.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "greenlight-webhooks/"+version)
+	req.Header.Set("X-Greenlight-Event", delivery.Event)
+	req.Header.Set("X-Greenlight-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Greenlight-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Greenlight-Signature", signWebhook(delivery.Secret, timestamp, body))
+
+	attempt := &data.WebhookAttempt{}
+	start := time.Now()
+
+	res, err := client.Do(req)
+	if err == nil {
+		// drain a bit of the body so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+		res.Body.Close()
+
+		attempt.StatusCode = res.StatusCode
+	} else {
+		attempt.Error = err.Error()
+	}
+
+	attempt.DurationMS = time.Since(start).Milliseconds()
+
+	// shutting down isn't the receiver's fault, the delivery is picked up again once its lease runs out
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	now := time.Now()
+
+	delivery.Attempts++
+	delivery.LastStatusCode, delivery.LastError = attempt.StatusCode, attempt.Error
+
+	switch {
+	case err == nil && res.StatusCode >= 200 && res.StatusCode < 300:
+		delivery.Status = data.DeliveryDelivered
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= app.config.webhooks.maxAttempts:
+		delivery.Status = data.DeliveryFailed
+
+		app.logger.PrintInfo("webhook delivery failed", map[string]string{
+			"delivery_id": strconv.FormatInt(delivery.ID, 10),
+			"webhook_id":  strconv.FormatInt(delivery.WebhookID, 10),
+			"attempts":    strconv.Itoa(delivery.Attempts),
+		})
+	default:
+		delivery.NextAttemptAt = now.Add(backoff(webhookBaseBackoff, webhookMaxBackoff, delivery.Attempts))
+	}
+
+	return app.models.Webhooks.RecordAttempt(ctx, delivery, attempt)
+}
+
+// dispatchWebhooks delivers due webhooks every webhookPollInterval until ctx is cancelled,
+// going again straight away as long as there is a backlog
+func (app *application) dispatchWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		claimed, err := app.deliverWebhooks(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			app.logger.PrintError(err, nil)
+		}
+
+		if claimed == webhookBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
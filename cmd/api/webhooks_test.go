@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/4925k/greenlight/internal/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver stands in for a client's endpoint, keeping every request it gets
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+
+	rcv := &webhookReceiver{status: http.StatusNoContent}
+
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		rcv.requests = append(rcv.requests, receivedWebhook{header: r.Header.Clone(), body: body})
+		w.WriteHeader(rcv.status)
+	}))
+	t.Cleanup(rcv.Close)
+
+	return rcv
+}
+
+func (rcv *webhookReceiver) respondWith(status int) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.status = status
+}
+
+// received returns the requests received so far and forgets them
+func (rcv *webhookReceiver) received() []receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	requests := rcv.requests
+	rcv.requests = nil
+
+	return requests
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.webhooks.maxAttempts = 3
+
+	ts := newTestServer(t, app.routes())
+	rcv := newWebhookReceiver(t)
+
+	admin := authenticatedUser(t, app, "admin@example.com", "admin", "movies:read", "movies:write")
+	editor := authenticatedUser(t, app, "editor@example.com", "movies:read", "movies:write")
+
+	rejected := []struct {
+		name       string
+		token      string
+		body       interface{}
+		wantStatus int
+	}{
+		{"not an admin", editor, map[string]interface{}{"url": rcv.URL, "events": []string{"movie.created"}}, http.StatusForbidden},
+		{"missing url", admin, map[string]interface{}{"events": []string{"movie.created"}}, http.StatusUnprocessableEntity},
+		{"relative url", admin, map[string]interface{}{"url": "/hooks", "events": []string{"movie.created"}}, http.StatusUnprocessableEntity},
+		{"no events", admin, map[string]interface{}{"url": rcv.URL, "events": []string{}}, http.StatusUnprocessableEntity},
+		{"unknown event", admin, map[string]interface{}{"url": rcv.URL, "events": []string{"movie.rated"}}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.do(t, http.MethodPost, "/v1/webhooks", tt.token, tt.body)
+			if res.status != tt.wantStatus {
+				t.Errorf("got status %d; want %d (%s)", res.status, tt.wantStatus, res.body)
+			}
+		})
+	}
+
+	res := ts.do(t, http.MethodPost, "/v1/webhooks", admin, map[string]interface{}{
+		"url":    rcv.URL,
+		"events": []string{"movie.created", "movie.deleted", "user.activated"},
+	})
+	if res.status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusCreated, res.body)
+	}
+
+	var created struct {
+		Webhook data.Webhook `json:"webhook"`
+		Secret  string       `json:"secret"`
+	}
+	res.decode(t, &created)
+
+	if created.Secret == "" {
+		t.Fatal("got no secret for a new webhook")
+	}
+
+	if res := ts.do(t, http.MethodGet, "/v1/webhooks/1", admin, nil); res.status != http.StatusOK || bytes.Contains(res.body, []byte(created.Secret)) {
+		t.Errorf("got status %d showing the webhook, or its secret (%s)", res.status, res.body)
+	}
+
+	// each change fires the events the webhook subscribed to, and only those
+	ts.do(t, http.MethodPost, "/v1/movies", editor, map[string]interface{}{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": []string{"animation"}})
+	ts.do(t, http.MethodPatch, "/v1/movies/1", editor, map[string]interface{}{"year": 2017})
+	ts.do(t, http.MethodDelete, "/v1/movies/1", editor, nil)
+
+	user := insertUser(t, app, "new@example.com", false)
+	token := newToken(t, app, user, data.ScopeActivation)
+	if res := ts.do(t, http.MethodPut, "/v1/users/activated", "", map[string]interface{}{"token": token}); res.status != http.StatusOK {
+		t.Fatalf("got status %d activating a user (%s)", res.status, res.body)
+	}
+
+	claimed, err := app.deliverWebhooks(context.Background())
+	if err != nil || claimed != 3 {
+		t.Fatalf("got %d deliveries (%v); want 3", claimed, err)
+	}
+
+	requests := rcv.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests; want 3", len(requests))
+	}
+
+	events := make(map[string]bool)
+
+	for _, req := range requests {
+		timestamp, _ := strconv.ParseInt(req.header.Get("X-Greenlight-Timestamp"), 10, 64)
+
+		if got, want := req.header.Get("X-Greenlight-Signature"), signWebhook(created.Secret, timestamp, req.body); got != want {
+			t.Errorf("got signature %q; want %q", got, want)
+		}
+
+		var body struct {
+			ID    int64                      `json:"id"`
+			Event string                     `json:"event"`
+			Data  map[string]json.RawMessage `json:"data"`
+		}
+
+		err := json.Unmarshal(req.body, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if body.Event != req.header.Get("X-Greenlight-Event") || strconv.FormatInt(body.ID, 10) != req.header.Get("X-Greenlight-Delivery") {
+			t.Errorf("got body %s not matching headers %v", req.body, req.header)
+		}
+
+		events[body.Event] = true
+	}
+
+	for _, event := range []string{data.EventMovieCreated, data.EventMovieDeleted, data.EventUserActivated} {
+		if !events[event] {
+			t.Errorf("got no %s delivery", event)
+		}
+	}
+
+	t.Run("retries with backoff", func(t *testing.T) {
+		rcv.respondWith(http.StatusInternalServerError)
+
+		ts.do(t, http.MethodPost, "/v1/movies", editor, map[string]interface{}{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation"}})
+
+		if claimed, _ := app.deliverWebhooks(context.Background()); claimed != 1 {
+			t.Fatalf("got %d deliveries; want 1", claimed)
+		}
+
+		// the next attempt isn't due yet
+		if claimed, _ := app.deliverWebhooks(context.Background()); claimed != 0 {
+			t.Fatalf("got %d deliveries straight after a failure; want 0", claimed)
+		}
+
+		var list struct {
+			Deliveries []data.WebhookDelivery `json:"deliveries"`
+		}
+		ts.do(t, http.MethodGet, "/v1/webhooks/1/deliveries?status=pending", admin, nil).decode(t, &list)
+
+		if len(list.Deliveries) != 1 {
+			t.Fatalf("got %d pending deliveries; want 1", len(list.Deliveries))
+		}
+
+		d := list.Deliveries[0]
+		if d.Attempts != 1 || d.LastStatusCode != http.StatusInternalServerError || d.NextAttemptAt.Before(time.Now()) {
+			t.Errorf("got delivery %+v; want a second attempt scheduled", d)
+		}
+
+		rcv.respondWith(http.StatusOK)
+
+		path := fmt.Sprintf("/v1/webhooks/1/deliveries/%d", d.ID)
+
+		if res := ts.do(t, http.MethodPost, path+"/redeliver", admin, nil); res.status != http.StatusAccepted {
+			t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusAccepted, res.body)
+		}
+
+		if claimed, _ := app.deliverWebhooks(context.Background()); claimed != 1 {
+			t.Fatalf("got %d redeliveries; want 1", claimed)
+		}
+
+		var shown struct {
+			Delivery data.WebhookDelivery  `json:"delivery"`
+			Attempts []data.WebhookAttempt `json:"attempts"`
+		}
+		ts.do(t, http.MethodGet, path, admin, nil).decode(t, &shown)
+
+		if shown.Delivery.Status != data.DeliveryDelivered || len(shown.Attempts) != 2 {
+			t.Fatalf("got status %q with %d attempts; want delivered after 2", shown.Delivery.Status, len(shown.Attempts))
+		}
+
+		if shown.Attempts[0].StatusCode != http.StatusInternalServerError || shown.Attempts[1].StatusCode != http.StatusOK {
+			t.Errorf("got attempts %+v", shown.Attempts)
+		}
+
+		rcv.received()
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		app.config.webhooks.maxAttempts = 1
+		rcv.respondWith(http.StatusBadGateway)
+
+		ts.do(t, http.MethodDelete, "/v1/movies/2", editor, nil)
+
+		if claimed, _ := app.deliverWebhooks(context.Background()); claimed != 1 {
+			t.Fatalf("got %d deliveries; want 1", claimed)
+		}
+
+		var list struct {
+			Deliveries []data.WebhookDelivery `json:"deliveries"`
+		}
+		ts.do(t, http.MethodGet, "/v1/webhooks/1/deliveries?status=failed", admin, nil).decode(t, &list)
+
+		if len(list.Deliveries) != 1 || list.Deliveries[0].Event != data.EventMovieDeleted {
+			t.Errorf("got failed deliveries %+v; want the movie.deleted one", list.Deliveries)
+		}
+	})
+
+	t.Run("redelivery while sending", func(t *testing.T) {
+		ts.do(t, http.MethodPost, "/v1/movies", editor, map[string]interface{}{"title": "Cars", "year": 2006, "runtime": "117 mins", "genres": []string{"animation"}})
+
+		// a dispatcher has claimed the delivery and is still waiting on the receiver
+		claimed, err := app.models.Webhooks.ClaimDue(context.Background(), webhookBatchSize, app.webhookLease())
+		if err != nil || len(claimed) != 1 {
+			t.Fatalf("claimed %d deliveries (%v); want 1", len(claimed), err)
+		}
+
+		path := fmt.Sprintf("/v1/webhooks/1/deliveries/%d/redeliver", claimed[0].ID)
+
+		if res := ts.do(t, http.MethodPost, path, admin, nil); res.status != http.StatusConflict {
+			t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusConflict, res.body)
+		}
+
+		claimed[0].Status, claimed[0].Attempts = data.DeliveryDelivered, 1
+		if err := app.models.Webhooks.RecordAttempt(context.Background(), claimed[0], &data.WebhookAttempt{StatusCode: http.StatusOK}); err != nil {
+			t.Fatal(err)
+		}
+
+		if res := ts.do(t, http.MethodPost, path, admin, nil); res.status != http.StatusAccepted {
+			t.Errorf("got status %d once sent; want %d (%s)", res.status, http.StatusAccepted, res.body)
+		}
+
+		app.deliverWebhooks(context.Background())
+		rcv.received()
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		res := ts.do(t, http.MethodPatch, "/v1/webhooks/1", admin, map[string]interface{}{"active": false})
+		if res.status != http.StatusOK {
+			t.Fatalf("got status %d; want %d (%s)", res.status, http.StatusOK, res.body)
+		}
+
+		ts.do(t, http.MethodPost, "/v1/movies", editor, map[string]interface{}{"title": "Coco", "year": 2017, "runtime": "105 mins", "genres": []string{"animation"}})
+
+		if claimed, _ := app.deliverWebhooks(context.Background()); claimed != 0 {
+			t.Errorf("got %d deliveries for a paused webhook; want 0", claimed)
+		}
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		if res := ts.do(t, http.MethodDelete, "/v1/webhooks/1", admin, nil); res.status != http.StatusOK {
+			t.Fatalf("got status %d; want %d", res.status, http.StatusOK)
+		}
+
+		if res := ts.do(t, http.MethodGet, "/v1/webhooks/1/deliveries/1", admin, nil); res.status != http.StatusNotFound {
+			t.Errorf("got status %d for a delivery of a deleted webhook; want %d", res.status, http.StatusNotFound)
+		}
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{12, webhookMaxBackoff},
+		{100, webhookMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(webhookBaseBackoff, webhookMaxBackoff, tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
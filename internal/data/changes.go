@@ -0,0 +1,134 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"time"
+)
+
+// MovieChangesChannel is the channel the movie_changes trigger notifies with the id of each change
+const MovieChangesChannel = "movie_changes"
+
+// MovieChange is an entry of the change log a trigger on the movies table keeps. Action is
+// one of the revision actions and Movie the state of the movie right after the change
+type MovieChange struct {
+	ID        int64     `json:"id"`
+	MovieID   int64     `json:"movie_id"`
+	Action    string    `json:"action"`
+	Movie     Movie     `json:"movie"`
+	CreatedAt time.Time `json:"created_at"`
+	TxID      uint64    `json:"-"` // the transaction which made the change
+}
+
+// Before reports whether the change comes before other in the log, which is ordered by
+// transaction and then by id
+func (c *MovieChange) Before(other *MovieChange) bool {
+	if c.TxID != other.TxID {
+		return c.TxID < other.TxID
+	}
+
+	return c.ID < other.ID
+}
+
+type MovieChangeModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// GetAfter returns up to limit changes following the one with the given id, oldest first.
+//
+// Ids are handed out as changes are made but become visible as their transactions commit,
+// which isn't necessarily in the same order, so the log is read in the order of transactions
+// instead. Only the changes of transactions older than any still running are returned: no
+// change can turn up before them later on, so a reader never skips one. A change whose id is
+// gone from the log, trimmed by DeleteBefore, is followed by the ids above it
+func (m MovieChangeModel) GetAfter(ctx context.Context, afterID int64, limit int) ([]*MovieChange, error) {
+	query := `WITH after AS (
+					SELECT txid, id FROM movie_changes WHERE id = $1
+				)
+				SELECT id, movie_id, action, version, title, year, runtime, genres, created_at, txid::text
+				FROM movie_changes
+				WHERE txid < pg_snapshot_xmin(pg_current_snapshot())
+				AND CASE
+					WHEN EXISTS (SELECT 1 FROM after) THEN (txid, id) > (SELECT txid, id FROM after)
+					ELSE id > $1
+				END
+				ORDER BY txid, id
+				LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*MovieChange{}
+
+	for rows.Next() {
+		var change MovieChange
+
+		err := rows.Scan(
+			&change.ID,
+			&change.MovieID,
+			&change.Action,
+			&change.Movie.Version,
+			&change.Movie.Title,
+			&change.Movie.Year,
+			&change.Movie.Runtime,
+			pq.Array(&change.Movie.Genres),
+			&change.CreatedAt,
+			&change.TxID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		change.Movie.ID = change.MovieID
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// LatestID returns the id of the last change GetAfter would return, zero when there is none
+func (m MovieChangeModel) LatestID(ctx context.Context) (int64, error) {
+	query := `SELECT COALESCE((
+					SELECT id
+					FROM movie_changes
+					WHERE txid < pg_snapshot_xmin(pg_current_snapshot())
+					ORDER BY txid DESC, id DESC
+					LIMIT 1
+				), 0)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&id)
+	return id, err
+}
+
+// DeleteBefore trims the changes recorded before the given time, after which clients can no
+// longer resume from them
+func (m MovieChangeModel) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM movie_changes WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
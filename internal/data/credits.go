@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/4925k/greenlight/internal/validator"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+const (
+	CreditDirector = "director"
+	CreditActor    = "actor"
+	CreditWriter   = "writer"
+	CreditProducer = "producer"
+)
+
+var (
+	ErrDuplicateCredit = errors.New("duplicate credit")
+
+	CreditRoles = []string{CreditDirector, CreditActor, CreditWriter, CreditProducer}
+)
+
+// Credit links a person to a movie in a given role. Character is only set for actors
+type Credit struct {
+	ID         int64  `json:"id"`
+	MovieID    int64  `json:"movie_id"`
+	PersonID   int64  `json:"person_id"`
+	PersonName string `json:"person_name,omitempty"`
+	Role       string `json:"role"`
+	Character  string `json:"character,omitempty"`
+}
+
+type CreditModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "must be provided")
+
+	v.Check(credit.Role != "", "role", "must be provided")
+	v.Check(validator.In(credit.Role, CreditRoles...), "role", "must be one of "+strings.Join(CreditRoles, ", "))
+
+	v.Check(len(credit.Character) <= 500, "character", "must be less than 500 bytes")
+	v.Check(credit.Character == "" || credit.Role == CreditActor, "character", "must only be set for actors")
+}
+
+// Insert stores the credit. It returns ErrNoRecordFound if the person doesn't exist and
+// ErrDuplicateCredit if the same credit was already recorded
+func (m CreditModel) Insert(ctx context.Context, credit *Credit) error {
+	query := `INSERT INTO credits (movie_id, person_id, role, character)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, (SELECT name FROM people WHERE id = $2)`
+
+	args := []interface{}{credit.MovieID, credit.PersonID, credit.Role, credit.Character}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.ID, &credit.PersonName)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "credits_movie_id_person_id_role_character_key"`:
+			return ErrDuplicateCredit
+		case strings.Contains(err.Error(), `violates foreign key constraint`):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForMovies returns the credits of each of the given movies keyed by movie id, so a
+// whole page of movies can be filled in with a single query
+func (m CreditModel) GetAllForMovies(ctx context.Context, movieIDs []int64) (map[int64][]*Credit, error) {
+	query := `SELECT credits.id, credits.movie_id, credits.person_id, people.name, credits.role, credits.character
+				FROM credits
+				INNER JOIN people ON people.id = credits.person_id
+				WHERE credits.movie_id = ANY($1)
+				ORDER BY credits.movie_id, credits.id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := make(map[int64][]*Credit)
+
+	for rows.Next() {
+		var credit Credit
+
+		err := rows.Scan(
+			&credit.ID,
+			&credit.MovieID,
+			&credit.PersonID,
+			&credit.PersonName,
+			&credit.Role,
+			&credit.Character,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		credits[credit.MovieID] = append(credits[credit.MovieID], &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// Delete removes a single credit from the movie
+func (m CreditModel) Delete(ctx context.Context, movieID, id int64) error {
+	query := `DELETE FROM credits WHERE movie_id = $1 AND id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query, movieID, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNoRecordFound
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"github.com/4925k/greenlight/internal/validator"
+	"sort"
+	"strings"
+)
+
+const (
+	FacetGenres        = "genres"
+	FacetDecade        = "decade"
+	FacetRuntimeBucket = "runtime_bucket"
+)
+
+var MovieFacets = []string{FacetGenres, FacetDecade, FacetRuntimeBucket}
+
+func ValidateFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		v.Check(validator.In(facet, MovieFacets...), "facets", "must be one of "+strings.Join(MovieFacets, ", "))
+	}
+
+	v.Check(validator.Unique(facets), "facets", "must contain unique values")
+}
+
+// runtimeBuckets are the runtime_bucket facet values in display order. Each bucket holds the
+// runtimes below its limit that didn't fit the previous one, the last has no limit
+var runtimeBuckets = []struct {
+	label string
+	limit int32
+}{
+	{"<90", 90},
+	{"90-119", 120},
+	{"120-149", 150},
+	{"150+", 0},
+}
+
+func runtimeBucket(runtime Runtime) string {
+	for _, bucket := range runtimeBuckets {
+		if bucket.limit == 0 || int32(runtime) < bucket.limit {
+			return bucket.label
+		}
+	}
+
+	return ""
+}
+
+func decade(year int32) string {
+	return fmt.Sprintf("%ds", year/10*10)
+}
+
+// facetExpression returns the SQL equivalent of runtimeBucket and decade, or the genres
+// array unnested into one row per genre
+func facetExpression(facet string) string {
+	switch facet {
+	case FacetGenres:
+		return "unnest(genres)"
+	case FacetDecade:
+		return "(year / 10 * 10)::text || 's'"
+	default:
+		var b strings.Builder
+
+		b.WriteString("CASE")
+		for _, bucket := range runtimeBuckets {
+			if bucket.limit == 0 {
+				fmt.Fprintf(&b, " ELSE '%s'", bucket.label)
+				continue
+			}
+
+			fmt.Fprintf(&b, " WHEN runtime < %d THEN '%s'", bucket.limit, bucket.label)
+		}
+		b.WriteString(" END")
+
+		return b.String()
+	}
+}
+
+// sortFacets orders genres from the most to the least common, and decades and runtime
+// buckets chronologically and from short to long so a sidebar can show them as they are
+func sortFacets(facets map[string][]FacetCount) {
+	for facet, counts := range facets {
+		var less func(a, b FacetCount) bool
+
+		switch facet {
+		case FacetGenres:
+			less = func(a, b FacetCount) bool {
+				if a.Count != b.Count {
+					return a.Count > b.Count
+				}
+				return a.Value < b.Value
+			}
+		case FacetDecade:
+			less = func(a, b FacetCount) bool {
+				return len(a.Value) < len(b.Value) || (len(a.Value) == len(b.Value) && a.Value < b.Value)
+			}
+		default:
+			order := make(map[string]int)
+			for i, bucket := range runtimeBuckets {
+				order[bucket.label] = i
+			}
+
+			less = func(a, b FacetCount) bool {
+				return order[a.Value] < order[b.Value]
+			}
+		}
+
+		sort.Slice(counts, func(i, j int) bool {
+			return less(counts[i], counts[j])
+		})
+	}
+}
+
+// Facets counts the movies matching the query by each value of the requested facets, using
+// the same conditions as GetAll so the counts agree with the listing
+func (m MovieModel) Facets(ctx context.Context, q MovieQuery, facets []string) (map[string][]FacetCount, error) {
+	result := make(map[string][]FacetCount)
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	f := q.filter()
+
+	// one round trip for every facet. The facet names are checked against MovieFacets before
+	// they are interpolated
+	var selects []string
+	for _, facet := range facets {
+		if !validator.In(facet, MovieFacets...) {
+			return nil, fmt.Errorf("unknown facet %q", facet)
+		}
+
+		selects = append(selects, fmt.Sprintf(`SELECT '%s', value, COUNT(*)
+				FROM (SELECT %s AS value FROM movies WHERE %s) AS facet
+				GROUP BY value`, facet, facetExpression(facet), f.where))
+
+		result[facet] = []FacetCount{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, strings.Join(selects, "\nUNION ALL\n"), f.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var facet string
+		var count FacetCount
+
+		err := rows.Scan(&facet, &count.Value, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		result[facet] = append(result[facet], count)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortFacets(result)
+
+	return result, nil
+}
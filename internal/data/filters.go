@@ -1,6 +1,9 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"github.com/4925k/greenlight/internal/validator"
 	"math"
 	"strings"
@@ -11,14 +14,75 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+
+	// Cursor is the opaque next_cursor of a previous page. When set, rows are picked
+	// after the cursor's position instead of by page number
+	Cursor string
+	// SkipCount saves counting every matching row when the client has no use for the total
+	SkipCount bool
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+
+	Facets map[string][]FacetCount `json:"facets,omitempty"`
+}
+
+// FacetCount is the number of records sharing a value, e.g. how many movies are dramas
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// cursor marks the last row of a page by its sort value and id, which together are unique
+// since id is the tiebreaker of every listing's ORDER BY
+type cursor struct {
+	Sort  string          `json:"sort"`
+	Value json.RawMessage `json:"value"`
+	ID    int64           `json:"id"`
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(sort string, value interface{}, id int64) (string, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	js, err := json.Marshal(cursor{Sort: sort, Value: raw, ID: id})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+// decodeCursor returns nil when no cursor was given. A cursor issued for another sort is
+// rejected as its value would be compared against the wrong column
+func (f Filters) decodeCursor() (*cursor, error) {
+	if f.Cursor == "" {
+		return nil, nil
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+
+	err = json.Unmarshal(js, &c)
+	if err != nil || c.Sort != f.Sort || len(c.Value) == 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -29,6 +93,12 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be less than 100")
 
 	v.Check(validator.In(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	if f.Cursor != "" {
+		_, err := f.decodeCursor()
+		v.Check(err == nil, "cursor", "invalid cursor")
+		v.Check(f.Page == 1, "page", "must not be combined with a cursor")
+	}
 }
 
 func (f Filters) sortColumn() string {
@@ -72,3 +142,22 @@ func (f Filters) CalculateMetadata(totalRecords, page, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// keysetMetadata builds the metadata of a listing that may be paged by cursor or have skipped
+// the count. Page numbers mean nothing past a cursor, so only the page size is reported
+func (f Filters) keysetMetadata(totalRecords int, nextCursor string) Metadata {
+	var metadata Metadata
+
+	switch {
+	case f.Cursor != "":
+		metadata = Metadata{PageSize: f.PageSize, TotalRecords: totalRecords}
+	case f.SkipCount:
+		metadata = Metadata{CurrentPage: f.Page, PageSize: f.PageSize, FirstPage: 1}
+	default:
+		metadata = f.CalculateMetadata(totalRecords, f.Page, f.PageSize)
+	}
+
+	metadata.NextCursor = nextCursor
+
+	return metadata
+}
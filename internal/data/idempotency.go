@@ -0,0 +1,128 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyRecord is the first response to a request carrying an Idempotency-Key, replayed
+// to any retry of the request until it expires. Status is zero while the request is in flight
+type IdempotencyRecord struct {
+	Key         string
+	UserID      int64
+	RequestHash []byte
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+type IdempotencyModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Reserve claims the record's key for its user. It returns nil once the key is claimed, taking
+// over an expired record if there is one, and the record holding the key otherwise
+func (m IdempotencyModel) Reserve(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	query := `INSERT INTO idempotency_keys (key, user_id, request_hash, expires_at)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (key, user_id) DO UPDATE
+				SET request_hash = EXCLUDED.request_hash, status = 0, header = '{}', body = '',
+				created_at = NOW(), expires_at = EXCLUDED.expires_at
+				WHERE idempotency_keys.expires_at < NOW()
+				RETURNING status`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var status int
+
+	err := m.DB.QueryRowContext(ctx, query, rec.Key, rec.UserID, rec.RequestHash, rec.ExpiresAt).Scan(&status)
+	if err == nil {
+		return nil, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// the key is held by a live record
+	query = `SELECT request_hash, status, header, body, expires_at
+				FROM idempotency_keys
+				WHERE key = $1 AND user_id = $2`
+
+	existing := &IdempotencyRecord{Key: rec.Key, UserID: rec.UserID}
+	var header []byte
+
+	err = m.DB.QueryRowContext(ctx, query, rec.Key, rec.UserID).Scan(
+		&existing.RequestHash,
+		&existing.Status,
+		&header,
+		&existing.Body,
+		&existing.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// released in the meantime, report it as in flight so the client tries again
+			existing.RequestHash = rec.RequestHash
+			return existing, nil
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(header, &existing.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// Complete stores the response of the request which reserved the key
+func (m IdempotencyModel) Complete(ctx context.Context, rec *IdempotencyRecord) error {
+	query := `UPDATE idempotency_keys SET status = $1, header = $2, body = $3
+				WHERE key = $4 AND user_id = $5`
+
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, rec.Status, header, rec.Body, rec.Key, rec.UserID)
+	return err
+}
+
+// Release gives up a reserved key, letting the next request carrying it through
+func (m IdempotencyModel) Release(ctx context.Context, key string, userID int64) error {
+	query := `DELETE FROM idempotency_keys WHERE key = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, userID)
+	return err
+}
+
+// DeleteExpired removes the records which can no longer be replayed
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE expires_at < NOW()`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
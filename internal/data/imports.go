@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed" // the import stopped early, see Import.Error
+)
+
+// MaxImportErrors caps the row errors kept on an import. Rows failing past it are still counted
+const MaxImportErrors = 1000
+
+// ImportRowError explains why a row of an upload was skipped. Line is where the row starts in the upload
+type ImportRowError struct {
+	Line   int               `json:"line"`
+	Errors map[string]string `json:"errors"`
+}
+
+// Import tracks the progress of a bulk movie upload, which is inserted in the background
+type Import struct {
+	ID            int64            `json:"id"`
+	Status        string           `json:"status"`
+	Format        string           `json:"format"`
+	TotalRows     int              `json:"total_rows"`
+	ProcessedRows int              `json:"processed_rows"`
+	ImportedRows  int              `json:"imported_rows"`
+	FailedRows    int              `json:"failed_rows"`
+	Errors        []ImportRowError `json:"errors"`
+	Error         string           `json:"error,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	FinishedAt    *time.Time       `json:"finished_at,omitempty"`
+	UserID        int64            `json:"-"`
+}
+
+// AddRowError counts a failed row, keeping its errors unless MaxImportErrors are already kept
+func (imp *Import) AddRowError(line int, errors map[string]string) {
+	imp.FailedRows++
+
+	if len(imp.Errors) < MaxImportErrors {
+		imp.Errors = append(imp.Errors, ImportRowError{Line: line, Errors: errors})
+	}
+}
+
+type ImportModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m ImportModel) Insert(ctx context.Context, imp *Import) error {
+	query := `INSERT INTO imports (user_id, status, format, total_rows, failed_rows, errors)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, created_at, updated_at`
+
+	errs, err := json.Marshal(imp.Errors)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{imp.UserID, imp.Status, imp.Format, imp.TotalRows, imp.FailedRows, errs}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&imp.ID, &imp.CreatedAt, &imp.UpdatedAt)
+}
+
+func (m ImportModel) Get(ctx context.Context, id int64) (*Import, error) {
+	query := `SELECT id, user_id, status, format, total_rows, processed_rows, imported_rows, failed_rows,
+				errors, error, created_at, updated_at, finished_at
+				FROM imports
+				WHERE id = $1`
+
+	var imp Import
+	var errs []byte
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&imp.ID,
+		&imp.UserID,
+		&imp.Status,
+		&imp.Format,
+		&imp.TotalRows,
+		&imp.ProcessedRows,
+		&imp.ImportedRows,
+		&imp.FailedRows,
+		&errs,
+		&imp.Error,
+		&imp.CreatedAt,
+		&imp.UpdatedAt,
+		&imp.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(errs, &imp.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imp, nil
+}
+
+// Update records the progress of the import. Finished imports are never changed again, so
+// ErrNoRecordFound is returned for them too, which tells the runner to stop
+func (m ImportModel) Update(ctx context.Context, imp *Import) error {
+	query := `UPDATE imports
+				SET status = $1, processed_rows = $2, imported_rows = $3, failed_rows = $4, errors = $5,
+				error = $6, finished_at = $7, updated_at = NOW()
+				WHERE id = $8 AND status IN ('pending', 'running')
+				RETURNING updated_at`
+
+	errs, err := json.Marshal(imp.Errors)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{
+		imp.Status,
+		imp.ProcessedRows,
+		imp.ImportedRows,
+		imp.FailedRows,
+		errs,
+		imp.Error,
+		imp.FinishedAt,
+		imp.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&imp.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FailAbandoned marks imports which are still pending or running but haven't made progress
+// since before as failed with the given error. Their runner is gone, a crash or a restart
+// having taken the uploaded rows with it, so they would otherwise never finish
+func (m ImportModel) FailAbandoned(ctx context.Context, before time.Time, reason string) (int64, error) {
+	query := `UPDATE imports
+				SET status = 'failed', error = $1, finished_at = NOW(), updated_at = NOW()
+				WHERE status IN ('pending', 'running') AND updated_at < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, reason, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
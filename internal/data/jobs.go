@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDead    = "dead" // every attempt failed, the job waits for someone to look into it
+)
+
+// Job is a unit of background work. Jobs are kept in the database until they succeed, so
+// none is lost when the server stops or crashes, and are deleted as soon as they do
+type Job struct {
+	ID          int64     `json:"id"`
+	Type        string    `json:"type"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	RunAt       time.Time `json:"run_at"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	// the payload is for the job's handler alone and is never shown to clients
+	Payload json.RawMessage `json:"-"`
+}
+
+// UserJob is the payload of jobs about a single user, such as sending them an email. Only
+// the user is named: anything secret the job needs, a token say, is made when it runs so
+// that it is never stored in the queue
+type UserJob struct {
+	UserID int64 `json:"user_id"`
+}
+
+type JobModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// enqueueJob adds the job to the queue as part of tx, so that it is only queued if the change
+// it follows from is committed
+func enqueueJob(ctx context.Context, tx *sql.Tx, job *Job) error {
+	query := `INSERT INTO jobs (type, payload, max_attempts, run_at)
+				VALUES ($1, $2, $3, COALESCE($4, NOW()))
+				RETURNING id, status, run_at, created_at, updated_at`
+
+	var runAt *time.Time
+	if !job.RunAt.IsZero() {
+		runAt = &job.RunAt
+	}
+
+	args := []interface{}{job.Type, job.Payload, job.MaxAttempts, runAt}
+
+	return tx.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.Status, &job.RunAt, &job.CreatedAt, &job.UpdatedAt)
+}
+
+// Enqueue adds the job to the queue, to be run straight away unless RunAt says otherwise
+func (m JobModel) Enqueue(ctx context.Context, job *Job) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		return enqueueJob(ctx, tx, job)
+	})
+}
+
+const jobColumns = `id, type, payload, status, attempts, max_attempts, run_at, last_error, created_at, updated_at`
+
+func jobDest(job *Job) []interface{} {
+	return []interface{}{
+		&job.ID,
+		&job.Type,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	}
+}
+
+// Claim locks the next job which is due for lease and counts the attempt. A job whose lease
+// ran out while running was left behind by a worker which died, and is claimed again. It
+// returns ErrNoRecordFound when no job is due
+func (m JobModel) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	query := fmt.Sprintf(`UPDATE jobs
+				SET status = 'running', attempts = attempts + 1,
+				locked_until = NOW() + make_interval(secs => $1), updated_at = NOW()
+				WHERE id = (
+					SELECT id FROM jobs
+					WHERE (status = 'pending' AND run_at <= NOW()) OR (status = 'running' AND locked_until < NOW())
+					ORDER BY run_at, id
+					LIMIT 1
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING %s`, jobColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var job Job
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Seconds()).Scan(jobDest(&job)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
+
+// Complete removes a job which succeeded
+func (m JobModel) Complete(ctx context.Context, id int64) error {
+	query := `DELETE FROM jobs WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Fail releases a job which failed, saving the status, run time and error the caller set:
+// pending to be tried again at RunAt, or dead
+func (m JobModel) Fail(ctx context.Context, job *Job) error {
+	query := `UPDATE jobs
+				SET status = $1, run_at = $2, last_error = $3, locked_until = NULL, updated_at = NOW()
+				WHERE id = $4
+				RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, job.Status, job.RunAt, job.LastError, job.ID).Scan(&job.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAll pages through the jobs, only those with the given status unless it's empty
+func (m JobModel) GetAll(ctx context.Context, status string, filters Filters) ([]*Job, Metadata, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), %s
+				FROM jobs
+				WHERE status = $1 OR $1 = ''
+				ORDER BY %s %s, id ASC
+				LIMIT $2 OFFSET $3`, jobColumns, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	var totalRecords int
+
+	for rows.Next() {
+		var job Job
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, jobDest(&job)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return jobs, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Requeue gives a dead job a fresh set of attempts, starting straight away
+func (m JobModel) Requeue(ctx context.Context, id int64) (*Job, error) {
+	query := fmt.Sprintf(`UPDATE jobs
+				SET status = 'pending', attempts = 0, run_at = NOW(), updated_at = NOW()
+				WHERE id = $1 AND status = 'dead'
+				RETURNING %s`, jobColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var job Job
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(jobDest(&job)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &job, nil
+}
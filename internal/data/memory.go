@@ -0,0 +1,2281 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/4925k/greenlight/internal/validator"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDB holds the state shared by the in-memory stores. It mirrors the tables
+// created by the migrations closely enough for the handlers not to notice the difference
+type memoryDB struct {
+	mu sync.RWMutex
+
+	movies      map[int64]*Movie
+	nextMovieID int64
+
+	revisions    []*Revision
+	changes      []*MovieChange
+	nextChangeID int64
+
+	people       map[int64]*Person
+	nextPersonID int64
+
+	credits      map[int64]*Credit
+	nextCreditID int64
+
+	imports      map[int64]*Import
+	nextImportID int64
+
+	idempotencyKeys map[idempotencyKey]*IdempotencyRecord
+
+	jobs      map[int64]*memoryJob
+	nextJobID int64
+
+	webhooks         map[int64]*Webhook
+	nextWebhookID    int64
+	deliveries       map[int64]*WebhookDelivery
+	nextDeliveryID   int64
+	deliveryAttempts []*WebhookAttempt
+	nextAttemptID    int64
+	deliveryLeases   map[int64]time.Time // keyed by delivery id, until when a dispatcher holds it
+
+	reviews      map[int64]*Review
+	nextReviewID int64
+
+	users      map[int64]*User
+	nextUserID int64
+
+	tokens map[string]*Token // keyed by token hash
+
+	watchlists map[int64][]*WatchlistItem // keyed by user id, kept in position order
+
+	permissionCodes []string
+	userPermissions map[int64]map[string]bool
+}
+
+// NewMemoryModels returns Models backed by thread-safe in-memory stores. Nothing is
+// persisted, which makes them suitable for tests and local demos only
+func NewMemoryModels() Models {
+	db := &memoryDB{
+		movies:          make(map[int64]*Movie),
+		people:          make(map[int64]*Person),
+		credits:         make(map[int64]*Credit),
+		imports:         make(map[int64]*Import),
+		idempotencyKeys: make(map[idempotencyKey]*IdempotencyRecord),
+		jobs:            make(map[int64]*memoryJob),
+		webhooks:        make(map[int64]*Webhook),
+		deliveries:      make(map[int64]*WebhookDelivery),
+		deliveryLeases:  make(map[int64]time.Time),
+		reviews:         make(map[int64]*Review),
+		users:           make(map[int64]*User),
+		tokens:          make(map[string]*Token),
+		watchlists:      make(map[int64][]*WatchlistItem),
+		permissionCodes: []string{"movies:read", "movies:write", "people:read", "people:write", "admin"},
+		userPermissions: make(map[int64]map[string]bool),
+	}
+
+	return Models{
+		Credits:      memoryCreditModel{db: db},
+		Idempotency:  memoryIdempotencyModel{db: db},
+		Imports:      memoryImportModel{db: db},
+		Jobs:         memoryJobModel{db: db},
+		MovieChanges: memoryMovieChangeModel{db: db},
+		Movies:       memoryMovieModel{db: db},
+		People:       memoryPersonModel{db: db},
+		Permissions:  memoryPermissionModel{db: db},
+		Reviews:      memoryReviewModel{db: db},
+		Revisions:    memoryRevisionModel{db: db},
+		Tokens:       memoryTokenModel{db: db},
+		Users:        memoryUserModel{db: db},
+		Watchlists:   memoryWatchlistModel{db: db},
+		Webhooks:     memoryWebhookModel{db: db},
+	}
+}
+
+// copyMovie returns a deep copy so callers never share state with the store
+func copyMovie(movie *Movie) *Movie {
+	cp := *movie
+	cp.Genres = append([]string(nil), movie.Genres...)
+
+	if movie.DeletedAt != nil {
+		deletedAt := *movie.DeletedAt
+		cp.DeletedAt = &deletedAt
+	}
+
+	return &cp
+}
+
+// matchTitle mimics to_tsvector('simple', title) @@ plainto_tsquery('simple', query)
+func matchTitle(title, query string) bool {
+	words := make(map[string]bool)
+	for _, word := range lexemes(title) {
+		words[word] = true
+	}
+
+	for _, word := range lexemes(query) {
+		if !words[word] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// containsAll mimics the array containment operator @>
+func containsAll(values, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, v := range values {
+			if v == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// trigrams returns the set of trigrams pg_trgm extracts from s: every word is padded with
+// two spaces in front and one behind before being cut into overlapping three rune pieces
+func trigrams(s string) map[string]bool {
+	set := make(map[string]bool)
+
+	for _, word := range lexemes(s) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
+
+// wordSimilarity approximates pg_trgm's word_similarity as the share of the search's
+// trigrams found anywhere in the title
+func wordSimilarity(search, title string) float64 {
+	want := trigrams(search)
+	if len(want) == 0 {
+		return 0
+	}
+
+	have := trigrams(title)
+
+	var shared int
+	for trigram := range want {
+		if have[trigram] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(want))
+}
+
+// matchTerm reports whether the lowercase word matches one of the search terms. With prefix
+// set, the last term only needs to start the word, as in a to_tsquery 'term:*'
+func matchTerm(word string, terms []string, prefix bool) bool {
+	for i, term := range terms {
+		if word == term || (prefix && i == len(terms)-1 && strings.HasPrefix(word, term)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type titleSearch struct {
+	matched   bool
+	rank      float64
+	highlight string
+}
+
+// searchTitle mirrors the title search of MovieQuery.filter. Every language is treated as
+// simple, so words aren't stemmed, and ts_rank is approximated by the share of the title's
+// words that the search matched
+func searchTitle(title string, q MovieQuery) titleSearch {
+	var result titleSearch
+
+	terms, words := lexemes(q.Title), lexemes(title)
+	prefix := q.match() != MatchExact
+
+	found := 0
+	for i, term := range terms {
+		for _, word := range words {
+			if word == term || (prefix && i == len(terms)-1 && strings.HasPrefix(word, term)) {
+				found++
+				break
+			}
+		}
+	}
+
+	if len(terms) > 0 && found == len(terms) {
+		result.matched = true
+		result.rank = float64(found) / float64(len(words))
+	}
+
+	if q.match() == MatchFuzzy {
+		similarity := wordSimilarity(q.Title, title)
+
+		result.matched = result.matched || similarity >= 0.6
+		result.rank += similarity
+	}
+
+	// wrap the matching words like ts_headline does, keeping the title's own case and punctuation
+	var b strings.Builder
+
+	runes := []rune(strings.NewReplacer(highlightStart, "", highlightStop, "").Replace(title))
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			b.WriteRune(runes[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+
+		word := string(runes[i:j])
+		if matchTerm(strings.ToLower(word), terms, prefix) {
+			word = highlightStart + word + highlightStop
+		}
+
+		b.WriteString(word)
+		i = j
+	}
+
+	result.highlight = markHighlight(b.String())
+
+	return result
+}
+
+// containsAny reports whether values shares at least one element with wanted
+func containsAny(values, wanted []string) bool {
+	for _, w := range wanted {
+		for _, v := range values {
+			if v == w {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchMovie mirrors the conditions built by MovieQuery.where. The caller must hold at
+// least the read lock
+func (db *memoryDB) matchMovie(movie *Movie, q MovieQuery) bool {
+	switch {
+	case q.Title != "" && !searchTitle(movie.Title, q).matched:
+		return false
+	case !containsAll(movie.Genres, q.Genres):
+		return false
+	case len(q.GenresAny) > 0 && !containsAny(movie.Genres, q.GenresAny):
+		return false
+	case containsAny(movie.Genres, q.ExcludeGenres):
+		return false
+	case q.PersonID != 0 && !db.credited(movie.ID, q.PersonID):
+		return false
+	case q.YearMin != 0 && movie.Year < q.YearMin:
+		return false
+	case q.YearMax != 0 && movie.Year > q.YearMax:
+		return false
+	case q.RuntimeMin != 0 && int32(movie.Runtime) < q.RuntimeMin:
+		return false
+	case q.RuntimeMax != 0 && int32(movie.Runtime) > q.RuntimeMax:
+		return false
+	case !q.CreatedAfter.IsZero() && movie.CreatedAt.Before(q.CreatedAfter):
+		return false
+	case !q.CreatedBefore.IsZero() && !movie.CreatedAt.Before(q.CreatedBefore):
+		return false
+	}
+
+	return true
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloat64(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// unixOrZero treats a missing timestamp as the earliest possible one
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// compareMovies orders two movies by the given sort column
+func compareMovies(a, b *Movie, column string) int {
+	switch column {
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "year":
+		return compareInt64(int64(a.Year), int64(b.Year))
+	case "runtime":
+		return compareInt64(int64(a.Runtime), int64(b.Runtime))
+	case "average_rating":
+		return compareFloat64(a.AverageRating, b.AverageRating)
+	case "rating_count":
+		return compareInt64(int64(a.RatingCount), int64(b.RatingCount))
+	case "deleted_at":
+		return compareInt64(a.DeletedAt.Unix(), b.DeletedAt.Unix())
+	default:
+		return compareInt64(a.ID, b.ID)
+	}
+}
+
+// sortMovies orders movies the same way the ORDER BY clause in MovieModel.GetAll does,
+// using the id as a tiebreaker
+func sortMovies(movies []*Movie, filters Filters) {
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.SliceStable(movies, func(i, j int) bool {
+		c := compareMovies(movies[i], movies[j], column)
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return movies[i].ID < movies[j].ID
+	})
+}
+
+// paginate returns the page of records selected by the filters
+func paginate[T any](records []T, filters Filters) []T {
+	start := filters.offset()
+	if start > len(records) {
+		start = len(records)
+	}
+
+	end := start + filters.limit()
+	if end > len(records) {
+		end = len(records)
+	}
+
+	return records[start:end]
+}
+
+// addRevision mirrors insertRevision. The caller must hold the write lock
+func (db *memoryDB) addRevision(action string, movie *Movie, userID int64) {
+	db.revisions = append(db.revisions, &Revision{
+		ID:        int64(len(db.revisions) + 1),
+		MovieID:   movie.ID,
+		Version:   movie.Version,
+		Action:    action,
+		UserID:    userID,
+		CreatedAt: time.Now().Truncate(time.Second),
+		Movie:     *copyMovie(movie),
+	})
+}
+
+// recordMovieChange mirrors the function of the same name. The caller must hold the write lock
+func (db *memoryDB) recordMovieChange(action string, movie *Movie, userID int64) {
+	db.addRevision(action, movie, userID)
+
+	// mirror the trigger keeping the movie_changes log
+	db.nextChangeID++
+
+	change := &MovieChange{
+		ID:        db.nextChangeID,
+		MovieID:   movie.ID,
+		Action:    action,
+		Movie:     Movie{ID: movie.ID, Title: movie.Title, Year: movie.Year, Runtime: movie.Runtime, Version: movie.Version},
+		CreatedAt: time.Now().Truncate(time.Second),
+		TxID:      uint64(db.nextChangeID), // changes are made one at a time under the lock
+	}
+	change.Movie.Genres = append([]string(nil), movie.Genres...)
+
+	db.changes = append(db.changes, change)
+	db.enqueueWebhooks(movieEvents[action], map[string]interface{}{"movie": copyMovie(movie)})
+}
+
+type memoryMovieModel struct {
+	db *memoryDB
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	m.insert(movie, userID)
+
+	return nil
+}
+
+// insert mirrors MovieModel.insert. The caller must hold the write lock
+func (m memoryMovieModel) insert(movie *Movie, userID int64) {
+	m.db.nextMovieID++
+
+	movie.ID = m.db.nextMovieID
+	movie.CreatedAt = time.Now().Truncate(time.Second)
+	movie.Version = 1
+
+	m.db.movies[movie.ID] = copyMovie(movie)
+	m.db.recordMovieChange(RevisionCreate, movie, userID)
+}
+
+func (m memoryMovieModel) InsertMany(ctx context.Context, movies []*Movie, userID int64) error {
+	for _, movie := range movies {
+		// mirror MovieModel.InsertMany, which leaves the movies untouched
+		err := m.Insert(ctx, copyMovie(movie), userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	movie, ok := m.db.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return nil, ErrNoRecordFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+// sortedMatches returns copies of the movies matching the query in the order of the filters.
+// The caller must hold the read lock
+func (m memoryMovieModel) sortedMatches(q MovieQuery, filters Filters) []*Movie {
+	matched := []*Movie{}
+
+	relevance := make(map[int64]float64)
+
+	for _, movie := range m.db.movies {
+		if movie.DeletedAt == nil && m.db.matchMovie(movie, q) {
+			cp := copyMovie(movie)
+
+			if q.Title != "" {
+				search := searchTitle(movie.Title, q)
+				cp.Highlight = search.highlight
+				relevance[cp.ID] = search.rank
+			}
+
+			matched = append(matched, cp)
+		}
+	}
+
+	if filters.sortColumn() == "relevance" {
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := relevance[matched[i].ID], relevance[matched[j].ID]
+			if a != b {
+				return a > b
+			}
+
+			return matched[i].ID < matched[j].ID
+		})
+	} else {
+		sortMovies(matched, filters)
+	}
+
+	return matched
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, q MovieQuery, filters Filters) ([]*Movie, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	matched := m.sortedMatches(q, filters)
+
+	pivot, err := movieCursorPivot(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	totalRecords := len(matched)
+	if filters.SkipCount {
+		totalRecords = 0
+	}
+
+	page := matched
+	if pivot != nil {
+		page = afterPivot(matched, pivot, filters)
+	}
+
+	// mirror MovieModel.GetAll, which fetches one row past the page
+	start := filters.offset()
+	if start > len(page) {
+		start = len(page)
+	}
+
+	end := start + filters.limit() + 1
+	if end > len(page) {
+		end = len(page)
+	}
+
+	page = page[start:end]
+
+	return nextMoviePage(page, filters, totalRecords)
+}
+
+func (m memoryMovieModel) Export(ctx context.Context, q MovieQuery, filters Filters, fn func(*Movie) error) error {
+	m.db.mu.RLock()
+	matched := m.sortedMatches(q, filters)
+	m.db.mu.RUnlock()
+
+	for _, movie := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(movie); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// afterPivot returns the sorted movies that come after the cursor's position, the same way
+// the keyset condition of MovieModel.GetAll picks them
+func afterPivot(movies []*Movie, pivot *Movie, filters Filters) []*Movie {
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	for i, movie := range movies {
+		c := compareMovies(movie, pivot, column)
+		if desc {
+			c = -c
+		}
+
+		if c > 0 || (c == 0 && movie.ID > pivot.ID) {
+			return movies[i:]
+		}
+	}
+
+	return nil
+}
+
+func (m memoryMovieModel) Suggest(ctx context.Context, search string, limit int) ([]*Suggestion, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	type candidate struct {
+		movie      *Movie
+		startsWith bool
+		similarity float64
+	}
+
+	var candidates []candidate
+
+	for _, movie := range m.db.movies {
+		if movie.DeletedAt != nil {
+			continue
+		}
+
+		c := candidate{
+			movie:      movie,
+			startsWith: strings.HasPrefix(strings.ToLower(movie.Title), strings.ToLower(search)),
+			similarity: wordSimilarity(search, movie.Title),
+		}
+
+		if c.startsWith || searchTitle(movie.Title, MovieQuery{Title: search, Match: MatchFuzzy}).matched {
+			candidates = append(candidates, c)
+		}
+	}
+
+	// mirror the ORDER BY of MovieModel.Suggest
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		switch {
+		case a.startsWith != b.startsWith:
+			return a.startsWith
+		case a.similarity != b.similarity:
+			return a.similarity > b.similarity
+		case a.movie.Title != b.movie.Title:
+			return a.movie.Title < b.movie.Title
+		default:
+			return a.movie.ID < b.movie.ID
+		}
+	})
+
+	suggestions := []*Suggestion{}
+
+	for _, c := range candidates {
+		if len(suggestions) == limit {
+			break
+		}
+
+		suggestions = append(suggestions, &Suggestion{ID: c.movie.ID, Title: c.movie.Title, Year: c.movie.Year})
+	}
+
+	return suggestions, nil
+}
+
+func (m memoryMovieModel) Facets(ctx context.Context, q MovieQuery, facets []string) (map[string][]FacetCount, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	counts := make(map[string]map[string]int)
+	for _, facet := range facets {
+		counts[facet] = make(map[string]int)
+	}
+
+	for _, movie := range m.db.movies {
+		if movie.DeletedAt != nil || !m.db.matchMovie(movie, q) {
+			continue
+		}
+
+		for facet, values := range counts {
+			switch facet {
+			case FacetGenres:
+				for _, genre := range movie.Genres {
+					values[genre]++
+				}
+			case FacetDecade:
+				values[decade(movie.Year)]++
+			case FacetRuntimeBucket:
+				values[runtimeBucket(movie.Runtime)]++
+			}
+		}
+	}
+
+	result := make(map[string][]FacetCount)
+
+	for facet, values := range counts {
+		result[facet] = []FacetCount{}
+
+		for value, count := range values {
+			result[facet] = append(result[facet], FacetCount{Value: value, Count: count})
+		}
+	}
+
+	sortFacets(result)
+
+	return result, nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	return m.update(movie, userID)
+}
+
+// update mirrors MovieModel.update. The caller must hold the write lock
+func (m memoryMovieModel) update(movie *Movie, userID int64) error {
+	current, ok := m.db.movies[movie.ID]
+	if !ok || current.Version != movie.Version || current.DeletedAt != nil {
+		return ErrEditConflict
+	}
+
+	// the rating aggregates are owned by the reviews, not by the caller's copy
+	movie.AverageRating, movie.RatingCount = current.AverageRating, current.RatingCount
+
+	movie.Version++
+	m.db.movies[movie.ID] = copyMovie(movie)
+	m.db.recordMovieChange(RevisionUpdate, movie, userID)
+
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64, version int32, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	return m.delete(id, version, userID)
+}
+
+// delete mirrors MovieModel.delete. The caller must hold the write lock
+func (m memoryMovieModel) delete(id int64, version int32, userID int64) error {
+	movie, ok := m.db.movies[id]
+
+	switch {
+	case (!ok || movie.DeletedAt != nil || movie.Version != version) && version != 0:
+		return ErrEditConflict
+	case !ok || movie.DeletedAt != nil:
+		return ErrNoRecordFound
+	}
+
+	now := time.Now().Truncate(time.Second)
+	movie.DeletedAt = &now
+	m.db.recordMovieChange(RevisionDelete, movie, userID)
+
+	return nil
+}
+
+func (m memoryMovieModel) Batch(ctx context.Context, ops []*MovieOperation, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	// mirror the transaction of MovieModel.Batch by putting the movies back when an operation fails
+	movies := make(map[int64]*Movie, len(m.db.movies))
+	for id, movie := range m.db.movies {
+		movies[id] = copyMovie(movie)
+	}
+
+	revisions, nextMovieID, nextDeliveryID := len(m.db.revisions), m.db.nextMovieID, m.db.nextDeliveryID
+	changes, nextChangeID := len(m.db.changes), m.db.nextChangeID
+
+	for i, op := range ops {
+		var err error
+
+		switch op.Op {
+		case MovieOpCreate:
+			m.insert(op.Movie, userID)
+		case MovieOpPatch:
+			err = m.update(op.Movie, userID)
+		case MovieOpDelete:
+			err = m.delete(op.Movie.ID, op.Movie.Version, userID)
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+
+		if err != nil {
+			m.db.movies, m.db.revisions, m.db.nextMovieID = movies, m.db.revisions[:revisions], nextMovieID
+			m.db.changes, m.db.nextChangeID = m.db.changes[:changes], nextChangeID
+
+			for id := nextDeliveryID + 1; id <= m.db.nextDeliveryID; id++ {
+				delete(m.db.deliveries, id)
+			}
+			m.db.nextDeliveryID = nextDeliveryID
+
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (m memoryMovieModel) GetTrash(ctx context.Context, filters Filters) ([]*Movie, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	trashed := []*Movie{}
+
+	for _, movie := range m.db.movies {
+		if movie.DeletedAt != nil {
+			trashed = append(trashed, copyMovie(movie))
+		}
+	}
+
+	sortMovies(trashed, filters)
+
+	return paginate(trashed, filters), filters.CalculateMetadata(len(trashed), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryMovieModel) Undelete(ctx context.Context, id int64, userID int64) (*Movie, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	movie, ok := m.db.movies[id]
+	if !ok || movie.DeletedAt == nil {
+		return nil, ErrNoRecordFound
+	}
+
+	movie.DeletedAt = nil
+	m.db.recordMovieChange(RevisionUndelete, movie, userID)
+
+	return copyMovie(movie), nil
+}
+
+func (m memoryMovieModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var purged int64
+
+	for id, movie := range m.db.movies {
+		if movie.DeletedAt != nil && movie.DeletedAt.Before(before) {
+			delete(m.db.movies, id)
+			m.db.removeFromWatchlists(id)
+
+			for creditID, credit := range m.db.credits {
+				if credit.MovieID == id {
+					delete(m.db.credits, creditID)
+				}
+			}
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+type memoryPersonModel struct {
+	db *memoryDB
+}
+
+func (m memoryPersonModel) Insert(ctx context.Context, person *Person) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	m.db.nextPersonID++
+
+	person.ID = m.db.nextPersonID
+	person.CreatedAt = time.Now().Truncate(time.Second)
+	person.Version = 1
+
+	cp := *person
+	m.db.people[person.ID] = &cp
+
+	return nil
+}
+
+func (m memoryPersonModel) Get(ctx context.Context, id int64) (*Person, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	person, ok := m.db.people[id]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	cp := *person
+	return &cp, nil
+}
+
+func (m memoryPersonModel) GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	people := []*Person{}
+
+	for _, person := range m.db.people {
+		if name != "" && !matchTitle(person.Name, name) {
+			continue
+		}
+
+		cp := *person
+		people = append(people, &cp)
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.SliceStable(people, func(i, j int) bool {
+		var c int
+		switch column {
+		case "name":
+			c = strings.Compare(people[i].Name, people[j].Name)
+		case "birth_year":
+			c = compareInt64(int64(people[i].BirthYear), int64(people[j].BirthYear))
+		default:
+			c = compareInt64(people[i].ID, people[j].ID)
+		}
+
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return people[i].ID < people[j].ID
+	})
+
+	return paginate(people, filters), filters.CalculateMetadata(len(people), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryPersonModel) Update(ctx context.Context, person *Person) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.people[person.ID]
+	if !ok || current.Version != person.Version {
+		return ErrEditConflict
+	}
+
+	person.Version++
+
+	cp := *person
+	m.db.people[person.ID] = &cp
+
+	return nil
+}
+
+func (m memoryPersonModel) Delete(ctx context.Context, id int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if _, ok := m.db.people[id]; !ok {
+		return ErrNoRecordFound
+	}
+
+	delete(m.db.people, id)
+
+	for creditID, credit := range m.db.credits {
+		if credit.PersonID == id {
+			delete(m.db.credits, creditID)
+		}
+	}
+
+	return nil
+}
+
+type memoryCreditModel struct {
+	db *memoryDB
+}
+
+// credited reports whether the person has any credit on the movie. The caller must hold
+// at least the read lock
+func (db *memoryDB) credited(movieID, personID int64) bool {
+	for _, credit := range db.credits {
+		if credit.MovieID == movieID && credit.PersonID == personID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m memoryCreditModel) Insert(ctx context.Context, credit *Credit) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	person, ok := m.db.people[credit.PersonID]
+	if !ok {
+		return ErrNoRecordFound
+	}
+
+	if _, ok := m.db.movies[credit.MovieID]; !ok {
+		return ErrNoRecordFound
+	}
+
+	for _, existing := range m.db.credits {
+		if existing.MovieID == credit.MovieID && existing.PersonID == credit.PersonID &&
+			existing.Role == credit.Role && existing.Character == credit.Character {
+			return ErrDuplicateCredit
+		}
+	}
+
+	m.db.nextCreditID++
+
+	credit.ID = m.db.nextCreditID
+	credit.PersonName = person.Name
+
+	cp := *credit
+	m.db.credits[credit.ID] = &cp
+
+	return nil
+}
+
+func (m memoryCreditModel) GetAllForMovies(ctx context.Context, movieIDs []int64) (map[int64][]*Credit, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	wanted := make(map[int64]bool, len(movieIDs))
+	for _, id := range movieIDs {
+		wanted[id] = true
+	}
+
+	matched := []*Credit{}
+
+	for _, credit := range m.db.credits {
+		if wanted[credit.MovieID] {
+			cp := *credit
+			cp.PersonName = m.db.people[cp.PersonID].Name
+			matched = append(matched, &cp)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].ID < matched[j].ID
+	})
+
+	credits := make(map[int64][]*Credit)
+	for _, credit := range matched {
+		credits[credit.MovieID] = append(credits[credit.MovieID], credit)
+	}
+
+	return credits, nil
+}
+
+func (m memoryCreditModel) Delete(ctx context.Context, movieID, id int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	credit, ok := m.db.credits[id]
+	if !ok || credit.MovieID != movieID {
+		return ErrNoRecordFound
+	}
+
+	delete(m.db.credits, id)
+
+	return nil
+}
+
+type memoryRevisionModel struct {
+	db *memoryDB
+}
+
+// copyRevision returns a copy of the stored revision with the acting user's name filled in.
+// The caller must hold at least the read lock
+func (m memoryRevisionModel) copyRevision(revision *Revision) *Revision {
+	cp := *revision
+	cp.Movie = *copyMovie(&revision.Movie)
+
+	if user, ok := m.db.users[cp.UserID]; ok {
+		cp.UserName = user.Name
+	}
+
+	return &cp
+}
+
+func (m memoryRevisionModel) GetAllForMovie(ctx context.Context, movieID int64) ([]*Revision, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	revisions := []*Revision{}
+
+	for _, revision := range m.db.revisions {
+		if revision.MovieID == movieID {
+			revisions = append(revisions, m.copyRevision(revision))
+		}
+	}
+
+	return withChanges(revisions), nil
+}
+
+func (m memoryRevisionModel) Get(ctx context.Context, movieID int64, version int32) (*Revision, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	for i := len(m.db.revisions) - 1; i >= 0; i-- {
+		revision := m.db.revisions[i]
+
+		if revision.MovieID != movieID || revision.Version != version {
+			continue
+		}
+
+		if revision.Action != RevisionDelete && revision.Action != RevisionUndelete {
+			return m.copyRevision(revision), nil
+		}
+	}
+
+	return nil, ErrNoRecordFound
+}
+
+type memoryReviewModel struct {
+	db *memoryDB
+}
+
+// refreshRatings mirrors the function of the same name in reviews.go. The caller must
+// hold the write lock
+func (db *memoryDB) refreshRatings(movieID int64) {
+	movie, ok := db.movies[movieID]
+	if !ok {
+		return
+	}
+
+	var sum, count int32
+	for _, review := range db.reviews {
+		if review.MovieID == movieID {
+			sum += review.Rating
+			count++
+		}
+	}
+
+	movie.RatingCount = count
+	movie.AverageRating = 0
+
+	if count > 0 {
+		// numeric(3, 2) keeps two decimal places
+		movie.AverageRating = math.Round(float64(sum)/float64(count)*100) / 100
+	}
+}
+
+// copyReview returns a copy of the stored review with the author's name filled in.
+// The caller must hold at least the read lock
+func (m memoryReviewModel) copyReview(review *Review) *Review {
+	cp := *review
+
+	if user, ok := m.db.users[cp.UserID]; ok {
+		cp.UserName = user.Name
+	}
+
+	return &cp
+}
+
+func (m memoryReviewModel) Insert(ctx context.Context, review *Review) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if _, ok := m.db.movies[review.MovieID]; !ok {
+		return ErrNoRecordFound
+	}
+
+	for _, existing := range m.db.reviews {
+		if existing.MovieID == review.MovieID && existing.UserID == review.UserID {
+			return ErrDuplicateReview
+		}
+	}
+
+	m.db.nextReviewID++
+
+	review.ID = m.db.nextReviewID
+	review.CreatedAt = time.Now().Truncate(time.Second)
+	review.UpdatedAt = review.CreatedAt
+	review.Version = 1
+
+	cp := *review
+	m.db.reviews[review.ID] = &cp
+	m.db.refreshRatings(review.MovieID)
+
+	return nil
+}
+
+func (m memoryReviewModel) Get(ctx context.Context, movieID, userID int64) (*Review, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	for _, review := range m.db.reviews {
+		if review.MovieID == movieID && review.UserID == userID {
+			return m.copyReview(review), nil
+		}
+	}
+
+	return nil, ErrNoRecordFound
+}
+
+func (m memoryReviewModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	reviews := []*Review{}
+
+	for _, review := range m.db.reviews {
+		if review.MovieID == movieID {
+			reviews = append(reviews, m.copyReview(review))
+		}
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.SliceStable(reviews, func(i, j int) bool {
+		var c int
+		switch column {
+		case "rating":
+			c = compareInt64(int64(reviews[i].Rating), int64(reviews[j].Rating))
+		case "created_at":
+			c = compareInt64(reviews[i].CreatedAt.Unix(), reviews[j].CreatedAt.Unix())
+		case "updated_at":
+			c = compareInt64(reviews[i].UpdatedAt.Unix(), reviews[j].UpdatedAt.Unix())
+		}
+
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return reviews[i].ID < reviews[j].ID
+	})
+
+	return paginate(reviews, filters), filters.CalculateMetadata(len(reviews), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryReviewModel) Update(ctx context.Context, review *Review) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.reviews[review.ID]
+	if !ok || current.Version != review.Version {
+		return ErrEditConflict
+	}
+
+	review.UpdatedAt = time.Now().Truncate(time.Second)
+	review.Version++
+
+	cp := *review
+	m.db.reviews[review.ID] = &cp
+	m.db.refreshRatings(review.MovieID)
+
+	return nil
+}
+
+func (m memoryReviewModel) Delete(ctx context.Context, movieID, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	for id, review := range m.db.reviews {
+		if review.MovieID == movieID && review.UserID == userID {
+			delete(m.db.reviews, id)
+			m.db.refreshRatings(movieID)
+			return nil
+		}
+	}
+
+	return ErrNoRecordFound
+}
+
+type memoryWatchlistModel struct {
+	db *memoryDB
+}
+
+// removeFromWatchlists mirrors the ON DELETE CASCADE on watchlist_items.movie_id. The
+// caller must hold the write lock
+func (db *memoryDB) removeFromWatchlists(movieID int64) {
+	for userID, items := range db.watchlists {
+		kept := items[:0]
+		for _, item := range items {
+			if item.MovieID != movieID {
+				kept = append(kept, item)
+			}
+		}
+
+		db.watchlists[userID] = kept
+	}
+}
+
+// find returns the index of the movie in the user's watchlist, or -1. The caller must
+// hold at least the read lock
+func (m memoryWatchlistModel) find(userID, movieID int64) int {
+	for i, item := range m.db.watchlists[userID] {
+		if item.MovieID == movieID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// copyItem returns a copy of the entry at index i with its position filled in. The
+// caller must hold at least the read lock
+func (m memoryWatchlistModel) copyItem(userID int64, i int) *WatchlistItem {
+	cp := *m.db.watchlists[userID][i]
+	cp.Position = int32(i + 1)
+
+	return &cp
+}
+
+func (m memoryWatchlistModel) Add(ctx context.Context, userID, movieID int64) (*WatchlistItem, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if _, ok := m.db.movies[movieID]; !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	if m.find(userID, movieID) >= 0 {
+		return nil, ErrDuplicateWatchlistItem
+	}
+
+	m.db.watchlists[userID] = append(m.db.watchlists[userID], &WatchlistItem{
+		UserID:  userID,
+		MovieID: movieID,
+		AddedAt: time.Now().Truncate(time.Second),
+	})
+
+	return m.copyItem(userID, len(m.db.watchlists[userID])-1), nil
+}
+
+func (m memoryWatchlistModel) Get(ctx context.Context, userID, movieID int64) (*WatchlistItem, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	i := m.find(userID, movieID)
+	if i < 0 {
+		return nil, ErrNoRecordFound
+	}
+
+	return m.copyItem(userID, i), nil
+}
+
+func (m memoryWatchlistModel) GetAll(ctx context.Context, userID int64, watched *bool, filters Filters) ([]*WatchlistItem, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	items := []*WatchlistItem{}
+
+	for i, stored := range m.db.watchlists[userID] {
+		movie := m.db.movies[stored.MovieID]
+		if movie.DeletedAt != nil || (watched != nil && stored.Watched != *watched) {
+			continue
+		}
+
+		item := m.copyItem(userID, i)
+		item.Movie = copyMovie(movie)
+		items = append(items, item)
+	}
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	sort.SliceStable(items, func(i, j int) bool {
+		var c int
+		switch column {
+		case "position":
+			c = compareInt64(int64(items[i].Position), int64(items[j].Position))
+		case "added_at":
+			c = compareInt64(items[i].AddedAt.Unix(), items[j].AddedAt.Unix())
+		case "watched_at":
+			c = compareInt64(unixOrZero(items[i].WatchedAt), unixOrZero(items[j].WatchedAt))
+		default:
+			c = compareMovies(items[i].Movie, items[j].Movie, column)
+		}
+
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return items[i].MovieID < items[j].MovieID
+	})
+
+	return paginate(items, filters), filters.CalculateMetadata(len(items), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryWatchlistModel) Update(ctx context.Context, item *WatchlistItem) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current := m.find(item.UserID, item.MovieID)
+	if current < 0 {
+		return ErrNoRecordFound
+	}
+
+	items := m.db.watchlists[item.UserID]
+
+	target := int(item.Position) - 1
+	if target < 0 {
+		target = 0
+	}
+	if target > len(items)-1 {
+		target = len(items) - 1
+	}
+
+	stored := items[current]
+	stored.Watched = item.Watched
+	stored.WatchedAt = item.WatchedAt
+
+	// shift the entries in between by one and drop the item into its new slot
+	if target < current {
+		copy(items[target+1:current+1], items[target:current])
+	} else {
+		copy(items[current:target], items[current+1:target+1])
+	}
+	items[target] = stored
+
+	item.Position = int32(target + 1)
+
+	return nil
+}
+
+func (m memoryWatchlistModel) Remove(ctx context.Context, userID, movieID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	i := m.find(userID, movieID)
+	if i < 0 {
+		return ErrNoRecordFound
+	}
+
+	items := m.db.watchlists[userID]
+	m.db.watchlists[userID] = append(items[:i], items[i+1:]...)
+
+	return nil
+}
+
+type memoryPermissionModel struct {
+	db *memoryDB
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	var permissions Permissions
+
+	// walk the known codes rather than the map so the order is stable
+	for _, code := range m.db.permissionCodes {
+		if m.db.userPermissions[userID][code] {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if m.db.userPermissions[userID] == nil {
+		m.db.userPermissions[userID] = make(map[string]bool)
+	}
+
+	for _, code := range codes {
+		for _, known := range m.db.permissionCodes {
+			if code == known {
+				m.db.userPermissions[userID][code] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+type memoryTokenModel struct {
+	db *memoryDB
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	// the plaintext is never stored, just like in the tokens table
+	m.db.tokens[string(token.Hash)] = &Token{
+		Hash:   token.Hash,
+		UserID: token.UserID,
+		Expiry: token.Expiry,
+		Scope:  token.Scope,
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, tokenScope string, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	for hash, token := range m.db.tokens {
+		if token.Scope == tokenScope && token.UserID == userID {
+			delete(m.db.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+type memoryUserModel struct {
+	db *memoryDB
+}
+
+// emailTaken reports whether another user already owns the email. The users table
+// uses citext, so the comparison is case-insensitive
+func (m memoryUserModel) emailTaken(email string, exceptID int64) bool {
+	for _, user := range m.db.users {
+		if user.ID != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User, jobs ...*Job) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if m.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	payload, err := json.Marshal(UserJob{UserID: m.db.nextUserID + 1})
+	if err != nil {
+		return err
+	}
+
+	m.db.nextUserID++
+
+	user.ID = m.db.nextUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+
+	cp := *user
+	m.db.users[user.ID] = &cp
+
+	for _, job := range jobs {
+		job.Payload = payload
+		m.db.enqueueJob(job)
+	}
+
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	user, ok := m.db.users[id]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	cp := *user
+	return &cp, nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	for _, user := range m.db.users {
+		if strings.EqualFold(user.Email, email) {
+			cp := *user
+			return &cp, nil
+		}
+	}
+
+	return nil, ErrNoRecordFound
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if m.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	current, ok := m.db.users[user.ID]
+	if !ok || current.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	user.Version++
+
+	cp := *user
+	m.db.users[user.ID] = &cp
+
+	if user.Activated && !current.Activated {
+		m.db.enqueueWebhooks(EventUserActivated, map[string]interface{}{"user": &cp})
+	}
+
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintText string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintText))
+
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	token, ok := m.db.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrNoRecordFound
+	}
+
+	user, ok := m.db.users[token.UserID]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	cp := *user
+	return &cp, nil
+}
+
+type memoryImportModel struct {
+	db *memoryDB
+}
+
+// copyImport returns a copy of the import which shares nothing with the original
+func copyImport(imp *Import) *Import {
+	cp := *imp
+	cp.Errors = append([]ImportRowError{}, imp.Errors...)
+
+	if imp.FinishedAt != nil {
+		finishedAt := *imp.FinishedAt
+		cp.FinishedAt = &finishedAt
+	}
+
+	return &cp
+}
+
+func (m memoryImportModel) Insert(ctx context.Context, imp *Import) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	m.db.nextImportID++
+
+	imp.ID = m.db.nextImportID
+	imp.CreatedAt = time.Now().Truncate(time.Second)
+	imp.UpdatedAt = imp.CreatedAt
+
+	m.db.imports[imp.ID] = copyImport(imp)
+
+	return nil
+}
+
+func (m memoryImportModel) Get(ctx context.Context, id int64) (*Import, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	imp, ok := m.db.imports[id]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	return copyImport(imp), nil
+}
+
+func (m memoryImportModel) Update(ctx context.Context, imp *Import) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.imports[imp.ID]
+	if !ok || (current.Status != ImportPending && current.Status != ImportRunning) {
+		return ErrNoRecordFound
+	}
+
+	imp.UpdatedAt = time.Now()
+
+	updated := copyImport(imp)
+	updated.UserID, updated.CreatedAt = current.UserID, current.CreatedAt
+
+	m.db.imports[imp.ID] = updated
+
+	return nil
+}
+
+func (m memoryImportModel) FailAbandoned(ctx context.Context, before time.Time, reason string) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var failed int64
+
+	for _, imp := range m.db.imports {
+		if (imp.Status == ImportPending || imp.Status == ImportRunning) && imp.UpdatedAt.Before(before) {
+			now := time.Now()
+			imp.Status, imp.Error, imp.FinishedAt, imp.UpdatedAt = ImportFailed, reason, &now, now
+			failed++
+		}
+	}
+
+	return failed, nil
+}
+
+// idempotencyKey mirrors the primary key of the idempotency_keys table
+type idempotencyKey struct {
+	key    string
+	userID int64
+}
+
+type memoryIdempotencyModel struct {
+	db *memoryDB
+}
+
+func copyIdempotencyRecord(rec *IdempotencyRecord) *IdempotencyRecord {
+	cp := *rec
+	cp.RequestHash = append([]byte(nil), rec.RequestHash...)
+	cp.Body = append([]byte(nil), rec.Body...)
+
+	cp.Header = make(map[string][]string, len(rec.Header))
+	for key, values := range rec.Header {
+		cp.Header[key] = append([]string(nil), values...)
+	}
+
+	return &cp
+}
+
+func (m memoryIdempotencyModel) Reserve(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	k := idempotencyKey{rec.Key, rec.UserID}
+
+	if existing, ok := m.db.idempotencyKeys[k]; ok && !existing.ExpiresAt.Before(time.Now()) {
+		return copyIdempotencyRecord(existing), nil
+	}
+
+	reserved := copyIdempotencyRecord(rec)
+	reserved.Status, reserved.Header, reserved.Body = 0, map[string][]string{}, nil
+
+	m.db.idempotencyKeys[k] = reserved
+
+	return nil, nil
+}
+
+func (m memoryIdempotencyModel) Complete(ctx context.Context, rec *IdempotencyRecord) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	k := idempotencyKey{rec.Key, rec.UserID}
+
+	if existing, ok := m.db.idempotencyKeys[k]; ok {
+		completed := copyIdempotencyRecord(rec)
+		completed.RequestHash, completed.ExpiresAt = existing.RequestHash, existing.ExpiresAt
+
+		m.db.idempotencyKeys[k] = completed
+	}
+
+	return nil
+}
+
+func (m memoryIdempotencyModel) Release(ctx context.Context, key string, userID int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	delete(m.db.idempotencyKeys, idempotencyKey{key, userID})
+
+	return nil
+}
+
+func (m memoryIdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	var deleted int64
+
+	for k, rec := range m.db.idempotencyKeys {
+		if rec.ExpiresAt.Before(time.Now()) {
+			delete(m.db.idempotencyKeys, k)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// enqueueWebhooks mirrors the function of the same name. The caller must hold the write lock
+func (db *memoryDB) enqueueWebhooks(event string, payload interface{}) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+
+	ids := make([]int64, 0, len(db.webhooks))
+	for id, webhook := range db.webhooks {
+		if webhook.Active && validator.In(event, webhook.Events...) {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	now := time.Now().Truncate(time.Second)
+
+	for _, id := range ids {
+		db.nextDeliveryID++
+
+		db.deliveries[db.nextDeliveryID] = &WebhookDelivery{
+			ID:            db.nextDeliveryID,
+			WebhookID:     id,
+			Event:         event,
+			Payload:       js,
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+	}
+}
+
+type memoryWebhookModel struct {
+	db *memoryDB
+}
+
+func copyWebhook(webhook *Webhook) *Webhook {
+	cp := *webhook
+	cp.Events = append([]string(nil), webhook.Events...)
+
+	return &cp
+}
+
+func copyDelivery(delivery *WebhookDelivery) *WebhookDelivery {
+	cp := *delivery
+	cp.Payload = append(json.RawMessage(nil), delivery.Payload...)
+
+	if delivery.DeliveredAt != nil {
+		deliveredAt := *delivery.DeliveredAt
+		cp.DeliveredAt = &deliveredAt
+	}
+
+	return &cp
+}
+
+func (m memoryWebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	m.db.nextWebhookID++
+
+	webhook.ID = m.db.nextWebhookID
+	webhook.CreatedAt = time.Now().Truncate(time.Second)
+	webhook.Version = 1
+
+	m.db.webhooks[webhook.ID] = copyWebhook(webhook)
+
+	return nil
+}
+
+func (m memoryWebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	webhook, ok := m.db.webhooks[id]
+	if !ok {
+		return nil, ErrNoRecordFound
+	}
+
+	return copyWebhook(webhook), nil
+}
+
+func (m memoryWebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	webhooks := []*Webhook{}
+	for _, webhook := range m.db.webhooks {
+		webhooks = append(webhooks, copyWebhook(webhook))
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+
+	return webhooks, nil
+}
+
+func (m memoryWebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.webhooks[webhook.ID]
+	if !ok || current.Version != webhook.Version {
+		return ErrEditConflict
+	}
+
+	webhook.Version++
+
+	updated := copyWebhook(webhook)
+	updated.Secret, updated.CreatedAt = current.Secret, current.CreatedAt
+
+	m.db.webhooks[webhook.ID] = updated
+
+	return nil
+}
+
+func (m memoryWebhookModel) Delete(ctx context.Context, id int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	if _, ok := m.db.webhooks[id]; !ok {
+		return ErrNoRecordFound
+	}
+
+	delete(m.db.webhooks, id)
+
+	// mirror ON DELETE CASCADE
+	for deliveryID, delivery := range m.db.deliveries {
+		if delivery.WebhookID == id {
+			delete(m.db.deliveries, deliveryID)
+		}
+	}
+
+	attempts := m.db.deliveryAttempts[:0]
+	for _, attempt := range m.db.deliveryAttempts {
+		if _, ok := m.db.deliveries[attempt.DeliveryID]; ok {
+			attempts = append(attempts, attempt)
+		}
+	}
+	m.db.deliveryAttempts = attempts
+
+	return nil
+}
+
+func (m memoryWebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	deliveries := []*WebhookDelivery{}
+
+	for _, delivery := range m.db.deliveries {
+		if delivery.WebhookID == webhookID && (status == "" || delivery.Status == status) {
+			deliveries = append(deliveries, copyDelivery(delivery))
+		}
+	}
+
+	column := filters.sortColumn()
+	desc := filters.sortDirection() == "DESC"
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		a, b := deliveries[i], deliveries[j]
+
+		var c int
+		switch column {
+		case "created_at":
+			c = compareInt64(a.CreatedAt.Unix(), b.CreatedAt.Unix())
+		case "next_attempt_at":
+			c = compareInt64(a.NextAttemptAt.Unix(), b.NextAttemptAt.Unix())
+		}
+
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return a.ID > b.ID
+	})
+
+	return paginate(deliveries, filters), filters.CalculateMetadata(len(deliveries), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryWebhookModel) GetDelivery(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	delivery, ok := m.db.deliveries[id]
+	if !ok || delivery.WebhookID != webhookID {
+		return nil, ErrNoRecordFound
+	}
+
+	return copyDelivery(delivery), nil
+}
+
+func (m memoryWebhookModel) GetAttempts(ctx context.Context, deliveryID int64) ([]*WebhookAttempt, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	attempts := []*WebhookAttempt{}
+
+	for _, attempt := range m.db.deliveryAttempts {
+		if attempt.DeliveryID == deliveryID {
+			cp := *attempt
+			attempts = append(attempts, &cp)
+		}
+	}
+
+	return attempts, nil
+}
+
+func (m memoryWebhookModel) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	now := time.Now()
+	due := []*WebhookDelivery{}
+
+	for _, delivery := range m.db.deliveries {
+		webhook := m.db.webhooks[delivery.WebhookID]
+
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) && webhook.Active {
+			due = append(due, delivery)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttemptAt.Equal(due[j].NextAttemptAt) {
+			return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+		}
+		return due[i].ID < due[j].ID
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*WebhookDelivery, len(due))
+
+	for i, delivery := range due {
+		delivery.NextAttemptAt = now.Add(lease).Truncate(time.Second)
+		m.db.deliveryLeases[delivery.ID] = delivery.NextAttemptAt
+
+		webhook := m.db.webhooks[delivery.WebhookID]
+
+		claimed[i] = copyDelivery(delivery)
+		claimed[i].URL, claimed[i].Secret = webhook.URL, webhook.Secret
+	}
+
+	return claimed, nil
+}
+
+func (m memoryWebhookModel) RecordAttempt(ctx context.Context, delivery *WebhookDelivery, attempt *WebhookAttempt) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.deliveries[delivery.ID]
+	if !ok {
+		// the webhook was deleted while the delivery was in flight
+		return nil
+	}
+
+	m.db.nextAttemptID++
+
+	attempt.ID = m.db.nextAttemptID
+	attempt.DeliveryID = delivery.ID
+	attempt.CreatedAt = time.Now().Truncate(time.Second)
+
+	cp := *attempt
+	m.db.deliveryAttempts = append(m.db.deliveryAttempts, &cp)
+
+	updated := copyDelivery(delivery)
+	updated.WebhookID, updated.Event, updated.Payload, updated.CreatedAt = current.WebhookID, current.Event, current.Payload, current.CreatedAt
+	updated.URL, updated.Secret = "", ""
+
+	m.db.deliveries[delivery.ID] = updated
+	delete(m.db.deliveryLeases, delivery.ID)
+
+	return nil
+}
+
+func (m memoryWebhookModel) Redeliver(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	delivery, ok := m.db.deliveries[id]
+	if !ok || delivery.WebhookID != webhookID {
+		return nil, ErrNoRecordFound
+	}
+
+	if time.Now().Before(m.db.deliveryLeases[id]) {
+		return nil, ErrEditConflict
+	}
+	delete(m.db.deliveryLeases, id)
+
+	delivery.Status = DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().Truncate(time.Second)
+	delivery.DeliveredAt = nil
+
+	return copyDelivery(delivery), nil
+}
+
+type memoryMovieChangeModel struct {
+	db *memoryDB
+}
+
+func (m memoryMovieChangeModel) GetAfter(ctx context.Context, afterID int64, limit int) ([]*MovieChange, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	changes := []*MovieChange{}
+
+	for _, change := range m.db.changes {
+		if change.ID > afterID && len(changes) < limit {
+			cp := *change
+			cp.Movie.Genres = append([]string(nil), change.Movie.Genres...)
+			changes = append(changes, &cp)
+		}
+	}
+
+	return changes, nil
+}
+
+func (m memoryMovieChangeModel) LatestID(ctx context.Context) (int64, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	return m.db.nextChangeID, nil
+}
+
+func (m memoryMovieChangeModel) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	kept := m.db.changes[:0]
+	for _, change := range m.db.changes {
+		if !change.CreatedAt.Before(before) {
+			kept = append(kept, change)
+		}
+	}
+
+	deleted := int64(len(m.db.changes) - len(kept))
+	m.db.changes = kept
+
+	return deleted, nil
+}
+
+// memoryJob is a job along with its lease, which clients never see
+type memoryJob struct {
+	Job
+	lockedUntil time.Time
+}
+
+type memoryJobModel struct {
+	db *memoryDB
+}
+
+func copyJob(job *Job) *Job {
+	cp := *job
+	cp.Payload = append(json.RawMessage(nil), job.Payload...)
+
+	return &cp
+}
+
+// enqueueJob mirrors the function of the same name. The caller must hold the write lock
+func (db *memoryDB) enqueueJob(job *Job) {
+	db.nextJobID++
+
+	now := time.Now().Truncate(time.Second)
+
+	job.ID = db.nextJobID
+	job.Status = JobPending
+	job.CreatedAt, job.UpdatedAt = now, now
+
+	if job.RunAt.IsZero() {
+		job.RunAt = now
+	}
+
+	db.jobs[job.ID] = &memoryJob{Job: *copyJob(job)}
+}
+
+func (m memoryJobModel) Enqueue(ctx context.Context, job *Job) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	m.db.enqueueJob(job)
+
+	return nil
+}
+
+func (m memoryJobModel) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	now := time.Now()
+
+	var next *memoryJob
+
+	for _, job := range m.db.jobs {
+		due := job.Status == JobPending && !job.RunAt.After(now) || job.Status == JobRunning && job.lockedUntil.Before(now)
+		if !due {
+			continue
+		}
+
+		if next == nil || job.RunAt.Before(next.RunAt) || job.RunAt.Equal(next.RunAt) && job.ID < next.ID {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil, ErrNoRecordFound
+	}
+
+	next.Status = JobRunning
+	next.Attempts++
+	next.lockedUntil = now.Add(lease)
+	next.UpdatedAt = now.Truncate(time.Second)
+
+	return copyJob(&next.Job), nil
+}
+
+func (m memoryJobModel) Complete(ctx context.Context, id int64) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	delete(m.db.jobs, id)
+
+	return nil
+}
+
+func (m memoryJobModel) Fail(ctx context.Context, job *Job) error {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	current, ok := m.db.jobs[job.ID]
+	if !ok {
+		return ErrNoRecordFound
+	}
+
+	current.Status, current.RunAt, current.LastError = job.Status, job.RunAt, job.LastError
+	current.lockedUntil = time.Time{}
+	current.UpdatedAt = time.Now().Truncate(time.Second)
+
+	job.UpdatedAt = current.UpdatedAt
+
+	return nil
+}
+
+func (m memoryJobModel) GetAll(ctx context.Context, status string, filters Filters) ([]*Job, Metadata, error) {
+	m.db.mu.RLock()
+	defer m.db.mu.RUnlock()
+
+	jobs := []*Job{}
+
+	for _, job := range m.db.jobs {
+		if status == "" || job.Status == status {
+			jobs = append(jobs, copyJob(&job.Job))
+		}
+	}
+
+	column := filters.sortColumn()
+	desc := filters.sortDirection() == "DESC"
+
+	sort.Slice(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+
+		var c int
+		switch column {
+		case "created_at":
+			c = compareInt64(a.CreatedAt.Unix(), b.CreatedAt.Unix())
+		case "run_at":
+			c = compareInt64(a.RunAt.Unix(), b.RunAt.Unix())
+		case "updated_at":
+			c = compareInt64(a.UpdatedAt.Unix(), b.UpdatedAt.Unix())
+		}
+
+		if desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c < 0
+		}
+
+		return a.ID < b.ID
+	})
+
+	return paginate(jobs, filters), filters.CalculateMetadata(len(jobs), filters.Page, filters.PageSize), nil
+}
+
+func (m memoryJobModel) Requeue(ctx context.Context, id int64) (*Job, error) {
+	m.db.mu.Lock()
+	defer m.db.mu.Unlock()
+
+	job, ok := m.db.jobs[id]
+	if !ok || job.Status != JobDead {
+		return nil, ErrNoRecordFound
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	job.Status, job.Attempts, job.RunAt, job.UpdatedAt = JobPending, 0, now, now
+
+	return copyJob(&job.Job), nil
+}
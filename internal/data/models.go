@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,18 +12,185 @@ var (
 	ErrEditConflict  = errors.New("edit conflict")
 )
 
+// withTx runs fn inside a transaction, committing when it returns nil and rolling back otherwise
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IdempotencyStore keeps the responses replayed to retried requests
+type IdempotencyStore interface {
+	Reserve(ctx context.Context, rec *IdempotencyRecord) (*IdempotencyRecord, error)
+	Complete(ctx context.Context, rec *IdempotencyRecord) error
+	Release(ctx context.Context, key string, userID int64) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// ImportStore keeps track of bulk movie imports
+type ImportStore interface {
+	Insert(ctx context.Context, imp *Import) error
+	Get(ctx context.Context, id int64) (*Import, error)
+	Update(ctx context.Context, imp *Import) error
+	FailAbandoned(ctx context.Context, before time.Time, reason string) (int64, error)
+}
+
+// JobStore is implemented by anything able to persist the background job queue
+type JobStore interface {
+	Enqueue(ctx context.Context, job *Job) error
+	Claim(ctx context.Context, lease time.Duration) (*Job, error)
+	Complete(ctx context.Context, id int64) error
+	Fail(ctx context.Context, job *Job) error
+	GetAll(ctx context.Context, status string, filters Filters) ([]*Job, Metadata, error)
+	Requeue(ctx context.Context, id int64) (*Job, error)
+}
+
+// MovieChangeStore reads the log of changes made to movies
+type MovieChangeStore interface {
+	GetAfter(ctx context.Context, afterID int64, limit int) ([]*MovieChange, error)
+	LatestID(ctx context.Context) (int64, error)
+	DeleteBefore(ctx context.Context, before time.Time) (int64, error)
+}
+
+// MovieStore is implemented by anything able to persist movies. MovieModel talks to
+// PostgreSQL while the in-memory store backs handler tests and local demos
+type MovieStore interface {
+	Insert(ctx context.Context, movie *Movie, userID int64) error
+	InsertMany(ctx context.Context, movies []*Movie, userID int64) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	GetAll(ctx context.Context, q MovieQuery, filters Filters) ([]*Movie, Metadata, error)
+	Suggest(ctx context.Context, search string, limit int) ([]*Suggestion, error)
+	Facets(ctx context.Context, q MovieQuery, facets []string) (map[string][]FacetCount, error)
+	Export(ctx context.Context, q MovieQuery, filters Filters, fn func(*Movie) error) error
+	Update(ctx context.Context, movie *Movie, userID int64) error
+	Delete(ctx context.Context, id int64, version int32, userID int64) error
+	Batch(ctx context.Context, ops []*MovieOperation, userID int64) error
+	GetTrash(ctx context.Context, filters Filters) ([]*Movie, Metadata, error)
+	Undelete(ctx context.Context, id int64, userID int64) (*Movie, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
+
+// PersonStore is implemented by anything able to persist people
+type PersonStore interface {
+	Insert(ctx context.Context, person *Person) error
+	Get(ctx context.Context, id int64) (*Person, error)
+	GetAll(ctx context.Context, name string, filters Filters) ([]*Person, Metadata, error)
+	Update(ctx context.Context, person *Person) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// CreditStore is implemented by anything able to persist the people credited on movies
+type CreditStore interface {
+	Insert(ctx context.Context, credit *Credit) error
+	GetAllForMovies(ctx context.Context, movieIDs []int64) (map[int64][]*Credit, error)
+	Delete(ctx context.Context, movieID, id int64) error
+}
+
+// ReviewStore is implemented by anything able to persist movie reviews
+type ReviewStore interface {
+	Insert(ctx context.Context, review *Review) error
+	Get(ctx context.Context, movieID, userID int64) (*Review, error)
+	GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error)
+	Update(ctx context.Context, review *Review) error
+	Delete(ctx context.Context, movieID, userID int64) error
+}
+
+// RevisionStore is implemented by anything able to read the movie revision history
+type RevisionStore interface {
+	GetAllForMovie(ctx context.Context, movieID int64) ([]*Revision, error)
+	Get(ctx context.Context, movieID int64, version int32) (*Revision, error)
+}
+
+// WebhookStore is implemented by anything able to persist webhooks along with the outbox of
+// their deliveries
+type WebhookStore interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	Get(ctx context.Context, id int64) (*Webhook, error)
+	GetAll(ctx context.Context) ([]*Webhook, error)
+	Update(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, id int64) error
+	GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error)
+	GetDelivery(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error)
+	GetAttempts(ctx context.Context, deliveryID int64) ([]*WebhookAttempt, error)
+	ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	RecordAttempt(ctx context.Context, delivery *WebhookDelivery, attempt *WebhookAttempt) error
+	Redeliver(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error)
+}
+
+// WatchlistStore is implemented by anything able to persist users' watchlists
+type WatchlistStore interface {
+	Add(ctx context.Context, userID, movieID int64) (*WatchlistItem, error)
+	Get(ctx context.Context, userID, movieID int64) (*WatchlistItem, error)
+	GetAll(ctx context.Context, userID int64, watched *bool, filters Filters) ([]*WatchlistItem, Metadata, error)
+	Update(ctx context.Context, item *WatchlistItem) error
+	Remove(ctx context.Context, userID, movieID int64) error
+}
+
+// PermissionStore is implemented by anything able to persist user permissions
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+// TokenStore is implemented by anything able to persist user tokens
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, tokenScope string, userID int64) error
+}
+
+// UserStore is implemented by anything able to persist users
+type UserStore interface {
+	Insert(ctx context.Context, user *User, jobs ...*Job) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintText string) (*User, error)
+}
+
 type Models struct {
-	Movies      MovieModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	Credits      CreditStore
+	Idempotency  IdempotencyStore
+	Imports      ImportStore
+	Jobs         JobStore
+	MovieChanges MovieChangeStore
+	Movies       MovieStore
+	People       PersonStore
+	Permissions  PermissionStore
+	Reviews      ReviewStore
+	Revisions    RevisionStore
+	Tokens       TokenStore
+	Users        UserStore
+	Watchlists   WatchlistStore
+	Webhooks     WebhookStore
 }
 
-func NewModels(db *sql.DB) Models {
+// NewModels wires every model to the given database. The timeout bounds each individual
+// query and is applied on top of whatever deadline the caller's context already carries
+func NewModels(db *sql.DB, timeout time.Duration) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Credits:      CreditModel{DB: db, Timeout: timeout},
+		Idempotency:  IdempotencyModel{DB: db, Timeout: timeout},
+		Imports:      ImportModel{DB: db, Timeout: timeout},
+		Jobs:         JobModel{DB: db, Timeout: timeout},
+		MovieChanges: MovieChangeModel{DB: db, Timeout: timeout},
+		Movies:       MovieModel{DB: db, Timeout: timeout},
+		People:       PersonModel{DB: db, Timeout: timeout},
+		Permissions:  PermissionModel{DB: db, Timeout: timeout},
+		Reviews:      ReviewModel{DB: db, Timeout: timeout},
+		Revisions:    RevisionModel{DB: db, Timeout: timeout},
+		Tokens:       TokenModel{DB: db, Timeout: timeout},
+		Users:        UserModel{DB: db, Timeout: timeout},
+		Watchlists:   WatchlistModel{DB: db, Timeout: timeout},
+		Webhooks:     WebhookModel{DB: db, Timeout: timeout},
 	}
 }
@@ -3,25 +3,374 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/4925k/greenlight/internal/validator"
 	"github.com/lib/pq"
+	"html"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type MovieModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type Movie struct {
-	ID        int64     `json:"ID"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   Runtime   `json:"runtime,omitempty,string"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID        int64      `json:"ID"`
+	CreatedAt time.Time  `json:"-"`
+	Title     string     `json:"title"`
+	Year      int32      `json:"year,omitempty"`
+	Runtime   Runtime    `json:"runtime,omitempty,string"`
+	Genres    []string   `json:"genres,omitempty"`
+	Version   int32      `json:"version"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	AverageRating float64 `json:"average_rating"`
+	RatingCount   int32   `json:"rating_count"`
+
+	// Credits is only filled in when a client asks for it with ?include=credits
+	Credits []*Credit `json:"credits,omitempty"`
+
+	// Highlight is the title escaped for HTML, with the words matching a title search wrapped
+	// in <mark> tags
+	Highlight string `json:"highlight,omitempty"`
+}
+
+// highlightStart and highlightStop stand in for the <mark> tags while a title is highlighted.
+// They are stripped from the title beforehand and swapped for the tags once the rest of it
+// has been escaped, so a title can't smuggle markup into the highlight
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+var highlightTags = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// markHighlight escapes a title highlighted with the placeholders and puts the tags in
+func markHighlight(s string) string {
+	return highlightTags.Replace(html.EscapeString(s))
+}
+
+const (
+	MatchExact  = "exact"  // every word of the search must appear in the title
+	MatchPrefix = "prefix" // like exact, but the last word may be incomplete
+	MatchFuzzy  = "fuzzy"  // like prefix, falling back to trigram similarity to tolerate typos
+)
+
+var (
+	MatchModes = []string{MatchExact, MatchPrefix, MatchFuzzy}
+
+	// SearchLanguages are the text search configurations shipped with PostgreSQL. Anything
+	// but simple stems words, so "running" finds "Run"
+	SearchLanguages = []string{
+		"simple", "danish", "dutch", "english", "finnish", "french", "german", "hungarian",
+		"italian", "norwegian", "portuguese", "russian", "spanish", "swedish", "turkish",
+	}
+)
+
+// MovieQuery holds the criteria used to narrow down a movie listing. Zero values match everything
+type MovieQuery struct {
+	Title         string
+	Match         string   // one of MatchModes, exact when empty
+	Language      string   // one of SearchLanguages, simple when empty
+	Genres        []string // movies must have all of these
+	GenresAny     []string // movies must have at least one of these
+	ExcludeGenres []string
+	PersonID      int64
+	YearMin       int32
+	YearMax       int32
+	RuntimeMin    int32
+	RuntimeMax    int32
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Fields restricts the columns read to the given MovieFields. The id and sort column
+	// are read regardless as paging needs them. Nil reads everything
+	Fields []string
+}
+
+// MovieFields are the keys of a movie a client can pick with ?fields=. Each is named after
+// the column it is read from
+var MovieFields = []string{"id", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count"}
+
+func ValidateMovieFields(v *validator.Validator, fields []string) {
+	for _, field := range fields {
+		v.Check(validator.In(field, MovieFields...), "fields", "must be one of "+strings.Join(MovieFields, ", "))
+	}
+
+	v.Check(validator.Unique(fields), "fields", "must contain unique values")
+}
+
+// Project returns the movie with only the given fields for encoding, along with the embedded
+// credits and search highlight when it carries them. Without fields the movie is returned whole
+func (movie *Movie) Project(fields []string) interface{} {
+	if len(fields) == 0 {
+		return movie
+	}
+
+	projected := make(map[string]interface{}, len(fields)+2)
+
+	for _, field := range fields {
+		switch field {
+		case "id":
+			projected["ID"] = movie.ID
+		case "title":
+			projected["title"] = movie.Title
+		case "year":
+			projected["year"] = movie.Year
+		case "runtime":
+			projected["runtime"] = movie.Runtime
+		case "genres":
+			projected["genres"] = movie.Genres
+		case "version":
+			projected["version"] = movie.Version
+		case "average_rating":
+			projected["average_rating"] = movie.AverageRating
+		case "rating_count":
+			projected["rating_count"] = movie.RatingCount
+		}
+	}
+
+	if movie.Credits != nil {
+		projected["credits"] = movie.Credits
+	}
+
+	if movie.Highlight != "" {
+		projected["highlight"] = movie.Highlight
+	}
+
+	return projected
+}
+
+// ProjectMovies applies Project to every movie
+func ProjectMovies(movies []*Movie, fields []string) interface{} {
+	if len(fields) == 0 {
+		return movies
+	}
+
+	projected := make([]interface{}, len(movies))
+	for i, movie := range movies {
+		projected[i] = movie.Project(fields)
+	}
+
+	return projected
+}
+
+// movieColumns lists the columns GetAll reads for the query, always including the id and
+// the sort column since the cursor of the next page is built from them
+func movieColumns(q MovieQuery, sortColumn string) []string {
+	if len(q.Fields) == 0 {
+		return []string{"id", "created_at", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count"}
+	}
+
+	columns := []string{"id"}
+
+	for _, field := range append(q.Fields, sortColumn) {
+		if validator.In(field, MovieFields...) && !validator.In(field, columns...) {
+			columns = append(columns, field)
+		}
+	}
+
+	return columns
+}
+
+// movieColumnDest returns where to scan the column into
+func movieColumnDest(movie *Movie, column string) interface{} {
+	switch column {
+	case "created_at":
+		return &movie.CreatedAt
+	case "title":
+		return &movie.Title
+	case "year":
+		return &movie.Year
+	case "runtime":
+		return &movie.Runtime
+	case "genres":
+		return pq.Array(&movie.Genres)
+	case "version":
+		return &movie.Version
+	case "average_rating":
+		return &movie.AverageRating
+	case "rating_count":
+		return &movie.RatingCount
+	default:
+		return &movie.ID
+	}
+}
+
+func ValidateMovieQuery(v *validator.Validator, q MovieQuery) {
+	v.Check(q.Match == "" || validator.In(q.Match, MatchModes...), "match", "must be one of "+strings.Join(MatchModes, ", "))
+	v.Check(q.Language == "" || validator.In(q.Language, SearchLanguages...), "language", "unsupported language")
+
+	if q.YearMin != 0 {
+		v.Check(q.YearMin >= 1888, "year_min", "must be later than 1888")
+	}
+
+	if q.YearMax != 0 {
+		v.Check(q.YearMax >= 1888, "year_max", "must be later than 1888")
+		v.Check(q.YearMin <= q.YearMax, "year_max", "must not be less than year_min")
+	}
+
+	v.Check(q.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(q.RuntimeMax >= 0, "runtime_max", "must not be negative")
+
+	if q.RuntimeMax != 0 {
+		v.Check(q.RuntimeMin <= q.RuntimeMax, "runtime_max", "must not be less than runtime_min")
+	}
+
+	if !q.CreatedAfter.IsZero() && !q.CreatedBefore.IsZero() {
+		v.Check(q.CreatedAfter.Before(q.CreatedBefore), "created_before", "must be later than created_after")
+	}
+
+	v.Check(len(q.Genres) <= 5, "genres_all", "must not contain more than 5 genres")
+	v.Check(len(q.GenresAny) <= 20, "genres_any", "must not contain more than 20 genres")
+	v.Check(len(q.ExcludeGenres) <= 20, "exclude_genres", "must not contain more than 20 genres")
+}
+
+// movieFilter is the SQL matching a MovieQuery. rank and highlight are select expressions
+// sharing the placeholders of where, which are bound to args
+type movieFilter struct {
+	where     string
+	rank      string
+	highlight string
+	args      []interface{}
+}
+
+func (q MovieQuery) match() string {
+	if q.Match == "" {
+		return MatchExact
+	}
+
+	return q.Match
+}
+
+// language returns the text search configuration, which is interpolated into the query so
+// that the expression indexes on title can be used
+func (q MovieQuery) language() string {
+	if q.Language == "" {
+		return "simple"
+	}
+
+	// the language should have already been checked by ValidateMovieQuery, this is a failsafe
+	// against SQL injection like the one in Filters.sortColumn
+	if !validator.In(q.Language, SearchLanguages...) {
+		panic("unsafe search language " + q.Language)
+	}
+
+	return q.Language
+}
+
+// isWordRune reports whether r belongs to a word rather than separating words
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// lexemes splits s the way the 'simple' text search configuration does: lowercase words
+// with punctuation stripped
+func lexemes(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// prefixQuery turns the search into a tsquery matching all of its words, the last one as a
+// prefix so "godf" finds "The Godfather"
+func prefixQuery(search string) string {
+	words := lexemes(search)
+	if len(words) == 0 {
+		return ""
+	}
+
+	return strings.Join(words, " & ") + ":*"
+}
+
+// filter builds the conditions matching the query
+func (q MovieQuery) filter() movieFilter {
+	var args []interface{}
+
+	f := movieFilter{rank: "0", highlight: "''"}
+	conditions := []string{"deleted_at IS NULL"}
+
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.Title != "" {
+		language := q.language()
+
+		search, parse := q.Title, "plainto_tsquery"
+		if q.match() != MatchExact {
+			search, parse = prefixQuery(q.Title), "to_tsquery"
+		}
+
+		args = append(args, search)
+		tsquery := fmt.Sprintf("%s('%s', $%d)", parse, language, len(args))
+
+		match := fmt.Sprintf("to_tsvector('%s', title) @@ %s", language, tsquery)
+		f.rank = fmt.Sprintf("ts_rank(to_tsvector('%s', title), %s)", language, tsquery)
+		f.highlight = fmt.Sprintf(`ts_headline('%s', translate(title, '%s%s', ''), %s, 'StartSel="%s", StopSel="%s", HighlightAll=true')`,
+			language, highlightStart, highlightStop, tsquery, highlightStart, highlightStop)
+
+		// <% is pg_trgm's word similarity operator, true when the search closely matches
+		// a stretch of the title
+		if q.match() == MatchFuzzy {
+			args = append(args, q.Title)
+			match = fmt.Sprintf("(%s OR $%d <%% title)", match, len(args))
+			f.rank = fmt.Sprintf("%s + word_similarity($%d, title)", f.rank, len(args))
+		}
+
+		conditions = append(conditions, match)
+	}
+
+	if len(q.Genres) > 0 {
+		add("genres @> $%d", pq.Array(q.Genres))
+	}
+
+	if len(q.GenresAny) > 0 {
+		add("genres && $%d", pq.Array(q.GenresAny))
+	}
+
+	if len(q.ExcludeGenres) > 0 {
+		add("NOT genres && $%d", pq.Array(q.ExcludeGenres))
+	}
+
+	if q.PersonID != 0 {
+		add("EXISTS (SELECT 1 FROM credits WHERE credits.movie_id = movies.id AND credits.person_id = $%d)", q.PersonID)
+	}
+
+	if q.YearMin != 0 {
+		add("year >= $%d", q.YearMin)
+	}
+
+	if q.YearMax != 0 {
+		add("year <= $%d", q.YearMax)
+	}
+
+	if q.RuntimeMin != 0 {
+		add("runtime >= $%d", q.RuntimeMin)
+	}
+
+	if q.RuntimeMax != 0 {
+		add("runtime <= $%d", q.RuntimeMax)
+	}
+
+	if !q.CreatedAfter.IsZero() {
+		add("created_at >= $%d", q.CreatedAfter)
+	}
+
+	if !q.CreatedBefore.IsZero() {
+		add("created_at < $%d", q.CreatedBefore)
+	}
+
+	f.where = strings.Join(conditions, " AND ")
+	f.args = args
+
+	return f
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -41,17 +390,166 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must contain unique values")
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert stores a new movie and records its first revision, attributed to userID, in the
+// same transaction
+func (m MovieModel) Insert(ctx context.Context, movie *Movie, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		return m.insert(ctx, tx, movie, userID)
+	})
+}
+
+// InsertMany inserts the movies in a single transaction, streaming them with COPY rather than
+// an INSERT per row. The ids and versions aren't read back, the movies are left untouched
+func (m MovieModel) InsertMany(ctx context.Context, movies []*Movie, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		// COPY can't return the new ids, so the rows go through a staging table and are moved
+		// into movies by a single INSERT which records their revisions along the way
+		_, err := tx.ExecContext(ctx, `CREATE TEMPORARY TABLE movie_imports
+						(title text, year integer, runtime integer, genres text[]) ON COMMIT DROP`)
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.PrepareContext(ctx, pq.CopyIn("movie_imports", "title", "year", "runtime", "genres"))
+		if err != nil {
+			return err
+		}
+
+		for _, movie := range movies {
+			_, err = stmt.ExecContext(ctx, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres))
+			if err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+
+		// an Exec without arguments flushes the buffered rows
+		_, err = stmt.ExecContext(ctx)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+
+		err = stmt.Close()
+		if err != nil {
+			return err
+		}
+
+		query := `WITH inserted AS (
+					INSERT INTO movies (title, year, runtime, genres)
+					SELECT title, year, runtime, genres FROM movie_imports
+					RETURNING id, created_at, version, title, year, runtime, genres
+				), revisions AS (
+					INSERT INTO movie_revisions (movie_id, version, action, user_id, title, year, runtime, genres)
+					SELECT id, version, $1, $2, title, year, runtime, genres FROM inserted
+				)
+				SELECT id, created_at, version, title, year, runtime, genres FROM inserted ORDER BY id`
+
+		rows, err := tx.QueryContext(ctx, query, RevisionCreate, sql.NullInt64{Int64: userID, Valid: userID > 0})
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		// the new movies are read back for the webhook deliveries reporting them
+		var payloads []interface{}
+
+		for rows.Next() {
+			var movie Movie
+
+			err := rows.Scan(&movie.ID, &movie.CreatedAt, &movie.Version, &movie.Title, &movie.Year, &movie.Runtime, pq.Array(&movie.Genres))
+			if err != nil {
+				return err
+			}
+
+			payloads = append(payloads, map[string]interface{}{"movie": &movie})
+		}
+
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		return enqueueWebhooks(ctx, tx, EventMovieCreated, payloads...)
+	})
+}
+
+const (
+	MovieOpCreate = "create"
+	MovieOpPatch  = "patch"
+	MovieOpDelete = "delete"
+)
+
+// MaxMovieOperations caps the number of operations in a batch
+const MaxMovieOperations = 100
+
+// MovieOperation is a single change of a batch. Creates and patches carry the movie as it
+// should be stored, the version of a patched movie being the one expected in the database.
+// Deletes only need the movie's ID
+type MovieOperation struct {
+	Op    string
+	Movie *Movie
+}
+
+// BatchError reports the operation of a batch which failed and caused it to be rolled back
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batch applies the operations in order in a single transaction, so either all of them are
+// stored or none. Movies are updated in place as with Insert and Update. A failing operation
+// is reported as a *BatchError wrapping the error it got, ErrEditConflict when a patched
+// movie has moved on from the expected version and ErrNoRecordFound for deleting a missing one
+func (m MovieModel) Batch(ctx context.Context, ops []*MovieOperation, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		for i, op := range ops {
+			var err error
+
+			switch op.Op {
+			case MovieOpCreate:
+				err = m.insert(ctx, tx, op.Movie, userID)
+			case MovieOpPatch:
+				err = m.update(ctx, tx, op.Movie, userID)
+			case MovieOpDelete:
+				err = m.delete(ctx, tx, op.Movie.ID, op.Movie.Version, userID)
+			default:
+				err = fmt.Errorf("unknown operation %q", op.Op)
+			}
+
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m MovieModel) insert(ctx context.Context, tx *sql.Tx, movie *Movie, userID int64) error {
 	query := `INSERT INTO movies (title, year, runtime, genres)
 				VALUES ($1, $2, $3, $4)
 				RETURNING id, created_at, version`
 
 	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -61,19 +559,21 @@ func (m MovieModel) Insert(movie *Movie) error {
 		}
 	}
 
-	return nil
+	return recordMovieChange(ctx, tx, RevisionCreate, movie, userID)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrNoRecordFound
 	}
 
-	query := `SELECT id, created_at, title, year, runtime, genres, version FROM movies WHERE id = $1`
+	query := `SELECT id, created_at, title, year, runtime, genres, version, average_rating, rating_count
+				FROM movies
+				WHERE id = $1 AND deleted_at IS NULL`
 
 	var movie Movie
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
@@ -84,6 +584,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.AverageRating,
+		&movie.RatingCount,
 	)
 	if err != nil {
 		switch {
@@ -97,7 +599,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, q MovieQuery, filters Filters) ([]*Movie, Metadata, error) {
 	/*
 		The to_tsvector('simple', title) function takes a movie title and splits it into lexemes.We specify the simple configuration,
 		which means that the lexemes are just lowercase versions of the words in the title.
@@ -112,18 +614,59 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		the generated query term matches the lexemes. To continue the example,
 		the query term 'the' & 'club' will match rows which contain both lexemes 'the' and 'club'
 	*/
-	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), id, created_at, title, year, runtime, genres, version 
+	f := q.filter()
+	where, args := f.where, f.args
+
+	pivot, err := movieCursorPivot(filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// the window function would only count the rows past the cursor, so cursor pages count
+	// the matching rows with a subquery instead
+	count := "COUNT(*) OVER()"
+	switch {
+	case filters.SkipCount:
+		count = "0"
+	case pivot != nil:
+		count = "(SELECT COUNT(*) FROM movies WHERE " + where + ")"
+	}
+
+	// keyset pagination picks up right after the last row of the previous page. The id
+	// tiebreaker is always ascending, whatever the direction of the sort column
+	var keyset string
+	if pivot != nil {
+		column, op := filters.sortColumn(), ">"
+		if filters.sortDirection() == "DESC" {
+			op = "<"
+		}
+
+		args = append(args, movieSortValue(pivot, column), pivot.ID)
+		keyset = fmt.Sprintf("AND (%[1]s %[2]s $%[3]d OR (%[1]s = $%[3]d AND id > $%[4]d))", column, op, len(args)-1, len(args))
+	}
+
+	// one row more than the page size tells whether there is a next page without counting
+	args = append(args, filters.limit()+1, filters.offset())
+
+	// the most relevant titles come first, there is no ascending relevance sort
+	orderBy := filters.sortColumn() + " " + filters.sortDirection()
+	if filters.sortColumn() == "relevance" {
+		orderBy = "relevance DESC"
+	}
+
+	columns := movieColumns(q, filters.sortColumn())
+
+	query := fmt.Sprintf(`SELECT %s, %s,
+				%s AS relevance, %s AS highlight
 				FROM movies
-				WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-				AND (genres @> $2 OR $2 = '{}')
-				ORDER BY %s %s, id ASC
-				LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+				WHERE %s
+				%s
+				ORDER BY %s, id ASC
+				LIMIT $%d OFFSET $%d`, count, strings.Join(columns, ", "), f.rank, f.highlight, where, keyset, orderBy, len(args)-1, len(args))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -131,6 +674,324 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 
 	defer rows.Close()
 
+	movies := []*Movie{}
+	var totalRecords int
+	var relevance float64
+
+	for rows.Next() {
+		var movie Movie
+
+		dest := []interface{}{&totalRecords}
+		for _, column := range columns {
+			dest = append(dest, movieColumnDest(&movie, column))
+		}
+		dest = append(dest, &relevance, &movie.Highlight)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		movie.Highlight = markHighlight(movie.Highlight)
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return nextMoviePage(movies, filters, totalRecords)
+}
+
+// nextMoviePage trims the extra row fetched past the page and turns it into the cursor of
+// the next page
+func nextMoviePage(movies []*Movie, filters Filters, totalRecords int) ([]*Movie, Metadata, error) {
+	var nextCursor string
+
+	// relevance is computed per search rather than stored, so there is no position to resume from
+	if len(movies) > filters.limit() && filters.sortColumn() == "relevance" {
+		return movies[:filters.limit()], filters.keysetMetadata(totalRecords, ""), nil
+	}
+
+	if len(movies) > filters.limit() {
+		movies = movies[:filters.limit()]
+		last := movies[len(movies)-1]
+
+		var err error
+		nextCursor, err = encodeCursor(filters.Sort, movieSortValue(last, filters.sortColumn()), last.ID)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+
+	return movies, filters.keysetMetadata(totalRecords, nextCursor), nil
+}
+
+// Export calls fn with every movie matching the query in the order of the filters, which
+// are only used for sorting. Rows are handed over as they are scanned so the whole catalogue
+// is never held in memory. The export runs for as long as the caller keeps up, so it is
+// bound by ctx rather than the model's Timeout. An error from fn stops the export and is
+// returned as is
+func (m MovieModel) Export(ctx context.Context, q MovieQuery, filters Filters, fn func(*Movie) error) error {
+	f := q.filter()
+
+	orderBy := filters.sortColumn() + " " + filters.sortDirection()
+	if filters.sortColumn() == "relevance" {
+		orderBy = "relevance DESC"
+	}
+
+	columns := movieColumns(q, filters.sortColumn())
+
+	query := fmt.Sprintf(`SELECT %s, %s AS relevance, %s AS highlight
+				FROM movies
+				WHERE %s
+				ORDER BY %s, id ASC`, strings.Join(columns, ", "), f.rank, f.highlight, f.where, orderBy)
+
+	rows, err := m.DB.QueryContext(ctx, query, f.args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var relevance float64
+
+	for rows.Next() {
+		var movie Movie
+
+		dest := []interface{}{}
+		for _, column := range columns {
+			dest = append(dest, movieColumnDest(&movie, column))
+		}
+		dest = append(dest, &relevance, &movie.Highlight)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return err
+		}
+
+		movie.Highlight = markHighlight(movie.Highlight)
+
+		err = fn(&movie)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// movieSortValue returns the value of the column a movie listing is ordered by, which
+// cursors carry over to the next page
+func movieSortValue(movie *Movie, column string) interface{} {
+	switch column {
+	case "title":
+		return movie.Title
+	case "year":
+		return movie.Year
+	case "runtime":
+		return int32(movie.Runtime)
+	case "average_rating":
+		return movie.AverageRating
+	case "rating_count":
+		return movie.RatingCount
+	default:
+		return movie.ID
+	}
+}
+
+// movieCursorPivot decodes the cursor into a movie holding only the sort value and id of
+// the last row of the previous page. It returns nil when no cursor was given
+func movieCursorPivot(filters Filters) (*Movie, error) {
+	c, err := filters.decodeCursor()
+	if err != nil || c == nil {
+		return nil, err
+	}
+
+	movie := &Movie{ID: c.ID}
+
+	switch filters.sortColumn() {
+	case "title":
+		err = json.Unmarshal(c.Value, &movie.Title)
+	case "year":
+		err = json.Unmarshal(c.Value, &movie.Year)
+	case "runtime":
+		var runtime int32
+		err = json.Unmarshal(c.Value, &runtime)
+		movie.Runtime = Runtime(runtime)
+	case "average_rating":
+		err = json.Unmarshal(c.Value, &movie.AverageRating)
+	case "rating_count":
+		err = json.Unmarshal(c.Value, &movie.RatingCount)
+	default:
+		err = json.Unmarshal(c.Value, &movie.ID)
+	}
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return movie, nil
+}
+
+// Suggestion is the little autocompletion needs to know about a movie
+type Suggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+func ValidateSuggestion(v *validator.Validator, search string, limit int) {
+	v.Check(search != "", "q", "must be provided")
+	v.Check(len(search) <= 100, "q", "must be less than 100 bytes")
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must not be more than 20")
+}
+
+// likePrefix escapes the LIKE wildcards in s and turns it into a lowercase prefix pattern
+func likePrefix(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(s))
+	return s + "%"
+}
+
+// Suggest returns up to limit titles completing the search. Titles starting with it come
+// first, then the ones matching its words by prefix or by trigram similarity
+func (m MovieModel) Suggest(ctx context.Context, search string, limit int) ([]*Suggestion, error) {
+	query := `SELECT id, title, year
+				FROM movies
+				WHERE deleted_at IS NULL
+				AND (lower(title) LIKE $1 OR to_tsvector('simple', title) @@ to_tsquery('simple', $2) OR $3 <% title)
+				ORDER BY lower(title) LIKE $1 DESC, word_similarity($3, title) DESC, title ASC, id ASC
+				LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, likePrefix(search), prefixQuery(search), search, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*Suggestion{}
+
+	for rows.Next() {
+		var suggestion Suggestion
+
+		err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year)
+		if err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
+
+// Update saves the movie if its version still matches the stored one and records the new
+// revision, attributed to userID, in the same transaction
+func (m MovieModel) Update(ctx context.Context, movie *Movie, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		return m.update(ctx, tx, movie, userID)
+	})
+}
+
+func (m MovieModel) update(ctx context.Context, tx *sql.Tx, movie *Movie, userID int64) error {
+	query := `UPDATE movies SET title = $1, year = $2, runtime = $3, genres = $4, version = version +1
+				WHERE id = $5 AND version = $6 AND deleted_at IS NULL
+				RETURNING version, average_rating, rating_count`
+
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version, &movie.AverageRating, &movie.RatingCount)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return recordMovieChange(ctx, tx, RevisionUpdate, movie, userID)
+}
+
+// Delete moves the movie to the trash and records a revision holding its last state.
+// Trashed movies are hidden from Get and GetAll until they are undeleted or purged. A non-zero
+// version makes the delete conditional, it fails with ErrEditConflict when the movie has moved
+// on from that version in the meantime
+func (m MovieModel) Delete(ctx context.Context, id int64, version int32, userID int64) error {
+	if id < 1 {
+		return ErrNoRecordFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		return m.delete(ctx, tx, id, version, userID)
+	})
+}
+
+func (m MovieModel) delete(ctx context.Context, tx *sql.Tx, id int64, version int32, userID int64) error {
+	query := `UPDATE movies SET deleted_at = NOW()
+				WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2)
+				RETURNING id, created_at, title, year, runtime, genres, version, deleted_at`
+
+	var movie Movie
+
+	err := tx.QueryRowContext(ctx, query, id, version).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+		&movie.DeletedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows) && version != 0:
+			return ErrEditConflict
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNoRecordFound
+		default:
+			return err
+		}
+	}
+
+	return recordMovieChange(ctx, tx, RevisionDelete, &movie, userID)
+}
+
+// GetTrash lists the movies that have been deleted but not purged yet
+func (m MovieModel) GetTrash(ctx context.Context, filters Filters) ([]*Movie, Metadata, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), id, created_at, title, year, runtime, genres, version, average_rating, rating_count, deleted_at
+				FROM movies
+				WHERE deleted_at IS NOT NULL
+				ORDER BY %s %s, id ASC
+				LIMIT $1 OFFSET $2`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
 	movies := []*Movie{}
 	var totalRecords int
 
@@ -146,6 +1007,9 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.DeletedAt,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -154,45 +1018,69 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		movies = append(movies, &movie)
 	}
 
-	return movies, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
 
+	return movies, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
-	query := `UPDATE movies SET title = $1, year = $2, runtime = $3, genres = $4, version = version +1
-				WHERE id = $5 AND version = $6 RETURNING version`
+// Undelete takes a movie back out of the trash and records the revision
+func (m MovieModel) Undelete(ctx context.Context, id int64, userID int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrNoRecordFound
+	}
 
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
+	query := `UPDATE movies SET deleted_at = NULL
+				WHERE id = $1 AND deleted_at IS NOT NULL
+				RETURNING id, created_at, title, year, runtime, genres, version, average_rating, rating_count`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
-}
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, id).Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNoRecordFound
+			default:
+				return err
+			}
+		}
 
-func (m MovieModel) Delete(id int64) error {
-	if id < 1 {
-		return ErrNoRecordFound
+		return recordMovieChange(ctx, tx, RevisionUndelete, &movie, userID)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	query := `DELETE FROM movies WHERE id = $1`
+	return &movie, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+// PurgeDeleted permanently removes movies trashed before the given time and reports how many were removed
+func (m MovieModel) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	query := `DELETE FROM movies WHERE deleted_at < $1`
 
-	res, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
 
-	rowsAffected, err := res.RowsAffected()
+	res, err := m.DB.ExecContext(ctx, query, before)
 	if err != nil {
-		return err
-	}
-
-	if rowsAffected == 0 {
-		return ErrNoRecordFound
+		return 0, err
 	}
 
-	return nil
+	return res.RowsAffected()
 }
@@ -10,7 +10,8 @@ import (
 type Permissions []string
 
 type PermissionModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 // Include helps to check if permissions contains the given permission
@@ -24,14 +25,14 @@ func (p Permissions) Include(code string) bool {
 }
 
 // GetAllForUser will fetch the permissions of the given user
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `SELECT permissions.code
 				FROM permissions
 				INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
 				INNER JOIN users ON users_permissions.user_id = users.id
 				WHERE users.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -61,11 +62,11 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 }
 
 // AddForUser will give the mentioned permissions to the user
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `INSERT INTO users_permissions 
 				SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
@@ -0,0 +1,225 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/validator"
+	"time"
+)
+
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+// Review is a user's rating of a movie. Each user can review a given movie once
+type Review struct {
+	ID        int64     `json:"id"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	UserName  string    `json:"user_name,omitempty"`
+	Rating    int32     `json:"rating"`
+	Body      string    `json:"body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int32     `json:"version"`
+}
+
+type ReviewModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating != 0, "rating", "must be provided")
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+
+	v.Check(len(review.Body) <= 10_000, "body", "must be less than 10000 bytes")
+}
+
+// refreshRatings recomputes the movie's rating aggregates as part of the surrounding transaction.
+// The movie row is locked first so that the recount, which runs as a statement of its own,
+// sees the reviews of every transaction which refreshed the movie before this one committed.
+// FOR NO KEY UPDATE leaves alone the KEY SHARE lock an inserted review's foreign key already
+// holds on the movie, where FOR UPDATE would deadlock two reviews of the same movie
+func refreshRatings(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	_, err := tx.ExecContext(ctx, `SELECT id FROM movies WHERE id = $1 FOR NO KEY UPDATE`, movieID)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE movies
+				SET average_rating = COALESCE((SELECT AVG(rating) FROM reviews WHERE movie_id = $1), 0),
+				rating_count = (SELECT COUNT(*) FROM reviews WHERE movie_id = $1)
+				WHERE id = $1`
+
+	_, err = tx.ExecContext(ctx, query, movieID)
+	return err
+}
+
+// Insert stores the review and refreshes the movie's rating aggregates. It returns
+// ErrDuplicateReview if the user already reviewed the movie
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	query := `INSERT INTO reviews (movie_id, user_id, rating, body)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{review.MovieID, review.UserID, review.Rating, review.Body}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "reviews_movie_id_user_id_key"`:
+				return ErrDuplicateReview
+			default:
+				return err
+			}
+		}
+
+		return refreshRatings(ctx, tx, review.MovieID)
+	})
+}
+
+// Get returns the review the user left on the movie
+func (m ReviewModel) Get(ctx context.Context, movieID, userID int64) (*Review, error) {
+	query := `SELECT reviews.id, reviews.movie_id, reviews.user_id, users.name, reviews.rating, reviews.body,
+				reviews.created_at, reviews.updated_at, reviews.version
+				FROM reviews
+				INNER JOIN users ON users.id = reviews.user_id
+				WHERE reviews.movie_id = $1 AND reviews.user_id = $2`
+
+	var review Review
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, userID).Scan(
+		&review.ID,
+		&review.MovieID,
+		&review.UserID,
+		&review.UserName,
+		&review.Rating,
+		&review.Body,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &review, nil
+}
+
+// GetAllForMovie returns a page of the movie's reviews
+func (m ReviewModel) GetAllForMovie(ctx context.Context, movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), reviews.id, reviews.movie_id, reviews.user_id, users.name,
+				reviews.rating, reviews.body, reviews.created_at, reviews.updated_at, reviews.version
+				FROM reviews
+				INNER JOIN users ON users.id = reviews.user_id
+				WHERE reviews.movie_id = $1
+				ORDER BY reviews.%s %s, reviews.id ASC
+				LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	reviews := []*Review{}
+	var totalRecords int
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.MovieID,
+			&review.UserID,
+			&review.UserName,
+			&review.Rating,
+			&review.Body,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return reviews, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Update saves the review if its version still matches and refreshes the movie's rating aggregates
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
+	query := `UPDATE reviews SET rating = $1, body = $2, updated_at = NOW(), version = version + 1
+				WHERE id = $3 AND version = $4
+				RETURNING updated_at, version`
+
+	args := []interface{}{review.Rating, review.Body, review.ID, review.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		return refreshRatings(ctx, tx, review.MovieID)
+	})
+}
+
+// Delete removes the user's review of the movie and refreshes the movie's rating aggregates
+func (m ReviewModel) Delete(ctx context.Context, movieID, userID int64) error {
+	query := `DELETE FROM reviews WHERE movie_id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, query, movieID, userID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrNoRecordFound
+		}
+
+		return refreshRatings(ctx, tx, movieID)
+	})
+}
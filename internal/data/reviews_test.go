@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the migrated database in GREENLIGHT_TEST_DB_DSN, skipping the test
+// when there is none. Locking only shows up against PostgreSQL, the memory store can't stand in
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("GREENLIGHT_TEST_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestReviewModelConcurrentInserts(t *testing.T) {
+	db := openTestDB(t)
+	models := NewModels(db, 10*time.Second)
+	ctx := context.Background()
+
+	const reviewers = 8
+
+	var userIDs []int64
+	t.Cleanup(func() {
+		for _, id := range userIDs {
+			db.Exec(`DELETE FROM users WHERE id = $1`, id)
+		}
+	})
+
+	for i := 0; i < reviewers; i++ {
+		user := &User{Name: "Reviewer", Email: fmt.Sprintf("reviewer-%d-%d@example.com", time.Now().UnixNano(), i)}
+		user.Password.hash = []byte("not a real hash")
+
+		err := models.Users.Insert(ctx, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		userIDs = append(userIDs, user.ID)
+	}
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+	err := models.Movies.Insert(ctx, movie, userIDs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM movies WHERE id = $1`, movie.ID)
+	})
+
+	// every insert takes KEY SHARE on the movie through the foreign key before locking it to
+	// recount, which is where two of them used to deadlock
+	var wg sync.WaitGroup
+	errs := make(chan error, reviewers)
+
+	for i, userID := range userIDs {
+		wg.Add(1)
+
+		go func(userID int64, rating int32) {
+			defer wg.Done()
+			errs <- models.Reviews.Insert(ctx, &Review{MovieID: movie.ID, UserID: userID, Rating: rating})
+		}(userID, int32(i%5+1))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("got error %v; want every review stored", err)
+		}
+	}
+
+	got, err := models.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.RatingCount != reviewers {
+		t.Errorf("got rating count %d; want %d", got.RatingCount, reviewers)
+	}
+}
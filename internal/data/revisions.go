@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+const (
+	RevisionCreate   = "create"
+	RevisionUpdate   = "update"
+	RevisionDelete   = "delete"
+	RevisionUndelete = "undelete"
+)
+
+// Revision is a snapshot of a movie as it was at a given version, along with who made
+// the change and what it changed compared to the previous revision
+type Revision struct {
+	ID        int64             `json:"id"`
+	MovieID   int64             `json:"movie_id"`
+	Version   int32             `json:"version"`
+	Action    string            `json:"action"`
+	UserID    int64             `json:"user_id,omitempty"`
+	UserName  string            `json:"user_name,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Changes   map[string]Change `json:"changes,omitempty"`
+	Movie     Movie             `json:"-"`
+}
+
+// Change holds the old and new value of a single movie field
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type RevisionModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// diffMovies lists the fields that differ between two snapshots. A nil previous
+// snapshot means the movie was just created, so every field is reported
+func diffMovies(prev, next *Movie) map[string]Change {
+	if prev == nil {
+		prev = &Movie{}
+	}
+
+	changes := make(map[string]Change)
+
+	if prev.Title != next.Title {
+		changes["title"] = Change{From: prev.Title, To: next.Title}
+	}
+
+	if prev.Year != next.Year {
+		changes["year"] = Change{From: prev.Year, To: next.Year}
+	}
+
+	if prev.Runtime != next.Runtime {
+		changes["runtime"] = Change{From: prev.Runtime, To: next.Runtime}
+	}
+
+	if !equalStrings(prev.Genres, next.Genres) {
+		changes["genres"] = Change{From: prev.Genres, To: next.Genres}
+	}
+
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withChanges fills in the Changes of revisions ordered from oldest to newest
+func withChanges(revisions []*Revision) []*Revision {
+	var prev *Movie
+
+	for _, revision := range revisions {
+		revision.Changes = diffMovies(prev, &revision.Movie)
+		prev = &revision.Movie
+	}
+
+	return revisions
+}
+
+// insertRevision records the movie's current state as part of the surrounding transaction.
+// A zero userID is stored as NULL
+func insertRevision(ctx context.Context, tx *sql.Tx, action string, movie *Movie, userID int64) error {
+	query := `INSERT INTO movie_revisions (movie_id, version, action, user_id, title, year, runtime, genres)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	args := []interface{}{
+		movie.ID,
+		movie.Version,
+		action,
+		sql.NullInt64{Int64: userID, Valid: userID > 0},
+		movie.Title,
+		movie.Year,
+		movie.Runtime,
+		pq.Array(movie.Genres),
+	}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// recordMovieChange stores a revision of the movie and queues the webhook deliveries
+// reporting the change, both as part of the surrounding transaction
+func recordMovieChange(ctx context.Context, tx *sql.Tx, action string, movie *Movie, userID int64) error {
+	err := insertRevision(ctx, tx, action, movie, userID)
+	if err != nil {
+		return err
+	}
+
+	return enqueueWebhooks(ctx, tx, movieEvents[action], map[string]interface{}{"movie": movie})
+}
+
+const revisionColumns = `movie_revisions.id, movie_revisions.movie_id, movie_revisions.version,
+				movie_revisions.action, COALESCE(movie_revisions.user_id, 0), COALESCE(users.name, ''),
+				movie_revisions.created_at, movie_revisions.title, movie_revisions.year,
+				movie_revisions.runtime, movie_revisions.genres`
+
+func scanRevision(row interface{ Scan(...interface{}) error }) (*Revision, error) {
+	var revision Revision
+
+	err := row.Scan(
+		&revision.ID,
+		&revision.MovieID,
+		&revision.Version,
+		&revision.Action,
+		&revision.UserID,
+		&revision.UserName,
+		&revision.CreatedAt,
+		&revision.Movie.Title,
+		&revision.Movie.Year,
+		&revision.Movie.Runtime,
+		pq.Array(&revision.Movie.Genres),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	revision.Movie.ID = revision.MovieID
+	revision.Movie.Version = revision.Version
+
+	return &revision, nil
+}
+
+// GetAllForMovie returns the movie's history from oldest to newest, each revision
+// carrying the changes it made
+func (m RevisionModel) GetAllForMovie(ctx context.Context, movieID int64) ([]*Revision, error) {
+	query := `SELECT ` + revisionColumns + `
+				FROM movie_revisions
+				LEFT JOIN users ON users.id = movie_revisions.user_id
+				WHERE movie_revisions.movie_id = $1
+				ORDER BY movie_revisions.id ASC`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*Revision{}
+
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return withChanges(revisions), nil
+}
+
+// Get returns the snapshot of the movie as it was at the given version
+func (m RevisionModel) Get(ctx context.Context, movieID int64, version int32) (*Revision, error) {
+	query := `SELECT ` + revisionColumns + `
+				FROM movie_revisions
+				LEFT JOIN users ON users.id = movie_revisions.user_id
+				WHERE movie_revisions.movie_id = $1 AND movie_revisions.version = $2
+				AND movie_revisions.action NOT IN ($3, $4)
+				ORDER BY movie_revisions.id DESC
+				LIMIT 1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	revision, err := scanRevision(m.DB.QueryRowContext(ctx, query, movieID, version, RevisionDelete, RevisionUndelete))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return revision, nil
+}
@@ -25,7 +25,8 @@ type Token struct {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -75,35 +76,35 @@ func ValidateTokenPlaintext(v *validator.Validator, plaintext string) {
 }
 
 // New generates a new token based on given fields and time period and stores it in the database
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `INSERT INTO tokens (hash, user_id, expiry, scope)
 				VALUES ($1, $2, $3, $4)`
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(tokenScope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, tokenScope string, userID int64) error {
 	query := `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`
 
 	args := []interface{}{tokenScope, userID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
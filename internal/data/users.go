@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"github.com/4925k/greenlight/internal/validator"
 	"golang.org/x/crypto/bcrypt"
@@ -34,7 +35,8 @@ type password struct {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 // IsAnonymous checks if the user is anonymous
@@ -96,17 +98,39 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // DATABASE FUNCTIONS
 
-func (m UserModel) Insert(user *User) error {
+// Insert adds the user along with jobs about them, such as their welcome email. The jobs are
+// queued in the same transaction so that they exist exactly when the user does, each with a
+// UserJob naming the new user as its payload
+func (m UserModel) Insert(ctx context.Context, user *User, jobs ...*Job) error {
 	query := `INSERT INTO users (name, email, password_hash, activated)
 				VALUES ($1, $2, $3, $4)
 				RETURNING id, created_at, version`
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			job.Payload, err = json.Marshal(UserJob{UserID: user.ID})
+			if err != nil {
+				return err
+			}
+
+			err = enqueueJob(ctx, tx, job)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "user_email_key"`:
@@ -119,17 +143,17 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
 	query := `SELECT id, created_at, name, email, password_hash, activated, version
 				FROM users
-				WHERE email = $1`
+				WHERE id = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
@@ -150,33 +174,74 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
-	query := `UPDATE users
-				SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-				WHERE id = $5 AND version = $6
-				RETURNING version`
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `SELECT id, created_at, name, email, password_hash, activated, version
+				FROM users
+				WHERE email = $1`
 
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return nil, ErrNoRecordFound
 		default:
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return &user, nil
+}
+
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	// the subquery reads the row as it was before the update, telling an activation apart
+	query := `UPDATE users
+				SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+				FROM (SELECT activated FROM users WHERE id = $5) AS previous
+				WHERE users.id = $5 AND users.version = $6
+				RETURNING users.version, previous.activated`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated, user.ID, user.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var wasActivated bool
+
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.Version, &wasActivated)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+				return ErrDuplicateEmail
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+
+		if user.Activated && !wasActivated {
+			return enqueueWebhooks(ctx, tx, EventUserActivated, map[string]interface{}{"user": user})
+		}
+
+		return nil
+	})
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintText string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintText string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintText))
 
 	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
@@ -191,7 +256,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintText string) (*User, error
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
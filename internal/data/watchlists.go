@@ -0,0 +1,267 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateWatchlistItem = errors.New("duplicate watchlist item")
+)
+
+// WatchlistItem is a movie on a user's watchlist. Position orders the list from 1
+type WatchlistItem struct {
+	MovieID   int64      `json:"movie_id"`
+	Position  int32      `json:"position"`
+	Watched   bool       `json:"watched"`
+	WatchedAt *time.Time `json:"watched_at,omitempty"`
+	AddedAt   time.Time  `json:"added_at"`
+	Movie     *Movie     `json:"movie,omitempty"`
+	UserID    int64      `json:"-"`
+}
+
+type WatchlistModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// watchlistSortColumn qualifies a sort column with the table it belongs to, since the
+// watchlist can be sorted both on its own columns and on the movie's
+func watchlistSortColumn(column string) string {
+	switch column {
+	case "position", "added_at", "watched_at":
+		return "watchlist_items." + column
+	default:
+		return "movies." + column
+	}
+}
+
+// lockWatchlist locks the user's row for the rest of the transaction. Every change to the
+// positions of a watchlist takes this lock first, so they apply one after the other. NO KEY
+// keeps it from blocking inserts elsewhere which reference the user
+func lockWatchlist(ctx context.Context, tx *sql.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR NO KEY UPDATE`, userID)
+	return err
+}
+
+// Add appends the movie to the end of the user's watchlist
+func (m WatchlistModel) Add(ctx context.Context, userID, movieID int64) (*WatchlistItem, error) {
+	query := `INSERT INTO watchlist_items (user_id, movie_id, position)
+				SELECT $1, $2, COALESCE(MAX(position), 0) + 1 FROM watchlist_items WHERE user_id = $1
+				RETURNING position, watched, watched_at, added_at`
+
+	item := &WatchlistItem{UserID: userID, MovieID: movieID}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := lockWatchlist(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRowContext(ctx, query, userID, movieID).Scan(&item.Position, &item.Watched, &item.WatchedAt, &item.AddedAt)
+	})
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_items_pkey"`:
+			return nil, ErrDuplicateWatchlistItem
+		case strings.Contains(err.Error(), `violates foreign key constraint "watchlist_items_movie_id_fkey"`):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return item, nil
+}
+
+// Get returns a single entry of the user's watchlist
+func (m WatchlistModel) Get(ctx context.Context, userID, movieID int64) (*WatchlistItem, error) {
+	query := `SELECT position, watched, watched_at, added_at
+				FROM watchlist_items
+				WHERE user_id = $1 AND movie_id = $2`
+
+	item := &WatchlistItem{UserID: userID, MovieID: movieID}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID).Scan(&item.Position, &item.Watched, &item.WatchedAt, &item.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return item, nil
+}
+
+// GetAll returns a page of the user's watchlist along with the movies on it. Trashed movies
+// are left out. A non-nil watched restricts the list to watched or unwatched entries
+func (m WatchlistModel) GetAll(ctx context.Context, userID int64, watched *bool, filters Filters) ([]*WatchlistItem, Metadata, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), watchlist_items.position, watchlist_items.watched,
+				watchlist_items.watched_at, watchlist_items.added_at,
+				movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+				movies.version, movies.average_rating, movies.rating_count
+				FROM watchlist_items
+				INNER JOIN movies ON movies.id = watchlist_items.movie_id
+				WHERE watchlist_items.user_id = $1
+				AND movies.deleted_at IS NULL
+				AND (watchlist_items.watched = $2 OR $2 IS NULL)
+				ORDER BY %s %s, movies.id ASC
+				LIMIT $3 OFFSET $4`, watchlistSortColumn(filters.sortColumn()), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := []interface{}{userID, sql.NullBool{Bool: watched != nil && *watched, Valid: watched != nil}, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	items := []*WatchlistItem{}
+	var totalRecords int
+
+	for rows.Next() {
+		item := &WatchlistItem{UserID: userID, Movie: &Movie{}}
+
+		err := rows.Scan(
+			&totalRecords,
+			&item.Position,
+			&item.Watched,
+			&item.WatchedAt,
+			&item.AddedAt,
+			&item.Movie.ID,
+			&item.Movie.CreatedAt,
+			&item.Movie.Title,
+			&item.Movie.Year,
+			&item.Movie.Runtime,
+			pq.Array(&item.Movie.Genres),
+			&item.Movie.Version,
+			&item.Movie.AverageRating,
+			&item.Movie.RatingCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		item.MovieID = item.Movie.ID
+		items = append(items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return items, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Update saves the watched state of the entry and moves it to item.Position, shifting the
+// entries in between so positions stay contiguous. Positions beyond the end of the list are
+// clamped to the last place
+func (m WatchlistModel) Update(ctx context.Context, item *WatchlistItem) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var current, count int32
+
+		// lock the user's whole list so concurrent reorders can't interleave
+		err := lockWatchlist(ctx, tx, item.UserID)
+		if err != nil {
+			return err
+		}
+
+		query := `SELECT position, (SELECT COUNT(*) FROM watchlist_items WHERE user_id = $1)
+					FROM watchlist_items
+					WHERE user_id = $1 AND movie_id = $2`
+
+		err = tx.QueryRowContext(ctx, query, item.UserID, item.MovieID).Scan(&current, &count)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNoRecordFound
+			default:
+				return err
+			}
+		}
+
+		target := item.Position
+		if target < 1 {
+			target = 1
+		}
+		if target > count {
+			target = count
+		}
+
+		switch {
+		case target < current:
+			query = `UPDATE watchlist_items SET position = position + 1
+						WHERE user_id = $1 AND position >= $2 AND position < $3`
+			_, err = tx.ExecContext(ctx, query, item.UserID, target, current)
+		case target > current:
+			query = `UPDATE watchlist_items SET position = position - 1
+						WHERE user_id = $1 AND position > $2 AND position <= $3`
+			_, err = tx.ExecContext(ctx, query, item.UserID, current, target)
+		}
+		if err != nil {
+			return err
+		}
+
+		query = `UPDATE watchlist_items SET position = $1, watched = $2, watched_at = $3
+					WHERE user_id = $4 AND movie_id = $5`
+
+		_, err = tx.ExecContext(ctx, query, target, item.Watched, item.WatchedAt, item.UserID, item.MovieID)
+		if err != nil {
+			return err
+		}
+
+		item.Position = target
+		return nil
+	})
+}
+
+// Remove takes the movie off the user's watchlist and closes the gap it leaves behind
+func (m WatchlistModel) Remove(ctx context.Context, userID, movieID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var position int32
+
+		err := lockWatchlist(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+
+		query := `DELETE FROM watchlist_items WHERE user_id = $1 AND movie_id = $2 RETURNING position`
+
+		err = tx.QueryRowContext(ctx, query, userID, movieID).Scan(&position)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrNoRecordFound
+			default:
+				return err
+			}
+		}
+
+		query = `UPDATE watchlist_items SET position = position - 1 WHERE user_id = $1 AND position > $2`
+
+		_, err = tx.ExecContext(ctx, query, userID, position)
+		return err
+	})
+}
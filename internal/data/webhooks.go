@@ -0,0 +1,533 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/validator"
+	"github.com/lib/pq"
+	"net/url"
+	"time"
+)
+
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventMovieRestored = "movie.restored"
+	EventUserActivated = "user.activated"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to
+var WebhookEvents = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventMovieRestored, EventUserActivated}
+
+// movieEvents maps the action of a movie revision to the event it fires
+var movieEvents = map[string]string{
+	RevisionCreate:   EventMovieCreated,
+	RevisionUpdate:   EventMovieUpdated,
+	RevisionDelete:   EventMovieDeleted,
+	RevisionUndelete: EventMovieRestored,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // every attempt failed, only a redelivery sends it again
+)
+
+// Webhook subscribes a URL to events. The secret signs every delivery and is only shown
+// to the client when the webhook is created
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int32     `json:"version"`
+	Secret    string    `json:"-"`
+}
+
+// WebhookDelivery is an event waiting to be, or already, sent to a webhook. Deliveries are
+// written in the same transaction as the change they report, which makes the table an outbox
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+
+	// the URL and secret of the webhook, only filled in on claimed deliveries
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt logs a single try at sending a delivery
+type WebhookAttempt struct {
+	ID         int64     `json:"id"`
+	DeliveryID int64     `json:"delivery_id"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// NewWebhookSecret returns a random secret to sign a webhook's deliveries with
+func NewWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) > 0, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+
+	for _, event := range webhook.Events {
+		if !validator.In(event, WebhookEvents...) {
+			v.AddError("events", fmt.Sprintf("unknown event %q", event))
+			break
+		}
+	}
+}
+
+// enqueueWebhooks adds a delivery of each payload to every active webhook subscribed to the
+// event, as part of the surrounding transaction
+func enqueueWebhooks(ctx context.Context, tx *sql.Tx, event string, payloads ...interface{}) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	js, err := json.Marshal(payloads)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO webhook_deliveries (webhook_id, event, payload)
+				SELECT webhooks.id, $1::text, payloads.payload
+				FROM webhooks, jsonb_array_elements($2::jsonb) WITH ORDINALITY AS payloads (payload, n)
+				WHERE webhooks.active AND $1::text = ANY(webhooks.events)
+				ORDER BY payloads.n, webhooks.id`
+
+	_, err = tx.ExecContext(ctx, query, event, js)
+	return err
+}
+
+type WebhookModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `INSERT INTO webhooks (url, secret, events, active)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := []interface{}{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+func (m WebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	query := `SELECT id, url, secret, events, active, created_at, version
+				FROM webhooks
+				WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var webhook Webhook
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.CreatedAt,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &webhook, nil
+}
+
+func (m WebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `SELECT id, url, secret, events, active, created_at, version
+				FROM webhooks
+				ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.URL,
+			&webhook.Secret,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.CreatedAt,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `UPDATE webhooks
+				SET url = $1, events = $2, active = $3, version = version + 1
+				WHERE id = $4 AND version = $5
+				RETURNING version`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Active, webhook.ID, webhook.Version}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the webhook along with its deliveries
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM webhooks WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNoRecordFound
+	}
+
+	return nil
+}
+
+const deliveryColumns = `webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event,
+				webhook_deliveries.payload, webhook_deliveries.status, webhook_deliveries.attempts,
+				webhook_deliveries.next_attempt_at, webhook_deliveries.last_status_code,
+				webhook_deliveries.last_error, webhook_deliveries.created_at, webhook_deliveries.delivered_at`
+
+func deliveryDest(delivery *WebhookDelivery) []interface{} {
+	return []interface{}{
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.LastStatusCode,
+		&delivery.LastError,
+		&delivery.CreatedAt,
+		&delivery.DeliveredAt,
+	}
+}
+
+// GetDeliveries pages through the deliveries of a webhook, only those with the given status
+// unless it's empty
+func (m WebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) OVER(), %s
+				FROM webhook_deliveries
+				WHERE webhook_id = $1 AND (status = $2 OR $2 = '')
+				ORDER BY %s %s, id DESC
+				LIMIT $3 OFFSET $4`, deliveryColumns, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	var totalRecords int
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, deliveryDest(&delivery)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, filters.CalculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m WebhookModel) GetDelivery(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	query := fmt.Sprintf(`SELECT %s
+				FROM webhook_deliveries
+				WHERE id = $1 AND webhook_id = $2`, deliveryColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var delivery WebhookDelivery
+
+	err := m.DB.QueryRowContext(ctx, query, id, webhookID).Scan(deliveryDest(&delivery)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &delivery, nil
+}
+
+// GetAttempts returns the log of a delivery's attempts, oldest first
+func (m WebhookModel) GetAttempts(ctx context.Context, deliveryID int64) ([]*WebhookAttempt, error) {
+	query := `SELECT id, delivery_id, status_code, error, duration_ms, created_at
+				FROM webhook_delivery_attempts
+				WHERE delivery_id = $1
+				ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []*WebhookAttempt{}
+
+	for rows.Next() {
+		var attempt WebhookAttempt
+
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.DeliveryID,
+			&attempt.StatusCode,
+			&attempt.Error,
+			&attempt.DurationMS,
+			&attempt.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, &attempt)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// ClaimDue picks up to limit pending deliveries of active webhooks which are due, pushing
+// their next attempt back by lease so that no other dispatcher claims them in the meantime.
+// Should the dispatcher die before recording the outcome, they are tried again once the lease runs out
+func (m WebhookModel) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := fmt.Sprintf(`WITH due AS (
+					SELECT webhook_deliveries.id
+					FROM webhook_deliveries
+					INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+					WHERE webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_at <= NOW()
+					AND webhooks.active
+					ORDER BY webhook_deliveries.next_attempt_at, webhook_deliveries.id
+					LIMIT $1
+					FOR UPDATE OF webhook_deliveries SKIP LOCKED
+				)
+				UPDATE webhook_deliveries
+				SET next_attempt_at = NOW() + make_interval(secs => $2), leased_until = NOW() + make_interval(secs => $2)
+				FROM due, webhooks
+				WHERE webhook_deliveries.id = due.id AND webhooks.id = webhook_deliveries.webhook_id
+				RETURNING %s, webhooks.url, webhooks.secret`, deliveryColumns)
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+
+		err := rows.Scan(append(deliveryDest(&delivery), &delivery.URL, &delivery.Secret)...)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// RecordAttempt logs the attempt and saves the delivery's new state, which the caller sets
+// according to the outcome
+func (m WebhookModel) RecordAttempt(ctx context.Context, delivery *WebhookDelivery, attempt *WebhookAttempt) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		query := `INSERT INTO webhook_delivery_attempts (delivery_id, status_code, error, duration_ms)
+					VALUES ($1, $2, $3, $4)
+					RETURNING id, created_at`
+
+		attempt.DeliveryID = delivery.ID
+
+		err := tx.QueryRowContext(ctx, query, attempt.DeliveryID, attempt.StatusCode, attempt.Error, attempt.DurationMS).Scan(&attempt.ID, &attempt.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		query = `UPDATE webhook_deliveries
+					SET status = $1, attempts = $2, next_attempt_at = $3, last_status_code = $4,
+					last_error = $5, delivered_at = $6, leased_until = NULL
+					WHERE id = $7`
+
+		args := []interface{}{
+			delivery.Status,
+			delivery.Attempts,
+			delivery.NextAttemptAt,
+			delivery.LastStatusCode,
+			delivery.LastError,
+			delivery.DeliveredAt,
+			delivery.ID,
+		}
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// Redeliver queues the delivery to be sent again straight away, whatever its status, with a
+// fresh set of attempts. The log of the previous attempts is kept. A delivery a dispatcher is
+// sending right now is left to it and ErrEditConflict returned, as queueing it again would
+// send it twice
+func (m WebhookModel) Redeliver(ctx context.Context, webhookID, id int64) (*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var delivery WebhookDelivery
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		query := `SELECT COALESCE(leased_until > NOW(), false)
+					FROM webhook_deliveries
+					WHERE id = $1 AND webhook_id = $2
+					FOR UPDATE`
+
+		var leased bool
+
+		err := tx.QueryRowContext(ctx, query, id, webhookID).Scan(&leased)
+		if err != nil {
+			return err
+		}
+
+		if leased {
+			return ErrEditConflict
+		}
+
+		query = fmt.Sprintf(`UPDATE webhook_deliveries
+					SET status = 'pending', attempts = 0, next_attempt_at = NOW(), delivered_at = NULL,
+					leased_until = NULL
+					WHERE id = $1
+					RETURNING %s`, deliveryColumns)
+
+		return tx.QueryRowContext(ctx, query, id).Scan(deliveryDest(&delivery)...)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecordFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &delivery, nil
+}
@@ -0,0 +1,248 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestApply runs the examples of RFC 6902 appendix A, along with the corners of pointer
+// escaping, copying and number comparison the appendix doesn't cover
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		// A.1 to A.16
+		{
+			name:  "adding an object member",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:  `{"baz": "qux", "foo": "bar"}`,
+		},
+		{
+			name:  "adding an array element",
+			doc:   `{"foo": ["bar", "baz"]}`,
+			patch: `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:  `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		{
+			name:  "removing an object member",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "remove", "path": "/baz"}]`,
+			want:  `{"foo": "bar"}`,
+		},
+		{
+			name:  "removing an array element",
+			doc:   `{"foo": ["bar", "qux", "baz"]}`,
+			patch: `[{"op": "remove", "path": "/foo/1"}]`,
+			want:  `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:  "replacing a value",
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:  `{"baz": "boo", "foo": "bar"}`,
+		},
+		{
+			name:  "moving a value",
+			doc:   `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch: `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:  `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{
+			name:  "moving an array element",
+			doc:   `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch: `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:  `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		{
+			name:  "testing a value: success",
+			doc:   `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			want:  `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{
+			name:    "testing a value: error",
+			doc:     `{"baz": "qux"}`,
+			patch:   `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:  "adding a nested member object",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:  `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		{
+			name:  "ignoring unrecognized elements",
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:  `{"foo": "bar", "baz": "qux"}`,
+		},
+		{
+			name:    "adding to a nonexistent target",
+			doc:     `{"foo": "bar"}`,
+			patch:   `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			wantErr: ErrPathNotFound,
+		},
+		{
+			name:  "~ escape ordering",
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:  `{"/": 9, "~1": 10}`,
+		},
+		{
+			name:    "comparing strings and numbers",
+			doc:     `{"/": 9, "~1": 10}`,
+			patch:   `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:  "adding an array value",
+			doc:   `{"foo": ["bar"]}`,
+			patch: `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:  `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+
+		// pointer escaping
+		{
+			name:  "~1 addresses a member with a slash",
+			doc:   `{"a/b": 1}`,
+			patch: `[{"op": "replace", "path": "/a~1b", "value": 2}]`,
+			want:  `{"a/b": 2}`,
+		},
+		{
+			name:  "~0 addresses a member with a tilde",
+			doc:   `{"m~n": 1}`,
+			patch: `[{"op": "remove", "path": "/m~0n"}]`,
+			want:  `{}`,
+		},
+		{
+			name:  "empty member name",
+			doc:   `{"": 1}`,
+			patch: `[{"op": "test", "path": "/", "value": 1}]`,
+			want:  `{"": 1}`,
+		},
+
+		// copy and move
+		{
+			name:  "copy shares nothing with the original",
+			doc:   `{"foo": {"bar": [1]}}`,
+			patch: `[{"op": "copy", "from": "/foo", "path": "/baz"}, {"op": "add", "path": "/baz/bar/-", "value": 2}]`,
+			want:  `{"foo": {"bar": [1]}, "baz": {"bar": [1, 2]}}`,
+		},
+		{
+			name:    "copying from a nonexistent location",
+			doc:     `{"foo": 1}`,
+			patch:   `[{"op": "copy", "from": "/bar", "path": "/baz"}]`,
+			wantErr: ErrPathNotFound,
+		},
+		{
+			name:    "moving into a child of the source",
+			doc:     `{"foo": {"bar": 1}}`,
+			patch:   `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:  "moving to a sibling sharing a prefix",
+			doc:   `{"foo": 1}`,
+			patch: `[{"op": "move", "from": "/foo", "path": "/foobar"}]`,
+			want:  `{"foobar": 1}`,
+		},
+
+		// numbers compare by value
+		{
+			name:  "numbers written differently are equal",
+			doc:   `{"n": 1, "m": [10]}`,
+			patch: `[{"op": "test", "path": "/n", "value": 1.0}, {"op": "test", "path": "/m", "value": [1e1]}]`,
+			want:  `{"n": 1, "m": [10]}`,
+		},
+		{
+			name:    "different numbers are not",
+			doc:     `{"n": 1}`,
+			patch:   `[{"op": "test", "path": "/n", "value": 1.5}]`,
+			wantErr: ErrTestFailed,
+		},
+
+		// malformed patches
+		{
+			name:    "leading zero index",
+			doc:     `{"foo": [1, 2]}`,
+			patch:   `[{"op": "remove", "path": "/foo/01"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "missing value",
+			doc:     `{"foo": 1}`,
+			patch:   `[{"op": "replace", "path": "/foo"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "unknown op",
+			doc:     `{"foo": 1}`,
+			patch:   `[{"op": "frobnicate", "path": "/foo"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertJSON(t, got, tt.want)
+		})
+	}
+}
+
+func TestApplyLeavesDocumentOnFailure(t *testing.T) {
+	doc := []byte(`{"foo": ["bar"]}`)
+
+	_, err := Apply(doc, []byte(`[{"op": "add", "path": "/foo/-", "value": "baz"}, {"op": "test", "path": "/foo/0", "value": "qux"}]`))
+	if !errors.Is(err, ErrTestFailed) {
+		t.Fatalf("got error %v; want %v", err, ErrTestFailed)
+	}
+
+	assertJSON(t, doc, `{"foo": ["bar"]}`)
+}
+
+func TestMergePatch(t *testing.T) {
+	got, err := MergePatch([]byte(`{"a": "b", "c": {"d": "e", "f": "g"}}`), []byte(`{"a": "z", "c": {"f": null}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertJSON(t, got, `{"a": "z", "c": {"d": "e"}}`)
+}
+
+// assertJSON compares documents by value, so member order and number formatting don't matter
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	g, err := decode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := decode([]byte(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equal(g, w) {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
@@ -2,9 +2,14 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"github.com/go-mail/mail/v2"
 	"html/template"
+	"io/fs"
+	"path"
 	"time"
 )
 
@@ -16,63 +21,157 @@ import (
 //go:embed "templates"
 var templateFs embed.FS
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+// Message is an email rendered from a template, ready to hand to a Transport
+type Message struct {
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	Subject   string `json:"subject"`
+	PlainBody string `json:"plain_body"`
+	HTMLBody  string `json:"html_body"`
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
+// mail builds the MIME message sent over SMTP or written to disk
+func (msg Message) mail() *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("From", msg.From)
+	m.SetHeader("To", msg.To)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetDateHeader("Date", time.Now())
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
 
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+// Transport delivers rendered messages. SMTPTransport sends them for real, the others keep
+// them around for development and tests. Send must give up once ctx is done
+type Transport interface {
+	Send(ctx context.Context, msg Message) error
+}
 
-	return Mailer{
-		dialer: dialer,
-		sender: sender,
-	}
+// ErrUnknownTemplate is returned for a template which isn't in the templates directory
+var ErrUnknownTemplate = errors.New("unknown email template")
+
+// blocks are the templates every email template must define
+var blocks = []string{"subject", "plainBody", "htmlBody"}
+
+// sampleData holds, for every template, data with each key the template reads. Templates are
+// checked against it at startup and rendered with it in previews
+var sampleData = map[string]map[string]interface{}{
+	"token_activation.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	},
+	"token_password_reset.tmpl": {
+		"passwordResetToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+	},
+	"user_welcome.tmpl": {
+		"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+		"userID":          42,
+	},
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+type Mailer struct {
+	transport Transport
+	sender    string
+	templates map[string]*template.Template
+}
 
-	tmpl, err := template.New("email").ParseFS(templateFs, "templates/"+templateFile)
+// New parses every email template, returning an error if one doesn't parse, misses a block
+// or fails to render its sample data, so that broken templates are caught before any email
+// is sent
+func New(transport Transport, sender string) (Mailer, error) {
+	templates, err := parseTemplates()
 	if err != nil {
-		return err
+		return Mailer{}, err
 	}
 
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	return Mailer{
+		transport: transport,
+		sender:    sender,
+		templates: templates,
+	}, nil
+}
+
+func parseTemplates() (map[string]*template.Template, error) {
+	files, err := fs.Glob(templateFs, "templates/*.tmpl")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
-	if err != nil {
-		return err
+	templates := make(map[string]*template.Template, len(files))
+
+	for _, file := range files {
+		name := path.Base(file)
+
+		// a key missing from the data is an error rather than "<no value>" in the email
+		tmpl, err := template.New("email").Option("missingkey=error").ParseFS(templateFs, file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			if tmpl.Lookup(block) == nil {
+				return nil, fmt.Errorf("template %s: no %q template defined", name, block)
+			}
+		}
+
+		data, ok := sampleData[name]
+		if !ok {
+			return nil, fmt.Errorf("template %s: no sample data", name)
+		}
+
+		_, err = render(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+
+		templates[name] = tmpl
+	}
+
+	return templates, nil
+}
+
+// render executes each block of tmpl with data into a message with no sender or recipient
+func render(tmpl *template.Template, data interface{}) (Message, error) {
+	var out [3]bytes.Buffer
+
+	for i, block := range blocks {
+		err := tmpl.ExecuteTemplate(&out[i], block, data)
+		if err != nil {
+			return Message{}, err
+		}
 	}
 
-	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	return Message{Subject: out[0].String(), PlainBody: out[1].String(), HTMLBody: out[2].String()}, nil
+}
+
+// Render renders the template with data into a message from the sender to recipient
+func (m Mailer) Render(recipient, templateFile string, data interface{}) (Message, error) {
+	tmpl, ok := m.templates[templateFile]
+	if !ok {
+		return Message{}, fmt.Errorf("%w %q", ErrUnknownTemplate, templateFile)
+	}
+
+	msg, err := render(tmpl, data)
 	if err != nil {
-		return err
+		return Message{}, err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg.From, msg.To = m.sender, recipient
 
-	for i := 1; i <= 3; i++ {
+	return msg, nil
+}
 
-		err = m.dialer.DialAndSend(msg)
-		if err == nil {
-			return nil
-		}
+// Preview renders the template with its sample data
+func (m Mailer) Preview(templateFile string) (Message, error) {
+	return m.Render("", templateFile, sampleData[templateFile])
+}
 
-		time.Sleep(500 * time.Millisecond)
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data interface{}) error {
+	msg, err := m.Render(recipient, templateFile, data)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return m.transport.Send(ctx, msg)
 }
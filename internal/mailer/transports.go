@@ -0,0 +1,241 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/4925k/greenlight/internal/jsonlog"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpTimeout bounds a send whose context carries no deadline of its own
+const smtpTimeout = 30 * time.Second
+
+// SMTPTransport sends messages through an SMTP server, upgrading the connection with
+// STARTTLS when the server offers it or speaking TLS from the start on port 465
+type SMTPTransport struct {
+	host     string
+	port     int
+	username string
+	password string
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	return &SMTPTransport{host: host, port: port, username: username, password: password}
+}
+
+// Send makes a single attempt at delivering the message, retrying is left to the caller. The
+// whole conversation with the server is bound by ctx, so a message is never still going out
+// once the caller has given up on it
+func (t *SMTPTransport) Send(ctx context.Context, msg Message) error {
+	err := t.send(ctx, msg)
+	if err == nil {
+		return nil
+	}
+
+	// report why the connection was cut rather than the i/o timeout it caused. The connection
+	// shares the context's deadline and may hit it before the context notices
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+func (t *SMTPTransport) send(ctx context.Context, msg Message) error {
+	from, err := netmail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := netmail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.host, strconv.Itoa(t.port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	// unblock whatever the conversation is waiting on as soon as ctx is done
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	tlsConfig := &tls.Config{ServerName: t.host}
+
+	var c net.Conn = conn
+	if t.port == 465 {
+		c = tls.Client(conn, tlsConfig)
+	}
+
+	client, err := smtp.NewClient(c, t.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if t.port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			err = client.StartTLS(tlsConfig)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if t.username != "" {
+		auth := smtp.PlainAuth("", t.username, t.password, t.host)
+		if _, mechanisms := client.Extension("AUTH"); strings.Contains(mechanisms, "CRAM-MD5") {
+			auth = smtp.CRAMMD5Auth(t.username, t.password)
+		}
+
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+
+	err = client.Rcpt(to.Address)
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mail().WriteTo(w)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	// the server has taken the message by now, failing to say goodbye must not get it sent twice
+	client.Quit()
+
+	return nil
+}
+
+// FileTransport writes every message to its own .eml file in a directory, which mail clients
+// open as they would a received email
+type FileTransport struct {
+	dir string
+}
+
+// NewFileTransport returns a FileTransport writing to dir, creating the directory if needed
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Send(ctx context.Context, msg Message) error {
+	// files are named after the time they were written so they list in order
+	pattern := fmt.Sprintf("%s-*.eml", time.Now().UTC().Format("20060102T150405.000Z"))
+
+	f, err := os.CreateTemp(t.dir, pattern)
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mail().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LogTransport prints messages to the log rather than sending them
+type LogTransport struct {
+	logger *jsonlog.Logger
+}
+
+func NewLogTransport(logger *jsonlog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Send(ctx context.Context, msg Message) error {
+	t.logger.PrintInfo("email", map[string]string{
+		"from":    msg.From,
+		"to":      msg.To,
+		"subject": msg.Subject,
+		"body":    msg.PlainBody,
+	})
+
+	return nil
+}
+
+// MemoryTransport keeps the messages it is given, for tests to look into
+type MemoryTransport struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(ctx context.Context, msg Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = append(t.sent, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Message(nil), t.sent...)
+}
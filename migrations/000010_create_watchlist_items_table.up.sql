@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS watchlist_items (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    position integer NOT NULL,
+    watched bool NOT NULL DEFAULT false,
+    watched_at timestamp(0) with time zone,
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, movie_id),
+    -- deferred since moving an entry shifts the ones in between with a single UPDATE, which goes
+    -- through duplicate positions along the way
+    CONSTRAINT watchlist_items_position_key UNIQUE (user_id, position) DEFERRABLE INITIALLY DEFERRED
+);
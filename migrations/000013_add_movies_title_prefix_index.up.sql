@@ -0,0 +1,2 @@
+-- lets the autocomplete query use an index for its lower(title) LIKE 'prefix%' condition
+CREATE INDEX IF NOT EXISTS movies_title_prefix_idx ON movies (lower(title) text_pattern_ops);
@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'admin';
+DROP TABLE IF EXISTS webhook_delivery_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS movies_record_change_update ON movies;
+DROP TRIGGER IF EXISTS movies_record_change_insert_delete ON movies;
+DROP FUNCTION IF EXISTS record_movie_change();
+DROP TABLE IF EXISTS movie_changes;
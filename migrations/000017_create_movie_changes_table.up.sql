@@ -0,0 +1,70 @@
+-- needs PostgreSQL 13 or later for xid8 and pg_current_xact_id, and for pg_current_snapshot
+-- which MovieChangeModel reads the log with
+CREATE TABLE IF NOT EXISTS movie_changes (
+    id bigserial PRIMARY KEY,
+    movie_id bigint NOT NULL,
+    action text NOT NULL,
+    version integer NOT NULL,
+    title text NOT NULL,
+    year integer NOT NULL,
+    runtime integer NOT NULL,
+    genres text[] NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    -- changes are read in the order of the transactions writing them rather than by id, see
+    -- MovieChangeModel.GetAfter, so writers don't need to take turns on a global lock
+    txid xid8 NOT NULL DEFAULT pg_current_xact_id()
+);
+
+CREATE INDEX IF NOT EXISTS movie_changes_created_at_idx ON movie_changes (created_at);
+CREATE INDEX IF NOT EXISTS movie_changes_txid_idx ON movie_changes (txid, id);
+
+CREATE OR REPLACE FUNCTION record_movie_change() RETURNS trigger AS $$
+DECLARE
+    change_action text;
+    movie movies;
+    change_id bigint;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        change_action := 'create';
+        movie := NEW;
+    ELSIF TG_OP = 'DELETE' THEN
+        -- purging the trash, the movie was reported deleted when it was trashed
+        IF OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+
+        change_action := 'delete';
+        movie := OLD;
+    ELSE
+        movie := NEW;
+
+        IF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+            change_action := 'delete';
+        ELSIF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+            change_action := 'undelete';
+        ELSE
+            change_action := 'update';
+        END IF;
+    END IF;
+
+    INSERT INTO movie_changes (movie_id, action, version, title, year, runtime, genres)
+    VALUES (movie.id, change_action, movie.version, movie.title, movie.year, movie.runtime, movie.genres)
+    RETURNING id INTO change_id;
+
+    PERFORM pg_notify('movie_changes', change_id::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_record_change_insert_delete
+    AFTER INSERT OR DELETE ON movies
+    FOR EACH ROW EXECUTE PROCEDURE record_movie_change();
+
+-- rating aggregates are refreshed in place and aren't a change of the movie itself
+CREATE TRIGGER movies_record_change_update
+    AFTER UPDATE ON movies
+    FOR EACH ROW
+    WHEN ((OLD.title, OLD.year, OLD.runtime, OLD.genres, OLD.version, OLD.deleted_at)
+        IS DISTINCT FROM (NEW.title, NEW.year, NEW.runtime, NEW.genres, NEW.version, NEW.deleted_at))
+    EXECUTE PROCEDURE record_movie_change();